@@ -17,7 +17,7 @@ import (
 func main() {
 	cliFlags := flag.NewFlagSet("jsonrpc-watch", flag.ExitOnError)
 	pServerUrl := cliFlags.String("c", "", "jsonrpc server url, wss?, h2c? prefixed, can be in env JSONRPC_CONNECT, default is ws://127.0.0.1:9990")
-	pRetry := cliFlags.Int("retry", 1, "retry times")
+	pRetry := cliFlags.Int("retry", 1, "retry times of connecting and reconnecting, 0 means retrying forever")
 	var headerFlags jlibhttp.HeaderFlags
 	cliFlags.Var(&headerFlags, "header", "attached http headers")
 	cliFlags.Parse(os.Args[1:])
@@ -81,6 +81,14 @@ func main() {
 		fmt.Println(repr)
 	})
 
+	sc.SetReconnect(&jlibhttp.ReconnectConfig{
+		InitialDelay: time.Second,
+		MaxRetries:   *pRetry,
+	})
+	sc.OnReconnected(func() {
+		log.Infof("reconnected")
+	})
+
 	watcher := &jsonrpcWatcher{
 		retrylimit: *pRetry,
 		sc:         sc,
@@ -109,7 +117,7 @@ func (self *jsonrpcWatcher) run() {
 
 				self.connectretry++
 				log.Infof("connect failed %d/%d times", self.connectretry, self.retrylimit)
-				if self.connectretry >= self.retrylimit {
+				if self.retrylimit > 0 && self.connectretry >= self.retrylimit {
 					break
 				} else {
 					time.Sleep(1 * time.Second)
@@ -139,7 +147,8 @@ func (self *jsonrpcWatcher) connect() error {
 	if self.method != "" {
 		reqId := jlib.NewUuid()
 		reqmsg := jlib.NewRequestMessage(reqId, self.method, self.params)
-		resmsg, err := self.sc.Call(ctx, reqmsg)
+		// the call is replayed after reconnecting
+		resmsg, err := self.sc.Subscribe(ctx, reqmsg)
 		if err != nil {
 			log.Panicf("rpc error: %s", err)
 			os.Exit(1)
@@ -150,6 +159,6 @@ func (self *jsonrpcWatcher) connect() error {
 		}
 		fmt.Println(repr)
 	}
-	// wait loop
+	// wait until the client is closed or gives up reconnecting
 	return self.sc.Wait()
 }
@@ -0,0 +1,638 @@
+package jlib
+
+// a hand written json codec for messages, the message envelope is
+// scanned and encoded in a single pass without reflection, params and
+// results of decoded messages are kept as raw bytes until they are
+// asked for.
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// the max nesting depth of json values, the same as encoding/json
+const maxScanDepth = 10000
+
+var errSyntax = errors.New("json syntax error")
+
+// rawValue keeps a json value undecoded until it is asked for
+type rawValue struct {
+	data  []byte
+	once  sync.Once
+	value interface{}
+}
+
+func newRawValue(data []byte) *rawValue {
+	// copy the bytes as the input buffer may be reused
+	return &rawValue{data: append([]byte(nil), data...)}
+}
+
+func (self *rawValue) load() interface{} {
+	self.once.Do(func() {
+		dec := json.NewDecoder(bytes.NewReader(self.data))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err == nil {
+			self.value = v
+		}
+	})
+	return self.value
+}
+
+// scanner
+type scanner struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (self *scanner) skipSpace() {
+	for self.pos < len(self.data) {
+		switch self.data[self.pos] {
+		case ' ', '\t', '\r', '\n':
+			self.pos++
+		default:
+			return
+		}
+	}
+}
+
+// value skips the next json value and returns its span
+func (self *scanner) value() ([]byte, error) {
+	self.skipSpace()
+	start := self.pos
+	if err := self.skipValue(); err != nil {
+		return nil, err
+	}
+	return self.data[start:self.pos], nil
+}
+
+func (self *scanner) skipValue() error {
+	if self.pos >= len(self.data) {
+		return errSyntax
+	}
+	switch c := self.data[self.pos]; {
+	case c == '{':
+		return self.object(nil)
+	case c == '[':
+		return self.array(nil)
+	case c == '"':
+		_, err := self.skipString()
+		return err
+	case c == 't':
+		return self.literal("true")
+	case c == 'f':
+		return self.literal("false")
+	case c == 'n':
+		return self.literal("null")
+	case c == '-' || (c >= '0' && c <= '9'):
+		return self.skipNumber()
+	}
+	return errSyntax
+}
+
+func (self *scanner) literal(lit string) error {
+	if len(self.data)-self.pos < len(lit) || string(self.data[self.pos:self.pos+len(lit)]) != lit {
+		return errSyntax
+	}
+	self.pos += len(lit)
+	return nil
+}
+
+// skipString skips a json string, returns whether there are escapes
+// in the string
+func (self *scanner) skipString() (bool, error) {
+	escaped := false
+	self.pos++ // the opening quote
+	for self.pos < len(self.data) {
+		c := self.data[self.pos]
+		switch {
+		case c == '"':
+			self.pos++
+			return escaped, nil
+		case c == '\\':
+			escaped = true
+			self.pos++
+			if self.pos >= len(self.data) {
+				return escaped, errSyntax
+			}
+			switch self.data[self.pos] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+				self.pos++
+			case 'u':
+				if len(self.data)-self.pos < 5 {
+					return escaped, errSyntax
+				}
+				for _, h := range self.data[self.pos+1 : self.pos+5] {
+					if !isHex(h) {
+						return escaped, errSyntax
+					}
+				}
+				self.pos += 5
+			default:
+				return escaped, errSyntax
+			}
+		case c < 0x20:
+			return escaped, errSyntax
+		default:
+			self.pos++
+		}
+	}
+	return escaped, errSyntax
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (self *scanner) skipDigits() int {
+	n := 0
+	for self.pos < len(self.data) && isDigit(self.data[self.pos]) {
+		self.pos++
+		n++
+	}
+	return n
+}
+
+func (self *scanner) skipNumber() error {
+	if self.data[self.pos] == '-' {
+		self.pos++
+	}
+	if self.pos >= len(self.data) {
+		return errSyntax
+	}
+	if self.data[self.pos] == '0' {
+		self.pos++
+	} else if self.skipDigits() == 0 {
+		return errSyntax
+	}
+	if self.pos < len(self.data) && self.data[self.pos] == '.' {
+		self.pos++
+		if self.skipDigits() == 0 {
+			return errSyntax
+		}
+	}
+	if self.pos < len(self.data) && (self.data[self.pos] == 'e' || self.data[self.pos] == 'E') {
+		self.pos++
+		if self.pos < len(self.data) && (self.data[self.pos] == '+' || self.data[self.pos] == '-') {
+			self.pos++
+		}
+		if self.skipDigits() == 0 {
+			return errSyntax
+		}
+	}
+	return nil
+}
+
+// object scans a json object, fn is called on each quoted key and
+// value pair if not nil
+func (self *scanner) object(fn func(key []byte, escaped bool, value []byte) error) error {
+	if self.depth++; self.depth > maxScanDepth {
+		return errSyntax
+	}
+	defer func() { self.depth-- }()
+
+	self.pos++ // the opening brace
+	self.skipSpace()
+	if self.pos < len(self.data) && self.data[self.pos] == '}' {
+		self.pos++
+		return nil
+	}
+	for {
+		self.skipSpace()
+		if self.pos >= len(self.data) || self.data[self.pos] != '"' {
+			return errSyntax
+		}
+		keyStart := self.pos
+		escaped, err := self.skipString()
+		if err != nil {
+			return err
+		}
+		key := self.data[keyStart:self.pos]
+
+		self.skipSpace()
+		if self.pos >= len(self.data) || self.data[self.pos] != ':' {
+			return errSyntax
+		}
+		self.pos++
+		value, err := self.value()
+		if err != nil {
+			return err
+		}
+		if fn != nil {
+			if err := fn(key, escaped, value); err != nil {
+				return err
+			}
+		}
+
+		self.skipSpace()
+		if self.pos >= len(self.data) {
+			return errSyntax
+		}
+		switch self.data[self.pos] {
+		case ',':
+			self.pos++
+		case '}':
+			self.pos++
+			return nil
+		default:
+			return errSyntax
+		}
+	}
+}
+
+// array scans a json array, fn is called on each element if not nil
+func (self *scanner) array(fn func(elem []byte) error) error {
+	if self.depth++; self.depth > maxScanDepth {
+		return errSyntax
+	}
+	defer func() { self.depth-- }()
+
+	self.pos++ // the opening bracket
+	self.skipSpace()
+	if self.pos < len(self.data) && self.data[self.pos] == ']' {
+		self.pos++
+		return nil
+	}
+	for {
+		elem, err := self.value()
+		if err != nil {
+			return err
+		}
+		if fn != nil {
+			if err := fn(elem); err != nil {
+				return err
+			}
+		}
+		self.skipSpace()
+		if self.pos >= len(self.data) {
+			return errSyntax
+		}
+		switch self.data[self.pos] {
+		case ',':
+			self.pos++
+		case ']':
+			self.pos++
+			return nil
+		default:
+			return errSyntax
+		}
+	}
+}
+
+// unquote converts a scanned json string into go string
+func unquote(data []byte, escaped bool) (string, error) {
+	if !escaped && utf8.Valid(data) {
+		return string(data[1 : len(data)-1]), nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+func isNull(data []byte) bool {
+	return string(data) == "null"
+}
+
+// encoder
+
+// appendMessage appends the json encoding of msg to buf, the output
+// is the same as json.Marshal(msg.Interface()) except that metadata
+// is encoded, which is absent in the templates
+func appendMessage(buf []byte, msg Message) ([]byte, error) {
+	var err error
+	switch m := msg.(type) {
+	case *RequestMessage:
+		buf = append(buf, `{"jsonrpc":"2.0","method":`...)
+		buf = appendString(buf, m.Method)
+		buf = append(buf, `,"id":`...)
+		if buf, err = appendValue(buf, m.Id); err != nil {
+			return nil, err
+		}
+		buf = append(buf, `,"params":`...)
+		if buf, err = appendParams(buf, m.Params, m.rawParams, m.paramsAreList); err != nil {
+			return nil, err
+		}
+		buf = appendTraceId(buf, m.traceId)
+		buf = appendMetadata(buf, m.metadata)
+	case *NotifyMessage:
+		buf = append(buf, `{"jsonrpc":"2.0","method":`...)
+		buf = appendString(buf, m.Method)
+		buf = append(buf, `,"params":`...)
+		if buf, err = appendParams(buf, m.Params, m.rawParams, m.paramsAreList); err != nil {
+			return nil, err
+		}
+		buf = appendTraceId(buf, m.traceId)
+		buf = appendMetadata(buf, m.metadata)
+	case *ResultMessage:
+		buf = append(buf, `{"jsonrpc":"2.0","id":`...)
+		if buf, err = appendValue(buf, m.Id); err != nil {
+			return nil, err
+		}
+		buf = append(buf, `,"result":`...)
+		if m.Result == nil && m.rawResult != nil {
+			buf = appendCompact(buf, m.rawResult.data)
+		} else if buf, err = appendValue(buf, m.Result); err != nil {
+			return nil, err
+		}
+		buf = appendTraceId(buf, m.traceId)
+		buf = appendMetadata(buf, m.metadata)
+	case *ErrorMessage:
+		buf = append(buf, `{"jsonrpc":"2.0","id":`...)
+		if buf, err = appendValue(buf, m.Id); err != nil {
+			return nil, err
+		}
+		buf = append(buf, `,"error":`...)
+		if buf, err = appendRPCError(buf, m.Error); err != nil {
+			return nil, err
+		}
+		buf = appendTraceId(buf, m.traceId)
+		buf = appendMetadata(buf, m.metadata)
+	case *BatchMessage:
+		buf = append(buf, '[')
+		for i, elem := range m.Messages {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			if buf, err = appendMessage(buf, elem); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, ']'), nil
+	default:
+		data, err := json.Marshal(msg.Interface())
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, data...), nil
+	}
+	return append(buf, '}'), nil
+}
+
+func appendTraceId(buf []byte, traceId string) []byte {
+	if traceId == "" {
+		return buf
+	}
+	buf = append(buf, `,"traceid":`...)
+	return appendString(buf, traceId)
+}
+
+func appendMetadata(buf []byte, md Metadata) []byte {
+	if len(md) == 0 {
+		return buf
+	}
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf = append(buf, ',')
+	buf = appendString(buf, MetadataKey)
+	buf = append(buf, ":{"...)
+	for i, k := range keys {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendString(buf, k)
+		buf = append(buf, ':')
+		buf = appendString(buf, md[k])
+	}
+	return append(buf, '}')
+}
+
+func appendParams(buf []byte, params []interface{}, raw *rawValue, paramsAreList bool) ([]byte, error) {
+	if params == nil && raw != nil {
+		return appendCompact(buf, raw.data), nil
+	}
+	if paramsAreList || len(params) == 0 {
+		return appendValue(buf, params)
+	}
+	return appendValue(buf, params[0])
+}
+
+func appendRPCError(buf []byte, rpcErr *RPCError) ([]byte, error) {
+	if rpcErr == nil {
+		return append(buf, "null"...), nil
+	}
+	buf = append(buf, `{"code":`...)
+	buf = strconv.AppendInt(buf, int64(rpcErr.Code), 10)
+	buf = append(buf, `,"message":`...)
+	buf = appendString(buf, rpcErr.Message)
+	if rpcErr.Data != nil {
+		var err error
+		buf = append(buf, `,"data":`...)
+		if buf, err = appendValue(buf, rpcErr.Data); err != nil {
+			return nil, err
+		}
+	}
+	return append(buf, '}'), nil
+}
+
+// appendValue encodes the value types commonly seen in messages,
+// other types are encoded by encoding/json
+func appendValue(buf []byte, v interface{}) ([]byte, error) {
+	switch x := v.(type) {
+	case nil:
+		return append(buf, "null"...), nil
+	case bool:
+		return strconv.AppendBool(buf, x), nil
+	case string:
+		return appendString(buf, x), nil
+	case json.Number:
+		if isNumber(string(x)) {
+			return append(buf, x...), nil
+		}
+	case int:
+		return strconv.AppendInt(buf, int64(x), 10), nil
+	case int32:
+		return strconv.AppendInt(buf, int64(x), 10), nil
+	case int64:
+		return strconv.AppendInt(buf, x, 10), nil
+	case uint:
+		return strconv.AppendUint(buf, uint64(x), 10), nil
+	case uint32:
+		return strconv.AppendUint(buf, uint64(x), 10), nil
+	case uint64:
+		return strconv.AppendUint(buf, x, 10), nil
+	case float64:
+		if !math.IsNaN(x) && !math.IsInf(x, 0) {
+			return appendFloat(buf, x), nil
+		}
+	case []interface{}:
+		if x == nil {
+			return append(buf, "null"...), nil
+		}
+		var err error
+		buf = append(buf, '[')
+		for i, elem := range x {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			if buf, err = appendValue(buf, elem); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, ']'), nil
+	case map[string]interface{}:
+		if x == nil {
+			return append(buf, "null"...), nil
+		}
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var err error
+		buf = append(buf, '{')
+		for i, k := range keys {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = appendString(buf, k)
+			buf = append(buf, ':')
+			if buf, err = appendValue(buf, x[k]); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, '}'), nil
+	case *RPCError:
+		return appendRPCError(buf, x)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, data...), nil
+}
+
+// appendFloat formats floats the same way as encoding/json
+func appendFloat(buf []byte, f float64) []byte {
+	abs := math.Abs(f)
+	format := byte('f')
+	if abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	buf = strconv.AppendFloat(buf, f, format, -1, 64)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(buf)
+		if n >= 4 && buf[n-4] == 'e' && buf[n-3] == '-' && buf[n-2] == '0' {
+			buf[n-2] = buf[n-1]
+			buf = buf[:n-1]
+		}
+	}
+	return buf
+}
+
+func isNumber(s string) bool {
+	sc := scanner{data: []byte(s)}
+	if len(s) == 0 || (s[0] != '-' && !isDigit(s[0])) {
+		return false
+	}
+	return sc.skipNumber() == nil && sc.pos == len(s)
+}
+
+// appendString encodes a string the same way as encoding/json, rare
+// characters which need escaping are delegated to encoding/json
+func appendString(buf []byte, s string) []byte {
+	origLen := len(buf)
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			var esc string
+			switch c {
+			case '"':
+				esc = `\"`
+			case '\\':
+				esc = `\\`
+			case '\n':
+				esc = `\n`
+			case '\r':
+				esc = `\r`
+			case '\t':
+				esc = `\t`
+			default:
+				return appendStringSlow(buf[:origLen], s)
+			}
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, esc...)
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if (r == utf8.RuneError && size == 1) || r == '\u2028' || r == '\u2029' {
+			return appendStringSlow(buf[:origLen], s)
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
+
+func appendStringSlow(buf []byte, s string) []byte {
+	data, _ := json.Marshal(s)
+	return append(buf, data...)
+}
+
+// appendCompact appends a scanned json value with insignificant
+// spaces elided and html characters escaped like encoding/json
+func appendCompact(buf []byte, data []byte) []byte {
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if !inString {
+			switch c {
+			case ' ', '\t', '\r', '\n':
+				continue
+			case '"':
+				inString = true
+			}
+			buf = append(buf, c)
+			continue
+		}
+		switch c {
+		case '\\':
+			buf = append(buf, c, data[i+1])
+			i++
+		case '"':
+			inString = false
+			buf = append(buf, c)
+		case '<', '>', '&':
+			buf = append(buf, `\u00`...)
+			buf = append(buf, hexChars[c>>4], hexChars[c&0xF])
+		case 0xE2:
+			// U+2028 and U+2029
+			if i+2 < len(data) && data[i+1] == 0x80 && data[i+2]&^1 == 0xA8 {
+				buf = append(buf, `\u202`...)
+				buf = append(buf, hexChars[data[i+2]&0xF])
+				i += 2
+			} else {
+				buf = append(buf, c)
+			}
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
+
+const hexChars = "0123456789abcdef"
@@ -3,6 +3,10 @@ package jlib
 import ()
 
 // error defination https://www.jsonrpc.org/specification#error_object
+//
+// codes from -32768 to -32000 are reserved, applications are expected
+// to register their codes out of the reserved range and the codes of
+// jlib's errors with an ErrorRegistry
 var (
 	ErrServerError = &RPCError{100, "server error", nil}
 	ErrNilId       = &RPCError{102, "nil message id", nil}
@@ -22,12 +26,28 @@ var (
 	ErrBadResource = &RPCError{201, "bad resource", nil}
 	ErrLiveExit    = &RPCError{202, "live exit", nil}
 
-	ErrNotAllowed = &RPCError{406, "type not allowed", nil}
-	ErrAuthFailed = &RPCError{401, "auth failed", nil}
+	ErrAuthFailed  = &RPCError{401, "auth failed", nil}
+	ErrForbidden   = &RPCError{403, "forbidden", nil}
+	ErrNotAllowed  = &RPCError{406, "type not allowed", nil}
+	ErrRateLimited = &RPCError{429, "rate limited", nil}
 
 	ErrInvalidSchema = &RPCError{-32633, "invalid schema", nil}
 )
 
+// the errors of jlib out of the reserved range, whose codes cannot
+// be registered by applications
+var builtinErrors = []*RPCError{
+	ErrServerError, ErrNilId, ErrMessageType,
+	ErrTimeout, ErrBadResource, ErrLiveExit,
+	ErrAuthFailed, ErrForbidden, ErrNotAllowed, ErrRateLimited,
+}
+
+// the range of codes reserved by the JSONRPC spec
+const (
+	ReservedCodeMin = -32768
+	ReservedCodeMax = -32000
+)
+
 func ParamsError(message string) *RPCError {
 	return &RPCError{-32602, message, nil}
 }
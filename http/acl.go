@@ -0,0 +1,186 @@
+package jlibhttp
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/superisaac/jlib"
+	"path"
+)
+
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// ACLRule allows or denies the methods matching glob patterns(in the
+// syntax of path.Match) to the subjects of the rule. A subject
+// matches if its username matches any of Users, or it has any of
+// Roles, or all the Claims match its settings. A rule without
+// subjects applies to everyone including the anonymous.
+type ACLRule struct {
+	Users []string `yaml:"users,omitempty" json:"users,omitempty"`
+	Roles []string `yaml:"roles,omitempty" json:"roles,omitempty"`
+
+	// settings keys mapped to glob patterns of the values, e.g. a
+	// claim of the jwt
+	Claims map[string]string `yaml:"claims,omitempty" json:"claims,omitempty"`
+
+	Allow []string `yaml:"allow,omitempty" json:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty" json:"deny,omitempty"`
+}
+
+// ACLConfig authorizes the methods called by users, a method denied
+// by any matching rule is denied, otherwise it's allowed if any
+// matching rule allows it, otherwise the default policy applies.
+//
+// Besides the rules, the settings of a user may carry the lists
+// "allow" and "deny" of method patterns, and "roles" of the user.
+type ACLConfig struct {
+	// the policy when no rule allows or denies a method, either
+	// "allow" or "deny", the default is "deny"
+	Default string    `yaml:"default,omitempty" json:"default,omitempty"`
+	Rules   []ACLRule `yaml:"rules,omitempty" json:"rules,omitempty"`
+}
+
+type aclContextKey struct{}
+
+// ACLFromContext returns the ACL put in the context by AuthHandler
+func ACLFromContext(ctx context.Context) (*ACLConfig, bool) {
+	if v := ctx.Value(aclContextKey{}); v != nil {
+		acl, ok := v.(*ACLConfig)
+		return acl, ok
+	}
+	return nil, false
+}
+
+// Authorize checks the user is allowed to call the method, authInfo
+// is nil for anonymous users. ErrAuthFailed is returned if an
+// anonymous user is denied and ErrForbidden if an authenticated user
+// is denied.
+func (self *ACLConfig) Authorize(authInfo *AuthInfo, method string) error {
+	if self == nil {
+		return nil
+	}
+	allowed := self.Default == ACLAllow
+	check := func(allow, deny []string) bool {
+		if matchAny(deny, method) {
+			allowed = false
+			return true
+		}
+		if matchAny(allow, method) {
+			allowed = true
+		}
+		return false
+	}
+
+	if authInfo != nil {
+		if check(settingStrings(authInfo.Settings, "allow"), settingStrings(authInfo.Settings, "deny")) {
+			return denied(authInfo, method)
+		}
+	}
+	for _, rule := range self.Rules {
+		if !rule.appliesTo(authInfo) {
+			continue
+		}
+		if check(rule.Allow, rule.Deny) {
+			return denied(authInfo, method)
+		}
+	}
+	if allowed {
+		return nil
+	}
+	return denied(authInfo, method)
+}
+
+func denied(authInfo *AuthInfo, method string) error {
+	if authInfo == nil {
+		return jlib.ErrAuthFailed.WithData(fmt.Sprintf("method %s requires authentication", method))
+	}
+	return jlib.ErrForbidden.WithData(fmt.Sprintf("user %s is not allowed to call %s", authInfo.Username, method))
+}
+
+func (self ACLRule) appliesTo(authInfo *AuthInfo) bool {
+	if len(self.Users) == 0 && len(self.Roles) == 0 && len(self.Claims) == 0 {
+		return true
+	}
+	if authInfo == nil {
+		return false
+	}
+	if matchAny(self.Users, authInfo.Username) {
+		return true
+	}
+	for _, role := range settingStrings(authInfo.Settings, "roles") {
+		for _, r := range self.Roles {
+			if r == role {
+				return true
+			}
+		}
+	}
+	if len(self.Claims) == 0 {
+		return false
+	}
+	for key, pattern := range self.Claims {
+		matched := false
+		for _, v := range settingStrings(authInfo.Settings, key) {
+			if ok, _ := path.Match(pattern, v); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (self ACLConfig) validate() error {
+	if self.Default != "" && self.Default != ACLAllow && self.Default != ACLDeny {
+		return errors.Errorf("bad acl default policy %s", self.Default)
+	}
+	for _, rule := range self.Rules {
+		patterns := append([]string{}, rule.Allow...)
+		patterns = append(patterns, rule.Deny...)
+		patterns = append(patterns, rule.Users...)
+		for _, pattern := range rule.Claims {
+			patterns = append(patterns, pattern)
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return errors.Wrapf(err, "acl pattern %s", pattern)
+			}
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// get a setting as a list of strings, a scalar is taken as a list
+// of one element
+func settingStrings(settings map[string]interface{}, key string) []string {
+	v, ok := settings[key]
+	if !ok || v == nil {
+		return nil
+	}
+	switch vv := v.(type) {
+	case []string:
+		return vv
+	case []interface{}:
+		strs := make([]string, 0, len(vv))
+		for _, elem := range vv {
+			strs = append(strs, fmt.Sprint(elem))
+		}
+		return strs
+	default:
+		return []string{fmt.Sprint(vv)}
+	}
+}
@@ -2,32 +2,58 @@ package jlibhttp
 
 import (
 	"context"
-	"fmt"
-	"github.com/golang-jwt/jwt"
-	"github.com/hashicorp/golang-lru"
 	"github.com/pkg/errors"
 	"net/http"
-	"strings"
 	"time"
 )
 
 type AuthInfo struct {
 	Username string
 	Settings map[string]interface{}
+
+	// the time the authentication expires, zero if it never
+	// expires, e.g. the exp of jwt
+	ExpiresAt time.Time `json:"-"`
+}
+
+func (self AuthInfo) Expired() bool {
+	return !self.ExpiresAt.IsZero() && time.Now().After(self.ExpiresAt)
+}
+
+type authInfoContextKey struct{}
+
+// the string key of AuthInfo in older versions, which is still set so
+// that the callers of ctx.Value("authInfo") keep working, new code
+// should use AuthInfoFromContext
+const legacyAuthInfoKey = "authInfo"
+
+// set the auth info to the context under both keys
+func withAuthInfo(ctx context.Context, authInfo *AuthInfo) context.Context {
+	ctx = context.WithValue(ctx, authInfoContextKey{}, authInfo)
+	return context.WithValue(ctx, legacyAuthInfoKey, authInfo)
 }
 
 func AuthInfoFromContext(ctx context.Context) (*AuthInfo, bool) {
-	if v := ctx.Value("authInfo"); v != nil {
+	if v := ctx.Value(authInfoContextKey{}); v != nil {
+		authinfo, ok := v.(*AuthInfo)
+		return authinfo, ok && authinfo != nil
+	}
+	if v := ctx.Value(legacyAuthInfoKey); v != nil {
 		authinfo, ok := v.(*AuthInfo)
-		return authinfo, ok
+		return authinfo, ok && authinfo != nil
 	}
 	return nil, false
 }
 
 type BasicAuthConfig struct {
-	Username string                 `yaml:"username" json:"username"`
-	Password string                 `yaml:"password" json:"password"`
-	Settings map[string]interface{} `yaml:"settings,omitempty" json:"settings.omitempty"`
+	Username string `yaml:"username" json:"username"`
+	Password string `yaml:"password,omitempty" json:"password,omitempty"`
+
+	// the bcrypt or argon2id hash of the password, which is used
+	// instead of the plain text password
+	PasswordHash string `yaml:"password_hash,omitempty" json:"password_hash,omitempty"`
+
+	Settings map[string]interface{} `yaml:"settings,omitempty" json:"settings,omitempty"`
 }
 
 type BearerAuthConfig struct {
@@ -35,144 +61,89 @@ type BearerAuthConfig struct {
 
 	// username attached to request when token authorized
 	Username string                 `yaml:"username,omitempty" json:"username,omitempty"`
-	Settings map[string]interface{} `yaml:"settings,omitempty" json:"settings.omitempty"`
-}
-
-type JwtAuthConfig struct {
-	Secret string `yaml:"secret" json:"secret"`
+	Settings map[string]interface{} `yaml:"settings,omitempty" json:"settings,omitempty"`
 }
 
 type AuthConfig struct {
 	Basic  []BasicAuthConfig  `yaml:"basic,omitempty" json:"basic,omitempty"`
 	Bearer []BearerAuthConfig `yaml:"bearer,omitempty" json:"bearer,omitempty"`
 	Jwt    *JwtAuthConfig     `yaml:"jwt,omitempty" json:"jwt,omitempty"`
+	ApiKey []ApiKeyAuthConfig `yaml:"apikey,omitempty" json:"apikey,omitempty"`
+	Hmac   []HmacAuthConfig   `yaml:"hmac,omitempty" json:"hmac,omitempty"`
+	MTLS   *MTLSAuthConfig    `yaml:"mtls,omitempty" json:"mtls,omitempty"`
+
+	// method level access control, enforced by the actors serving
+	// the requests passed the auth handler
+	ACL *ACLConfig `yaml:"acl,omitempty" json:"acl,omitempty"`
 }
 
-type jwtClaims struct {
-	Username string                 `json:"username"`
-	Settings map[string]interface{} `json:"settings,omitempty"`
-	jwt.StandardClaims
+// Authenticators builds the chain of authenticators configured, in
+// the order of jwt, basic, bearer, api key, hmac and mtls
+func (self *AuthConfig) Authenticators() AuthChain {
+	chain := AuthChain{}
+	if self == nil {
+		return chain
+	}
+	if self.Jwt != nil {
+		chain = append(chain, NewJwtAuthenticator(self.Jwt))
+	}
+	if len(self.Basic) > 0 {
+		chain = append(chain, BasicAuthenticator(self.Basic))
+	}
+	if len(self.Bearer) > 0 {
+		chain = append(chain, BearerAuthenticator(self.Bearer))
+	}
+	if len(self.ApiKey) > 0 {
+		chain = append(chain, ApiKeyAuthenticator(self.ApiKey))
+	}
+	if len(self.Hmac) > 0 {
+		chain = append(chain, HmacAuthenticator(self.Hmac))
+	}
+	if self.MTLS != nil {
+		chain = append(chain, (*MTLSAuthenticator)(self.MTLS))
+	}
+	return chain
 }
 
-// Auth handler
+// Auth handler authenticates http requests, including websocket
+// upgrades and http/2 streams, by a chain of authenticators
 type AuthHandler struct {
 	authConfig *AuthConfig
 	next       http.Handler
-	jwtCache   *lru.Cache
+	chain      AuthChain
 }
 
 func NewAuthHandler(authConfig *AuthConfig, next http.Handler) *AuthHandler {
-	cache, err := lru.New(100)
-	if err != nil {
-		panic(err)
-	}
 	return &AuthHandler{
 		authConfig: authConfig,
-		jwtCache:   cache,
 		next:       next,
+		chain:      authConfig.Authenticators(),
 	}
 }
 
-func (self AuthHandler) TryAuth(r *http.Request) (*AuthInfo, bool) {
-	if self.authConfig == nil {
-		return nil, true
-	}
-
-	if self.authConfig.Jwt != nil && self.authConfig.Jwt.Secret != "" {
-		if authInfo, ok := self.jwtAuth(self.authConfig.Jwt, r); ok {
-			return authInfo, true
-		}
-	}
-
-	if self.authConfig.Basic != nil && len(self.authConfig.Basic) > 0 {
-		if username, password, ok := r.BasicAuth(); ok {
-			for _, basicCfg := range self.authConfig.Basic {
-				if basicCfg.Username == username && basicCfg.Password == password {
-					return &AuthInfo{
-						Username: username,
-						Settings: basicCfg.Settings}, true
-				}
-			}
-		}
-	}
-
-	if self.authConfig.Bearer != nil && len(self.authConfig.Bearer) > 0 {
-		authHeader := r.Header.Get("Authorization")
-		for _, bearerCfg := range self.authConfig.Bearer {
-			expect := fmt.Sprintf("Bearer %s", bearerCfg.Token)
-			if authHeader == expect {
-				username := bearerCfg.Username
-				if username == "" {
-					username = bearerCfg.Token
-				}
-				return &AuthInfo{
-					Username: username,
-					Settings: bearerCfg.Settings}, true
-			}
-		}
-	}
-
-	return nil, false
+// Use appends an authenticator to the chain, it's not safe to call
+// while serving
+func (self *AuthHandler) Use(authenticator Authenticator) {
+	self.chain = append(self.chain, authenticator)
 }
 
-func (self *AuthHandler) jwtAuth(jwtCfg *JwtAuthConfig, r *http.Request) (*AuthInfo, bool) {
-	// refers to https://qvault.io/cryptography/jwts-in-golang/
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		return nil, false
-	}
-	if arr := strings.SplitN(authHeader, " ", 2); len(arr) <= 2 && arr[0] == "Bearer" {
-		var claims *jwtClaims
-		fromCache := false
-
-		if cached, ok := self.jwtCache.Get(authHeader); ok {
-			claims, _ = cached.(*jwtClaims)
-			fromCache = true
-		} else {
-			jwtFromHeader := arr[1]
-			token, err := jwt.ParseWithClaims(
-				jwtFromHeader,
-				&jwtClaims{},
-				func(token *jwt.Token) (interface{}, error) {
-					return []byte(jwtCfg.Secret), nil
-				},
-			)
-
-			if err != nil {
-				Logger(r).Warnf("jwt auth error %s", err)
-				return nil, false
-			}
-			claims, ok = token.Claims.(*jwtClaims)
-			if !ok {
-				return nil, false
-			}
-		}
-		// check expiration
-		if claims.ExpiresAt < time.Now().UTC().Unix() {
-			Logger(r).Warnf("claims expired %s", authHeader)
-			if fromCache {
-				self.jwtCache.Remove(authHeader)
-			}
-			return nil, false
-		}
-		if !fromCache {
-			self.jwtCache.Add(authHeader, claims)
-		}
-		return &AuthInfo{
-			Username: claims.Username,
-			Settings: claims.Settings}, true
+func (self AuthHandler) TryAuth(r *http.Request) (*AuthInfo, bool) {
+	if self.authConfig == nil && len(self.chain) == 0 {
+		return nil, true
 	}
-	return nil, false
+	return self.chain.Authenticate(r)
 }
 
 func (self *AuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if authInfo, ok := self.TryAuth(r); ok {
+		ctx := r.Context()
 		if authInfo != nil {
-			ctx := context.WithValue(r.Context(), "authInfo", authInfo)
-			self.next.ServeHTTP(w, r.WithContext(ctx))
-		} else {
-			self.next.ServeHTTP(w, r)
+			ctx = withAuthInfo(ctx, authInfo)
 		}
+		if self.authConfig != nil && self.authConfig.ACL != nil {
+			ctx = context.WithValue(ctx, aclContextKey{}, self.authConfig.ACL)
+		}
+		self.next.ServeHTTP(w, r.WithContext(ctx))
 	} else {
 		w.WriteHeader(401)
 		w.Write([]byte("auth failed!\n"))
@@ -195,14 +166,47 @@ func (self *AuthConfig) ValidateValues() error {
 
 	if self.Basic != nil && len(self.Basic) > 0 {
 		for _, basicCfg := range self.Basic {
-			if basicCfg.Username == "" || basicCfg.Password == "" {
+			if basicCfg.Username == "" || (basicCfg.Password == "" && basicCfg.PasswordHash == "") {
 				return errors.New("basic username or password are empty")
 			}
+			if basicCfg.PasswordHash != "" {
+				if err := validatePasswordHash(basicCfg.PasswordHash); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if self.Jwt != nil {
+		if err := self.Jwt.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, apiKeyCfg := range self.ApiKey {
+		if apiKeyCfg.Key == "" {
+			return errors.New("api key is empty")
+		}
+	}
+
+	for _, hmacCfg := range self.Hmac {
+		if hmacCfg.KeyId == "" || hmacCfg.Secret == "" {
+			return errors.New("hmac key id or secret are empty")
 		}
 	}
 
-	if self.Jwt != nil && self.Jwt.Secret == "" {
-		return errors.New("jwt has no secret")
+	if self.MTLS != nil {
+		switch self.MTLS.UsernameField {
+		case "", "cn", "email", "dns", "uri":
+		default:
+			return errors.Errorf("bad mtls username field %s", self.MTLS.UsernameField)
+		}
+	}
+
+	if self.ACL != nil {
+		if err := self.ACL.validate(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,375 @@
+package jlibhttp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authenticator authenticates a http request by one kind of
+// credentials, it returns false if the request doesn't carry the
+// credentials or the credentials are wrong.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*AuthInfo, bool)
+}
+
+// AuthFunc adapts a function to Authenticator
+type AuthFunc func(r *http.Request) (*AuthInfo, bool)
+
+func (self AuthFunc) Authenticate(r *http.Request) (*AuthInfo, bool) {
+	return self(r)
+}
+
+// AuthChain tries the authenticators in order, the first succeeded
+// one wins
+type AuthChain []Authenticator
+
+func (self AuthChain) Authenticate(r *http.Request) (*AuthInfo, bool) {
+	for _, authenticator := range self {
+		if authInfo, ok := authenticator.Authenticate(r); ok {
+			return authInfo, true
+		}
+	}
+	return nil, false
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// BasicAuthenticator authenticates the http basic auth against plain
+// text or hashed passwords
+type BasicAuthenticator []BasicAuthConfig
+
+func (self BasicAuthenticator) Authenticate(r *http.Request) (*AuthInfo, bool) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	for _, basicCfg := range self {
+		if basicCfg.Username != username {
+			continue
+		}
+		if basicCfg.PasswordHash != "" {
+			ok = verifyPasswordHash(basicCfg.PasswordHash, password)
+		} else {
+			ok = secureEqual(basicCfg.Password, password)
+		}
+		if ok {
+			return &AuthInfo{
+				Username: username,
+				Settings: basicCfg.Settings}, true
+		}
+	}
+	return nil, false
+}
+
+// verify a password against a bcrypt hash or an argon2id hash in the
+// format of $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func verifyPasswordHash(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(computed, key) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func validatePasswordHash(hash string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		_, _, _, err := parseArgon2Hash(hash)
+		return err
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return errors.Wrap(err, "bad password hash")
+	}
+	return nil
+}
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+func parseArgon2Hash(hash string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errors.New("bad argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("bad argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, errors.Wrap(err, "bad argon2id params")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errors.Wrap(err, "bad argon2id salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, errors.Wrap(err, "bad argon2id key")
+	}
+	return params, salt, key, nil
+}
+
+// BearerAuthenticator authenticates the static bearer tokens
+type BearerAuthenticator []BearerAuthConfig
+
+func (self BearerAuthenticator) Authenticate(r *http.Request) (*AuthInfo, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return nil, false
+	}
+	token := authHeader[len("Bearer "):]
+	for _, bearerCfg := range self {
+		if secureEqual(bearerCfg.Token, token) {
+			username := bearerCfg.Username
+			if username == "" {
+				username = bearerCfg.Token
+			}
+			return &AuthInfo{
+				Username: username,
+				Settings: bearerCfg.Settings}, true
+		}
+	}
+	return nil, false
+}
+
+type ApiKeyAuthConfig struct {
+	// the header carrying the api key, default is X-Api-Key
+	Header string `yaml:"header,omitempty" json:"header,omitempty"`
+	Key    string `yaml:"key" json:"key"`
+
+	Username string                 `yaml:"username,omitempty" json:"username,omitempty"`
+	Settings map[string]interface{} `yaml:"settings,omitempty" json:"settings,omitempty"`
+}
+
+// ApiKeyAuthenticator authenticates the api keys in headers
+type ApiKeyAuthenticator []ApiKeyAuthConfig
+
+func (self ApiKeyAuthenticator) Authenticate(r *http.Request) (*AuthInfo, bool) {
+	for _, apiKeyCfg := range self {
+		header := apiKeyCfg.Header
+		if header == "" {
+			header = "X-Api-Key"
+		}
+		if key := r.Header.Get(header); key != "" && secureEqual(apiKeyCfg.Key, key) {
+			return &AuthInfo{
+				Username: apiKeyCfg.Username,
+				Settings: apiKeyCfg.Settings}, true
+		}
+	}
+	return nil, false
+}
+
+// the scheme of the Authorization header of hmac signed requests
+const HmacAuthScheme = "JSONRPC-HMAC-SHA256"
+
+// the payload hash of requests of unknown body length, i.e. http/2
+// streams, whose bodies are not signed
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// the default max bytes of the signed bodies
+const defaultMaxSignedBodySize = 16 * 1024 * 1024
+
+type HmacAuthConfig struct {
+	KeyId  string `yaml:"key_id" json:"key_id"`
+	Secret string `yaml:"secret" json:"secret"`
+
+	// the max seconds between the signing time and now, default
+	// is 300
+	MaxSkew int `yaml:"max_skew,omitempty" json:"max_skew,omitempty"`
+
+	// the max bytes of the signed bodies, default is 16M
+	MaxBodySize int64 `yaml:"max_body_size,omitempty" json:"max_body_size,omitempty"`
+
+	// accept the requests of unknown body length(i.e. http/2
+	// streams) whose bodies are not signed, such requests are
+	// rejected by default
+	AllowUnsignedPayload bool `yaml:"allow_unsigned_payload,omitempty" json:"allow_unsigned_payload,omitempty"`
+
+	Username string                 `yaml:"username,omitempty" json:"username,omitempty"`
+	Settings map[string]interface{} `yaml:"settings,omitempty" json:"settings,omitempty"`
+}
+
+// HmacAuthenticator authenticates the requests signed by
+// SignHmacRequest
+type HmacAuthenticator []HmacAuthConfig
+
+func (self HmacAuthenticator) Authenticate(r *http.Request) (*AuthInfo, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, HmacAuthScheme+" ") {
+		return nil, false
+	}
+	fields := make(map[string]string)
+	for _, kv := range strings.Split(authHeader[len(HmacAuthScheme)+1:], ",") {
+		if arr := strings.SplitN(strings.TrimSpace(kv), "=", 2); len(arr) == 2 {
+			fields[arr[0]] = arr[1]
+		}
+	}
+	var hmacCfg *HmacAuthConfig
+	for i, cfg := range self {
+		if cfg.KeyId == fields["KeyId"] {
+			hmacCfg = &self[i]
+			break
+		}
+	}
+	if hmacCfg == nil {
+		return nil, false
+	}
+
+	ts, err := strconv.ParseInt(fields["Timestamp"], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	maxSkew := int64(hmacCfg.MaxSkew)
+	if maxSkew <= 0 {
+		maxSkew = 300
+	}
+	if skew := time.Now().Unix() - ts; skew > maxSkew || skew < -maxSkew {
+		Logger(r).Warnf("hmac signature expired")
+		return nil, false
+	}
+
+	payloadHash := unsignedPayload
+	if r.ContentLength < 0 {
+		if !hmacCfg.AllowUnsignedPayload {
+			Logger(r).Warnf("hmac unsigned payload not allowed")
+			return nil, false
+		}
+	} else {
+		maxSize := hmacCfg.MaxBodySize
+		if maxSize <= 0 {
+			maxSize = defaultMaxSignedBodySize
+		}
+		payloadHash, err = hashRequestBody(r, maxSize)
+		if err != nil {
+			Logger(r).Warnf("hash request body error %s", err)
+			return nil, false
+		}
+	}
+	expect := hmacSignature(hmacCfg.Secret, r, fields["Timestamp"], payloadHash)
+	if !secureEqual(expect, fields["Signature"]) {
+		return nil, false
+	}
+	return &AuthInfo{
+		Username: hmacCfg.Username,
+		Settings: hmacCfg.Settings}, true
+}
+
+// SignHmacRequest signs a http request with the key, the string to
+// sign is made of the method, the request uri, the timestamp and the
+// sha256 of the body, the body of unknown length(i.e. a http/2
+// stream) is not signed and is accepted only by the servers allowing
+// unsigned payloads.
+func SignHmacRequest(r *http.Request, keyId, secret string) error {
+	payloadHash := unsignedPayload
+	if r.ContentLength >= 0 {
+		var err error
+		payloadHash, err = hashRequestBody(r, 0)
+		if err != nil {
+			return err
+		}
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := hmacSignature(secret, r, ts, payloadHash)
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"%s KeyId=%s, Timestamp=%s, Signature=%s",
+		HmacAuthScheme, keyId, ts, signature))
+	return nil
+}
+
+func hmacSignature(secret string, r *http.Request, ts string, payloadHash string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{
+		r.Method, r.URL.RequestURI(), ts, payloadHash}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hash the request body, the body is read and replaced by a reader
+// of the same content, bodies over maxSize bytes fail unless maxSize
+// is 0
+func hashRequestBody(r *http.Request, maxSize int64) (string, error) {
+	var data []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var reader io.Reader = r.Body
+		if maxSize > 0 {
+			reader = io.LimitReader(r.Body, maxSize+1)
+		}
+		var err error
+		data, err = io.ReadAll(reader)
+		r.Body.Close()
+		if err != nil {
+			return "", errors.Wrap(err, "read body")
+		}
+		if maxSize > 0 && int64(len(data)) > maxSize {
+			return "", errors.New("body too large")
+		}
+		r.Body = io.NopCloser(bytes.NewReader(data))
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// MTLSAuthConfig authenticates the client certificates verified by
+// the tls config of server, i.e. ClientAuth is
+// tls.VerifyClientCertIfGiven or tls.RequireAndVerifyClientCert
+type MTLSAuthConfig struct {
+	// the field of certificate taken as username, one of cn, email,
+	// dns and uri, the default is cn
+	UsernameField string `yaml:"username_field,omitempty" json:"username_field,omitempty"`
+
+	Settings map[string]interface{} `yaml:"settings,omitempty" json:"settings,omitempty"`
+}
+
+type MTLSAuthenticator MTLSAuthConfig
+
+func (self *MTLSAuthenticator) Authenticate(r *http.Request) (*AuthInfo, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	username := ""
+	switch self.UsernameField {
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			username = cert.EmailAddresses[0]
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			username = cert.DNSNames[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			username = cert.URIs[0].String()
+		}
+	default:
+		username = cert.Subject.CommonName
+	}
+	if username == "" {
+		return nil, false
+	}
+	return &AuthInfo{
+		Username: username,
+		Settings: self.Settings}, true
+}
@@ -0,0 +1,90 @@
+package jlibhttp
+
+import (
+	"context"
+
+	"github.com/superisaac/jlib"
+)
+
+// clientSession is the session of a streaming client seen by the
+// handlers of its actor, through which they can push messages to the
+// server or call the server
+type clientSession struct {
+	client *StreamingClient
+	ctx    context.Context
+}
+
+func (self clientSession) Send(msg jlib.Message) {
+	if err := self.client.Send(self.ctx, msg); err != nil {
+		self.client.Log().Warnf("session send error %s", err)
+	}
+}
+
+func (self clientSession) Call(ctx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error) {
+	return self.client.Call(ctx, reqmsg)
+}
+
+func (self clientSession) SessionID() string {
+	return self.client.sessionId
+}
+
+// SetActor sets the actor which serves the requests and notifies
+// called by the server, the requests are replied with the results,
+// and the notifies the actor has no handlers for go to the message
+// handler. The requests of the actor have no http request, so that
+// RPCRequest.HttpRequest() panics, check RPCRequest.HasHttpRequest()
+// in the handlers shared with servers.
+func (self *StreamingClient) SetActor(actor *Actor) {
+	self.actor = actor
+	self.sessionId = jlib.NewUuid()
+}
+
+// returns true if the message is served by the actor
+func (self *StreamingClient) actorServes(msg jlib.Message) bool {
+	if self.actor == nil || !msg.IsRequestOrNotify() {
+		return false
+	}
+	return msg.IsRequest() || self.actor.Has(msg.MustMethod())
+}
+
+// the transport type of the client url scheme, for the transports
+// which don't tell their types
+func schemeTransport(scheme string) string {
+	switch scheme {
+	case "ws", "wss":
+		return TransportWebsocket
+	case "h2", "h2c":
+		return TransportHTTP2
+	case "sse", "sses":
+		return TransportSSE
+	case "tcp":
+		return TransportTCP
+	case "unix":
+		return TransportUnix
+	case "stdio":
+		return TransportStdio
+	default:
+		return scheme
+	}
+}
+
+// feed a message from server to the actor and reply the result
+func (self *StreamingClient) feedActor(ctx context.Context, msg jlib.Message) {
+	req := NewRPCRequest(ctx, msg, self.transportType, nil)
+	req.session = clientSession{client: self, ctx: ctx}
+
+	resmsg, err := self.actor.Feed(req)
+	if err != nil {
+		req.Log().Warnf("actor feed error %s", err)
+		if !msg.IsRequest() {
+			return
+		}
+		resmsg = jlib.ErrInternalError.ToMessageFromId(msg.MustId(), msg.TraceId())
+	}
+	if resmsg == nil {
+		return
+	}
+	if err := self.send(ctx, resmsg); err != nil {
+		req.Log().Warnf("reply error %s", err)
+	}
+}
@@ -6,9 +6,10 @@ import (
 )
 
 // NewClient returns an JSONRPC client whose type depends on the
-// server url it wants to connect to. Currently there are 3 types of
-// supported url schemes: the HTTP/1.1 client, the websocket based
-// client and HTTP2 base client, the latter two types are streaming
+// server url it wants to connect to. Currently the supported url
+// schemes are for the HTTP/1.1 client, the websocket based
+// client, HTTP2 base client, the server-sent events client and the
+// raw tcp or unix socket client, all but the first are streaming
 // clients which can accept server push messages.
 func NewClient(serverUrl string, optlist ...ClientOptions) (Client, error) {
 	u, err := url.Parse(serverUrl)
@@ -21,10 +22,19 @@ func NewClient(serverUrl string, optlist ...ClientOptions) (Client, error) {
 		return NewH1Client(u, optlist...), nil
 	case "ws", "wss":
 		// Websocket client
-		return NewWSClient(u), nil
+		return NewWSClient(u, optlist...), nil
 	case "h2", "h2c":
 		// HTTP2 client
-		return NewH2Client(u), nil
+		return NewH2Client(u, optlist...), nil
+	case "sse", "sses":
+		// server-sent events client
+		return NewSSEClient(u, optlist...), nil
+	case "tcp", "unix":
+		// raw tcp or unix socket client
+		if _, _, _, err := parseNetURL(u); err != nil {
+			return nil, err
+		}
+		return NewNetClient(u, optlist...), nil
 	default:
 		return nil, errors.New("url scheme not supported")
 	}
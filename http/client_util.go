@@ -1,7 +1,12 @@
 package jlibhttp
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/pkg/errors"
+	"github.com/superisaac/jlib"
+	"github.com/superisaac/jlib/trace"
 	"net/http"
 	"strings"
 )
@@ -29,6 +34,83 @@ func (self *HeaderFlags) Parse() (http.Header, error) {
 	return header, nil
 }
 
+// the key to match a result to its request, ids of the same json
+// repr are considered identical, i.e. int64(5) equals int(5)
+func idKey(id interface{}) string {
+	data, err := json.Marshal(id)
+	if err != nil {
+		return fmt.Sprintf("%#v", id)
+	}
+	return string(data)
+}
+
+// collect the results of a batch call in the order of the request
+// messages, resmsg is the batch message replied by server, which may
+// be nil when the batch contains only notifies.
+func batchResults(msgs []jlib.Message, resmsg jlib.Message) ([]jlib.Message, error) {
+	reqIds := []interface{}{}
+	for _, msg := range msgs {
+		if msg.IsRequest() {
+			reqIds = append(reqIds, msg.MustId())
+		}
+	}
+	if len(reqIds) == 0 {
+		return []jlib.Message{}, nil
+	}
+
+	if resmsg == nil {
+		return nil, errors.New("no results for batch")
+	}
+	if !resmsg.IsBatch() {
+		if resmsg.IsError() {
+			// the whole batch is rejected
+			return nil, resmsg.MustError()
+		}
+		return nil, errors.New("result of batch is not a batch")
+	}
+
+	resbatch, ok := resmsg.(*jlib.BatchMessage)
+	if !ok {
+		return nil, errors.New("convert to batch message failed")
+	}
+	resmap := make(map[string]jlib.Message)
+	for _, elem := range resbatch.Messages {
+		if elem.IsResultOrError() {
+			resmap[idKey(elem.MustId())] = elem
+		}
+	}
+
+	results := make([]jlib.Message, 0, len(reqIds))
+	for _, reqId := range reqIds {
+		elem, ok := resmap[idKey(reqId)]
+		if !ok {
+			return nil, errors.Errorf("no result for request %v", reqId)
+		}
+		results = append(results, elem)
+	}
+	return results, nil
+}
+
+// check there are no duplicate request ids among the batch
+func checkBatchIds(msgs []jlib.Message) error {
+	if len(msgs) == 0 {
+		return errors.New("empty batch")
+	}
+	ids := make(map[string]bool)
+	for _, msg := range msgs {
+		if msg.IsRequest() {
+			key := idKey(msg.MustId())
+			if ids[key] {
+				return errors.Errorf("duplicate request id %s in batch", key)
+			}
+			ids[key] = true
+		} else if !msg.IsNotify() {
+			return errors.New("only requests and notifies can be batched")
+		}
+	}
+	return nil
+}
+
 // // merge multiple http headers into one, may return nil
 // func MergeHeaders(headers []http.Header) http.Header {
 // 	var merged http.Header = nil
@@ -44,3 +126,118 @@ func (self *HeaderFlags) Parse() (http.Header, error) {
 // 	}
 // 	return merged
 // }
+
+// convert the error body of an error message into golang error
+func unwrapError(registry *jlib.ErrorRegistry, rpcErr *jlib.RPCError) error {
+	if registry == nil {
+		registry = jlib.DefaultErrorRegistry
+	}
+	return registry.FromRPCError(rpcErr)
+}
+
+// chain the interceptors around an invoker, the interceptor used
+// first is the outermost one
+func intercept(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		invoker = interceptors[i](invoker)
+	}
+	return invoker
+}
+
+// call a Request message through the interceptors
+func invokeCall(ctx context.Context, reqmsg *jlib.RequestMessage, interceptors []Interceptor, tracer jlibtrace.Tracer, call func(ctx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error)) (jlib.Message, error) {
+	invoker := func(ctx context.Context, msg jlib.Message) (jlib.Message, error) {
+		reqmsg, ok := msg.(*jlib.RequestMessage)
+		if !ok {
+			return nil, errors.New("only request messages can be called")
+		}
+		return traceCall(ctx, tracer, reqmsg, func(ctx context.Context) (jlib.Message, error) {
+			injectTimeout(ctx, reqmsg)
+			return call(ctx, reqmsg)
+		})
+	}
+	resmsg, err := intercept(interceptors, invoker)(ctx, reqmsg)
+	if err == nil && resmsg == nil {
+		return nil, errors.Errorf("RPC(%s) no result", reqmsg.Method)
+	}
+	return resmsg, err
+}
+
+// call a batch through the interceptors, which see the batch as a
+// Batch message
+func invokeBatch(ctx context.Context, msgs []jlib.Message, interceptors []Interceptor, tracer jlibtrace.Tracer, callBatch func(ctx context.Context, msgs []jlib.Message) ([]jlib.Message, error)) ([]jlib.Message, error) {
+	invoker := func(ctx context.Context, msg jlib.Message) (jlib.Message, error) {
+		batch, ok := msg.(*jlib.BatchMessage)
+		if !ok {
+			return nil, errors.New("convert to batch message failed")
+		}
+		results, err := traceBatch(ctx, tracer, batch.Messages, func(ctx context.Context) ([]jlib.Message, error) {
+			injectTimeout(ctx, batch.Messages...)
+			return callBatch(ctx, batch.Messages)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return jlib.NewBatchMessage(results), nil
+	}
+	resmsg, err := intercept(interceptors, invoker)(ctx, jlib.NewBatchMessage(msgs))
+	if err != nil {
+		return nil, err
+	}
+	resbatch, ok := resmsg.(*jlib.BatchMessage)
+	if !ok {
+		return nil, errors.New("result of batch is not a batch")
+	}
+	return resbatch.Messages, nil
+}
+
+// send a message through the interceptors
+func invokeSend(ctx context.Context, msg jlib.Message, interceptors []Interceptor, tracer jlibtrace.Tracer, send func(ctx context.Context, msg jlib.Message) error) error {
+	invoker := func(ctx context.Context, msg jlib.Message) (jlib.Message, error) {
+		return traceCall(ctx, tracer, msg, func(ctx context.Context) (jlib.Message, error) {
+			return nil, send(ctx, msg)
+		})
+	}
+	_, err := intercept(interceptors, invoker)(ctx, msg)
+	return err
+}
+
+// wrap a call of a Request or Notify message with a client span if
+// tracer is set, the trace context is injected into the message
+func traceCall(ctx context.Context, tracer jlibtrace.Tracer, msg jlib.Message, call func(ctx context.Context) (jlib.Message, error)) (jlib.Message, error) {
+	if tracer == nil || !msg.IsRequestOrNotify() {
+		return call(ctx)
+	}
+	ctx, span := jlibtrace.StartClientSpan(ctx, tracer, msg)
+	resmsg, err := call(ctx)
+	jlibtrace.EndSpan(span, resmsg, err)
+	return resmsg, err
+}
+
+// wrap a batch call with a client span for each element, results are
+// in the order of requests
+func traceBatch(ctx context.Context, tracer jlibtrace.Tracer, msgs []jlib.Message, call func(ctx context.Context) ([]jlib.Message, error)) ([]jlib.Message, error) {
+	if tracer == nil {
+		return call(ctx)
+	}
+	spans := make([]jlibtrace.Span, len(msgs))
+	for i, msg := range msgs {
+		if msg.IsRequestOrNotify() {
+			_, spans[i] = jlibtrace.StartClientSpan(ctx, tracer, msg)
+		}
+	}
+	results, err := call(ctx)
+	j := 0
+	for i, msg := range msgs {
+		if spans[i] == nil {
+			continue
+		}
+		var resmsg jlib.Message
+		if err == nil && msg.IsRequest() && j < len(results) {
+			resmsg = results[j]
+			j++
+		}
+		jlibtrace.EndSpan(spans[i], resmsg, err)
+	}
+	return results, err
+}
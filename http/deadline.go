@@ -0,0 +1,100 @@
+package jlibhttp
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/superisaac/jlib"
+)
+
+// TimeoutMetaKey is the metadata key of the remaining time budget of
+// the caller in milliseconds, which is relative so that clock skews
+// between peers don't matter. It's mirrored as the header
+// X-Jsonrpc-Meta-Timeout over http/1.1.
+const TimeoutMetaKey = "timeout"
+
+// set the remaining budget of the context deadline to the requests
+func injectTimeout(ctx context.Context, msgs ...jlib.Message) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	ms := time.Until(deadline).Milliseconds()
+	if ms < 0 {
+		ms = 0
+	}
+	for _, msg := range msgs {
+		if msg.IsRequest() {
+			msg.SetMeta(TimeoutMetaKey, strconv.FormatInt(ms, 10))
+		}
+	}
+}
+
+// the remaining budget of the caller carried by a message
+func callerTimeout(msg jlib.Message) (time.Duration, bool) {
+	v := msg.Metadata().Get(TimeoutMetaKey)
+	if v == "" {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		msg.Log().Warnf("bad timeout metadata %s", v)
+		return 0, false
+	}
+	if ms < 0 {
+		ms = 0
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// call a handler within the deadline of the request context and the
+// timeout of method, jlib.ErrTimeout is replied if the deadline
+// exceeds, and the context passed to the handler is cancelled. A
+// panic of the handler is raised again on the calling goroutine as
+// if the handler were called directly, or dropped along with the
+// result if the deadline already exceeded.
+func callWithDeadline(req *RPCRequest, timeout time.Duration, call func(req *RPCRequest) (jlib.Message, error)) (jlib.Message, error) {
+	ctx := req.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		return call(req)
+	}
+
+	type result struct {
+		msg jlib.Message
+		err error
+		// the recovered panic of handler
+		panicked interface{}
+	}
+	ch := make(chan result, 1)
+	if ctx.Err() == nil {
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					ch <- result{panicked: r}
+				}
+			}()
+			msg, err := call(req.WithContext(ctx))
+			ch <- result{msg: msg, err: err}
+		}()
+	}
+	select {
+	case res := <-ch:
+		if res.panicked != nil {
+			panic(res.panicked)
+		}
+		return res.msg, res.err
+	case <-ctx.Done():
+		req.Log().Warnf("handler exceeds deadline, %s", ctx.Err())
+		msg := req.Msg()
+		if msg.IsRequest() {
+			return jlib.ErrTimeout.ToMessageFromId(msg.MustId(), msg.TraceId()), nil
+		}
+		return nil, nil
+	}
+}
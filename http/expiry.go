@@ -0,0 +1,103 @@
+package jlibhttp
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// pendingHeap orders the pending requests by expire time
+type pendingHeap []*pendingRequest
+
+func (self pendingHeap) Len() int { return len(self) }
+
+func (self pendingHeap) Less(i, j int) bool {
+	return self[i].expire.Before(self[j].expire)
+}
+
+func (self pendingHeap) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+	self[i].index = i
+	self[j].index = j
+}
+
+func (self *pendingHeap) Push(x interface{}) {
+	p := x.(*pendingRequest)
+	p.index = len(*self)
+	*self = append(*self, p)
+}
+
+func (self *pendingHeap) Pop() interface{} {
+	old := *self
+	n := len(old)
+	p := old[n-1]
+	old[n-1] = nil
+	p.index = -1
+	*self = old[:n-1]
+	return p
+}
+
+// expiryQueue expires pending requests by one timer which is armed
+// for the earliest expire time, instead of a timer per request
+type expiryQueue struct {
+	lock     sync.Mutex
+	items    pendingHeap
+	timer    *time.Timer
+	onExpire func(p *pendingRequest)
+}
+
+func newExpiryQueue(onExpire func(p *pendingRequest)) *expiryQueue {
+	return &expiryQueue{onExpire: onExpire}
+}
+
+func (self *expiryQueue) add(p *pendingRequest) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	heap.Push(&self.items, p)
+	if p.index == 0 {
+		self.arm()
+	}
+}
+
+// remove a pending request which has got the result
+func (self *expiryQueue) remove(p *pendingRequest) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if p.index >= 0 && p.index < len(self.items) && self.items[p.index] == p {
+		heap.Remove(&self.items, p.index)
+	}
+}
+
+func (self *expiryQueue) len() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.items)
+}
+
+// arm the timer for the earliest item, the lock must be held
+func (self *expiryQueue) arm() {
+	if len(self.items) == 0 {
+		return
+	}
+	d := time.Until(self.items[0].expire)
+	if self.timer == nil {
+		self.timer = time.AfterFunc(d, self.fire)
+	} else {
+		self.timer.Reset(d)
+	}
+}
+
+func (self *expiryQueue) fire() {
+	self.lock.Lock()
+	now := time.Now()
+	expired := []*pendingRequest{}
+	for len(self.items) > 0 && !self.items[0].expire.After(now) {
+		expired = append(expired, heap.Pop(&self.items).(*pendingRequest))
+	}
+	self.arm()
+	self.lock.Unlock()
+
+	for _, p := range expired {
+		self.onExpire(p)
+	}
+}
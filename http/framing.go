@@ -0,0 +1,180 @@
+package jlibhttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Framing delimits the messages over raw byte streams, i.e. tcp and
+// unix socket connections and stdio pipes
+type Framing string
+
+const (
+	// each message is a line of json, which is the default
+	FramingNDJSON Framing = "ndjson"
+	// each message is prefixed by its length in 4 bytes big endian
+	FramingLength Framing = "length"
+	// each message is preceded by a Content-Length header and an
+	// empty line, as the language server protocol does
+	FramingHeader Framing = "header"
+)
+
+// the max size of the header part of FramingHeader
+const maxFrameHeaderSize = 4096
+
+// the max size of a frame if not limited explicitly
+const defaultMaxFrameSize = 16 * 1024 * 1024
+
+func (self Framing) validate() error {
+	switch self {
+	case "", FramingNDJSON, FramingLength, FramingHeader:
+		return nil
+	default:
+		return errors.Errorf("bad framing %s", self)
+	}
+}
+
+// frameReader reads the messages one frame after another
+type frameReader struct {
+	reader  *bufio.Reader
+	framing Framing
+	maxSize int64
+}
+
+func newFrameReader(r io.Reader, framing Framing, maxSize int64) *frameReader {
+	if maxSize <= 0 {
+		maxSize = defaultMaxFrameSize
+	}
+	return &frameReader{
+		reader:  bufio.NewReader(r),
+		framing: framing,
+		maxSize: maxSize,
+	}
+}
+
+// ReadFrame returns the bytes of next message, ErrMessageTooLarge is
+// returned if the frame exceeds the max size
+func (self *frameReader) ReadFrame() ([]byte, error) {
+	switch self.framing {
+	case FramingHeader:
+		size, err := self.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		if size > self.maxSize {
+			return nil, ErrMessageTooLarge
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(self.reader, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	case FramingLength:
+		var header [4]byte
+		if _, err := io.ReadFull(self.reader, header[:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if int64(size) > self.maxSize {
+			return nil, ErrMessageTooLarge
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(self.reader, data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+
+	// ndjson
+	for {
+		var line []byte
+		for {
+			chunk, isPrefix, err := self.reader.ReadLine()
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(line)+len(chunk)) > self.maxSize {
+				return nil, ErrMessageTooLarge
+			}
+			line = append(line, chunk...)
+			if !isPrefix {
+				break
+			}
+		}
+		// skip the blank lines
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+// read the header lines until an empty line and return the content
+// length, headers other than Content-Length are ignored
+func (self *frameReader) readHeader() (int64, error) {
+	size := int64(-1)
+	headerSize := 0
+	headers := 0
+	for {
+		line, err := self.reader.ReadSlice('\n')
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				return 0, errors.New("frame header line too long")
+			}
+			return 0, err
+		}
+		headerSize += len(line)
+		if headerSize > maxFrameHeaderSize {
+			return 0, errors.New("frame header too large")
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			if headers == 0 {
+				// skip the blank lines between frames
+				headerSize = 0
+				continue
+			} else if size < 0 {
+				return 0, errors.New("no Content-Length header")
+			}
+			return size, nil
+		}
+		headers++
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			return 0, errors.Errorf("bad frame header %s", line)
+		}
+		if bytes.EqualFold(bytes.TrimSpace(name), []byte("Content-Length")) {
+			size, err = strconv.ParseInt(string(bytes.TrimSpace(value)), 10, 64)
+			if err != nil || size < 0 {
+				return 0, errors.Errorf("bad Content-Length %s", value)
+			}
+		}
+	}
+}
+
+// write a message in a frame
+func writeFrame(w io.Writer, framing Framing, data []byte) error {
+	var buf []byte
+	switch framing {
+	case FramingHeader:
+		header := fmt.Sprintf("Content-Length: %d\r\n\r\n", len(data))
+		buf = make([]byte, 0, len(header)+len(data))
+		buf = append(buf, header...)
+		buf = append(buf, data...)
+	case FramingLength:
+		buf = make([]byte, 4, len(data)+4)
+		binary.BigEndian.PutUint32(buf, uint32(len(data)))
+		buf = append(buf, data...)
+	default:
+		buf = make([]byte, 0, len(data)+1)
+		buf = append(buf, data...)
+		buf = append(buf, '\n')
+	}
+	_, err := w.Write(buf)
+	return err
+}
@@ -3,18 +3,20 @@ package jlibhttp
 import (
 	"context"
 	"net/http"
+	"strings"
 )
 
-// shared handler serve http1/http2/websocket server over the same port
-// using http protocol detection.
+// shared handler serve http1/http2/websocket/sse server over the same
+// port using http protocol detection.
 //
 // NOTE: gateway handler must work over TLS to serve h2
 type GatewayHandler struct {
-	h1Handler http.Handler
-	wsHandler http.Handler
-	h2Handler http.Handler
-	Actor     *Actor
-	insecure  bool
+	h1Handler  http.Handler
+	wsHandler  http.Handler
+	h2Handler  http.Handler
+	sseHandler http.Handler
+	Actor      *Actor
+	insecure   bool
 }
 
 func NewGatewayHandler(serverCtx context.Context, actor *Actor, insecure bool) *GatewayHandler {
@@ -23,10 +25,11 @@ func NewGatewayHandler(serverCtx context.Context, actor *Actor, insecure bool) *
 	}
 
 	sh := &GatewayHandler{
-		Actor:     actor,
-		h1Handler: NewH1Handler(actor),
-		wsHandler: NewWSHandler(serverCtx, actor),
-		insecure:  insecure,
+		Actor:      actor,
+		h1Handler:  NewH1Handler(actor),
+		wsHandler:  NewWSHandler(serverCtx, actor),
+		sseHandler: NewSSEHandler(serverCtx, actor),
+		insecure:   insecure,
 	}
 
 	if insecure {
@@ -38,6 +41,13 @@ func NewGatewayHandler(serverCtx context.Context, actor *Actor, insecure bool) *
 }
 
 func (self *GatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") || r.Header.Get(SSESessionHeader) != "" {
+		// the event stream or the messages of sse sessions, which
+		// may be over http2 too
+		self.sseHandler.ServeHTTP(w, r)
+		return
+	}
+
 	if r.ProtoAtLeast(2, 0) {
 		// http2 check by proto
 		self.h2Handler.ServeHTTP(w, r)
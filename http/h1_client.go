@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -14,6 +16,7 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/superisaac/jlib"
+	"github.com/superisaac/jlib/trace"
 )
 
 type H1Client struct {
@@ -25,6 +28,12 @@ type H1Client struct {
 	connectOnce sync.Once
 
 	clientTLS *tls.Config
+
+	errorRegistry *jlib.ErrorRegistry
+
+	tracer jlibtrace.Tracer
+
+	interceptors []Interceptor
 }
 
 func NewH1Client(serverUrl *url.URL, optlist ...ClientOptions) *H1Client {
@@ -49,10 +58,18 @@ func (self *H1Client) connect() {
 		if timeout <= 0 {
 			timeout = 5
 		}
+		dialer := &net.Dialer{
+			Timeout:   self.clientOptions.connectTimeout(),
+			KeepAlive: 30 * time.Second,
+		}
 		tr := &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: self.clientOptions.connectTimeout(),
 			MaxIdleConns:        30,
 			MaxIdleConnsPerHost: 10,
 			IdleConnTimeout:     30 * time.Second,
+			ReadBufferSize:      self.clientOptions.ReadBufferSize,
+			WriteBufferSize:     self.clientOptions.WriteBufferSize,
 		}
 		if self.clientTLS != nil {
 			tr.TLSClientConfig = self.clientTLS
@@ -71,31 +88,71 @@ func (self *H1Client) SetClientTLSConfig(cfg *tls.Config) {
 	self.clientTLS = cfg
 }
 
+func (self *H1Client) SetErrorRegistry(registry *jlib.ErrorRegistry) {
+	self.errorRegistry = registry
+}
+
+func (self *H1Client) SetTracer(tracer jlibtrace.Tracer) {
+	self.tracer = tracer
+}
+
 func (self *H1Client) UnwrapCall(rootCtx context.Context, reqmsg *jlib.RequestMessage, output interface{}) error {
 	resmsg, err := self.Call(rootCtx, reqmsg)
 	if err != nil {
 		return err
 	}
 	if resmsg.IsResult() {
-		err := jlib.DecodeInterface(resmsg.MustResult(), output)
+		err := resmsg.DecodeResultInto(output)
 		if err != nil {
 			return errors.Wrapf(err, "RPC(%s)", reqmsg.Method)
 		}
 		return nil
 	} else {
-		return resmsg.MustError()
+		return unwrapError(self.errorRegistry, resmsg.MustError())
 	}
 }
 
+func (self *H1Client) Use(interceptor Interceptor) {
+	self.interceptors = append(self.interceptors, interceptor)
+}
+
 func (self *H1Client) Call(rootCtx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error) {
+	ctx, cancel := self.clientOptions.callContext(rootCtx)
+	defer cancel()
+	return invokeCall(ctx, reqmsg, self.interceptors, self.tracer, self.call)
+}
+
+func (self *H1Client) call(rootCtx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error) {
 	resmsg, err := self.request(rootCtx, reqmsg)
 	if err != nil {
 		return resmsg, errors.Wrapf(err, "RPC(%s)", reqmsg.Method)
 	}
+	if resmsg == nil {
+		return nil, errors.Errorf("RPC(%s) no result", reqmsg.Method)
+	}
 	return resmsg, nil
 }
 
-func (self *H1Client) request(rootCtx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error) {
+func (self *H1Client) CallBatch(rootCtx context.Context, msgs []jlib.Message) ([]jlib.Message, error) {
+	ctx, cancel := self.clientOptions.callContext(rootCtx)
+	defer cancel()
+	return invokeBatch(ctx, msgs, self.interceptors, self.tracer, self.callBatch)
+}
+
+func (self *H1Client) callBatch(rootCtx context.Context, msgs []jlib.Message) ([]jlib.Message, error) {
+	if err := checkBatchIds(msgs); err != nil {
+		return nil, err
+	}
+	resmsg, err := self.request(rootCtx, jlib.NewBatchMessage(msgs))
+	if err != nil {
+		return nil, errors.Wrap(err, "RPC(batch)")
+	}
+	return batchResults(msgs, resmsg)
+}
+
+// request posts a Request or Batch message and returns the message
+// replied, nil is returned if server replies no content
+func (self *H1Client) request(rootCtx context.Context, reqmsg jlib.Message) (jlib.Message, error) {
 	self.connect()
 
 	traceId := reqmsg.TraceId()
@@ -118,6 +175,9 @@ func (self *H1Client) request(rootCtx context.Context, reqmsg *jlib.RequestMessa
 	if traceId != "" {
 		req.Header.Add("X-Trace-Id", traceId)
 	}
+	if !reqmsg.IsBatch() {
+		metadataToHeader(reqmsg.Metadata(), req.Header)
+	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
@@ -142,6 +202,10 @@ func (self *H1Client) request(rootCtx context.Context, reqmsg *jlib.RequestMessa
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
 	if resp.StatusCode != 200 {
 		var buffer bytes.Buffer
 		readed, err := buffer.ReadFrom(resp.Body)
@@ -156,19 +220,33 @@ func (self *H1Client) request(rootCtx context.Context, reqmsg *jlib.RequestMessa
 		reqmsg.Log().Warnf("abnormal response %d", resp.StatusCode)
 		return nil, errors.Wrap(abnResp, "abnormal response")
 	}
-	respBody, err := ioutil.ReadAll(resp.Body)
+	var bodyReader io.Reader = resp.Body
+	if self.clientOptions.MaxMessageSize > 0 {
+		bodyReader = io.LimitReader(resp.Body, self.clientOptions.MaxMessageSize+1)
+	}
+	respBody, err := ioutil.ReadAll(bodyReader)
 	if err != nil {
 		return nil, errors.Wrap(err, "ioutil.ReadAll")
 	}
+	if self.clientOptions.MaxMessageSize > 0 && int64(len(respBody)) > self.clientOptions.MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
 	respmsg, err := jlib.ParseBytes(respBody)
 	if err != nil {
 		return nil, err
 	}
 	respmsg.SetTraceId(traceId)
+	if !respmsg.IsBatch() {
+		headerToMetadata(resp.Header, respmsg)
+	}
 	return respmsg, nil
 }
 
 func (self *H1Client) Send(rootCtx context.Context, msg jlib.Message) error {
+	return invokeSend(rootCtx, msg, self.interceptors, self.tracer, self.send)
+}
+
+func (self *H1Client) send(rootCtx context.Context, msg jlib.Message) error {
 	self.connect()
 
 	traceId := msg.TraceId()
@@ -190,6 +268,9 @@ func (self *H1Client) Send(rootCtx context.Context, msg jlib.Message) error {
 	if traceId != "" {
 		req.Header.Add("X-Trace-Id", traceId)
 	}
+	if !msg.IsBatch() {
+		metadataToHeader(msg.Metadata(), req.Header)
+	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
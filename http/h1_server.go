@@ -36,12 +36,22 @@ func (self *H1Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	msg, err := jlib.ParseBytes(buffer.Bytes())
+	msg, err := jlib.ParseBytesWithOptions(buffer.Bytes(), self.Actor.DecodeOptions)
 	if err != nil {
-		jlib.ErrorResponse(w, r, err, 400, "Bad jsonrpc request")
+		// reply the parse error or invalid request error
+		Logger(r).Warnf("bad jsonrpc request %s", err)
+		errmsg := jlib.NewDecodeErrorMessage(err)
+		data, _ := jlib.MessageBytes(errmsg)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(data)
 		return
 	}
 
+	if !msg.IsBatch() {
+		headerToMetadata(r.Header, msg)
+	}
+
 	req := NewRPCRequest(r.Context(), msg, TransportHTTP, r)
 	resmsg, err := self.Actor.Feed(req)
 	if err != nil {
@@ -80,16 +90,27 @@ func (self *H1Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		data, err1 := jlib.MessageBytes(resmsg)
 		if err1 != nil {
 			resmsg.Log().Warnf("error marshaling msg %s", err1)
+			if msg.IsBatch() {
+				w.WriteHeader(500)
+				w.Write([]byte("internal server error"))
+				return
+			}
 			errmsg := jlib.ErrInternalError.ToMessageFromId(msg.MustId(), msg.TraceId())
 			data, _ = jlib.MessageBytes(errmsg)
 		}
-		w.WriteHeader(200)
+		// headers must be set before WriteHeader()
 		w.Header().Set("Content-Type", "application/json")
-
 		if traceId != "" {
 			w.Header().Set("X-Trace-Id", traceId)
 		}
+		if !resmsg.IsBatch() {
+			metadataToHeader(resmsg.Metadata(), w.Header())
+		}
+		w.WriteHeader(200)
 		w.Write(data)
+	} else if msg.IsBatch() {
+		// a batch of notifies expects no response
+		w.WriteHeader(http.StatusNoContent)
 	} else {
 		w.WriteHeader(200)
 		w.Write([]byte(""))
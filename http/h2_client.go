@@ -29,14 +29,17 @@ type H2Client struct {
 }
 
 type h2Transport struct {
-	client  *H2Client
+	client *H2Client
+
+	// the stream shared by the read and write loops
+	lock    sync.Mutex
 	resp    *http.Response
 	decoder *json.Decoder
 	writer  io.Writer
 	flusher http.Flusher
 }
 
-func NewH2Client(serverUrl *url.URL) *H2Client {
+func NewH2Client(serverUrl *url.URL, optlist ...ClientOptions) *H2Client {
 	newUrl, err := url.Parse(serverUrl.String())
 	useh2c := false
 	if err != nil {
@@ -53,12 +56,18 @@ func NewH2Client(serverUrl *url.URL) *H2Client {
 	}
 	c := &H2Client{UseH2C: useh2c}
 	transport := &h2Transport{client: c}
-	c.InitStreaming(newUrl, transport)
+	c.InitStreaming(newUrl, transport, optlist...)
 	return c
 }
 
+func (self *h2Transport) transportType() string {
+	return TransportHTTP2
+}
+
 func (self *H2Client) HTTPClient() *http.Client {
 	self.clientOnce.Do(func() {
+		opts := self.ClientOptions()
+		dialer := &net.Dialer{Timeout: opts.connectTimeout()}
 		if self.UseH2C {
 			// refer to https://www.mailgun.com/blog/http-2-cleartext-h2c-client-example-go/
 			trans := &http2.Transport{
@@ -66,8 +75,10 @@ func (self *H2Client) HTTPClient() *http.Client {
 				// Pretend we are dialing a TLS endpoint.
 				// Note, we ignore the passed tls.Config
 				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
-					return net.Dial(network, addr)
+					return dialer.Dial(network, addr)
 				},
+				ReadIdleTimeout: opts.pingInterval(),
+				PingTimeout:     opts.pingInterval(),
 			}
 			self.httpClient = &http.Client{
 				Transport: trans,
@@ -77,6 +88,13 @@ func (self *H2Client) HTTPClient() *http.Client {
 				AllowHTTP: true,
 				//WriteByteTimeout: time.Second * 15,
 				TLSClientConfig: self.ClientTLSConfig(),
+				ReadIdleTimeout: opts.pingInterval(),
+				PingTimeout:     opts.pingInterval(),
+			}
+			if opts.ConnectTimeout > 0 {
+				trans.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					return tls.DialWithDialer(dialer, network, addr, cfg)
+				}
 			}
 
 			self.httpClient = &http.Client{
@@ -93,6 +111,8 @@ func (self *H2Client) String() string {
 
 // http2 transport methods
 func (self *h2Transport) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	if self.resp != nil {
 		self.resp.Body.Close()
 		self.resp = nil
@@ -102,7 +122,9 @@ func (self *h2Transport) Close() {
 	}
 }
 
-func (self h2Transport) Connected() bool {
+func (self *h2Transport) Connected() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	return self.resp != nil
 }
 
@@ -120,12 +142,38 @@ func (self *h2Transport) Connect(rootCtx context.Context, serverUrl *url.URL, he
 	if err != nil {
 		return self.handleHttp2Error(err)
 	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	self.writer = pipeWriter
 	self.resp = resp
-	self.decoder = json.NewDecoder(resp.Body)
+	if max := self.client.ClientOptions().MaxMessageSize; max > 0 {
+		limited := &messageLimitReader{r: resp.Body, max: max}
+		self.decoder = json.NewDecoder(limited)
+		limited.decoder = self.decoder
+	} else {
+		self.decoder = json.NewDecoder(resp.Body)
+	}
 	return nil
 }
 
+// messageLimitReader fails when the bytes read but not decoded yet
+// exceed the max size, i.e. a message is too large
+type messageLimitReader struct {
+	r       io.Reader
+	decoder *json.Decoder
+	max     int64
+	total   int64
+}
+
+func (self *messageLimitReader) Read(p []byte) (int, error) {
+	n, err := self.r.Read(p)
+	self.total += int64(n)
+	if self.total-self.decoder.InputOffset() > self.max {
+		return n, ErrMessageTooLarge
+	}
+	return n, err
+}
+
 func (self *h2Transport) handleHttp2Error(err error) error {
 	logger := self.client.Log()
 	var urlErr *url.Error
@@ -148,14 +196,26 @@ func (self *h2Transport) WriteMessage(msg jlib.Message) error {
 	}
 
 	marshaled = append(marshaled, []byte("\n")...)
-	if _, err := self.writer.Write(marshaled); err != nil {
+	self.lock.Lock()
+	writer := self.writer
+	self.lock.Unlock()
+	if writer == nil {
+		return TransportClosed
+	}
+	if _, err := writer.Write(marshaled); err != nil {
 		return self.handleHttp2Error(err)
 	}
 	return nil
 }
 
 func (self *h2Transport) ReadMessage() (jlib.Message, bool, error) {
-	msg, err := jlib.DecodeMessage(self.decoder)
+	self.lock.Lock()
+	decoder := self.decoder
+	self.lock.Unlock()
+	if decoder == nil {
+		return nil, false, TransportClosed
+	}
+	msg, err := jlib.DecodeMessage(decoder)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
 			return nil, false, TransportClosed
@@ -164,7 +224,7 @@ func (self *h2Transport) ReadMessage() (jlib.Message, bool, error) {
 		}
 		self.client.Log().Warnf(
 			"bad jsonrpc message %s %s, at pos %d",
-			reflect.TypeOf(err), err, self.decoder.InputOffset())
+			reflect.TypeOf(err), err, decoder.InputOffset())
 		return nil, false, err
 	}
 	return msg, true, nil
@@ -12,6 +12,7 @@ import (
 	"io"
 	"net/http"
 	"sync"
+	"time"
 )
 
 type H2Handler struct {
@@ -20,6 +21,9 @@ type H2Handler struct {
 	// options
 	SpawnGoroutine bool
 	UseH2C         bool
+	Session        SessionConfig
+
+	sessions sessionRegistry
 
 	fallbackHandler *H1Handler
 	fallbackOnce    sync.Once
@@ -32,9 +36,9 @@ type H2Session struct {
 	flusher     http.Flusher
 	httpRequest *http.Request
 	rootCtx     context.Context
-	done        chan error
-	sendChannel chan jlib.Message
+	stream      *streamSession
 	sessionId   string
+	authState   *sessionAuth
 }
 
 func NewH2Handler(serverCtx context.Context, actor *Actor) *H2Handler {
@@ -89,17 +93,31 @@ func (self *H2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		writer:      w,
 		flusher:     flusher,
 		decoder:     decoder,
-		done:        make(chan error, 10),
-		sendChannel: make(chan jlib.Message, 100),
+		stream:      newStreamSession(self.Session),
 		sessionId:   jlib.NewUuid(),
+		authState:   &sessionAuth{},
 	}
+	self.sessions.add(session.sessionId, session.stream)
+	self.Actor.startSession(r, session)
 	defer func() {
 		r.Body.Close()
+		self.sessions.remove(session.sessionId)
+		session.authState.unbind()
 		self.Actor.HandleClose(r, session)
 	}()
 	session.wait()
 }
 
+// Stats sums up the stats of live sessions
+func (self *H2Handler) Stats() SessionStats {
+	return self.sessions.stats()
+}
+
+// the response writers of http/2 supporting write deadlines
+type writeDeadliner interface {
+	SetWriteDeadline(deadline time.Time) error
+}
+
 // websocket session
 func (self *H2Session) wait() {
 	connCtx, cancel := context.WithCancel(self.rootCtx)
@@ -108,44 +126,57 @@ func (self *H2Session) wait() {
 	serverCtx, cancelServer := context.WithCancel(self.server.serverCtx)
 	defer cancelServer()
 
-	go self.sendLoop()
+	sendDone := make(chan struct{})
+	go func() {
+		defer close(sendDone)
+		self.stream.sendLoop(connCtx, self.write)
+	}()
 	go self.recvLoop()
 
-	for {
+	select {
+	case <-connCtx.Done():
+	case <-serverCtx.Done():
+	case <-self.stream.closed:
+		if err := self.stream.err(); err != nil {
+			log.Warnf("h2 session error %s", err)
+		}
+	}
+	self.stream.close(nil)
+
+	// the response writer must not be written after the handler
+	// returns, a write blocked by the peer is aborted by an expired
+	// deadline
+	if deadliner, ok := self.writer.(writeDeadliner); ok {
 		select {
-		case <-connCtx.Done():
-			return
-		case <-serverCtx.Done():
-			return
-		case err, ok := <-self.done:
-			if ok && err != nil {
-				log.Warnf("websocket error %s", err)
-			}
-			return
+		case <-sendDone:
+		case <-time.After(100 * time.Millisecond):
+			deadliner.SetWriteDeadline(time.Now().Add(-time.Second))
+			<-sendDone
 		}
 	}
 }
 
 func (self *H2Session) recvLoop() {
 	for {
-		msg, err := jlib.DecodeMessage(self.decoder)
+		msg, err := jlib.DecodeMessageWithOptions(self.decoder, self.server.Actor.DecodeOptions)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
-			} else {
-				self.done <- err
+			}
+			errmsg := jlib.NewDecodeErrorMessage(err)
+			self.Send(errmsg)
+			if errmsg.Error.Code == jlib.ErrParseMessage.Code {
+				// the stream is broken
+				self.stream.close(err)
 				return
 			}
+			// an invalid message was consumed, wait for next
+			continue
 		}
-		if self.server.SpawnGoroutine {
-			go self.msgReceived(msg)
-		} else {
-			self.msgReceived(msg)
-		}
+		self.stream.dispatch(msg, self.server.SpawnGoroutine, self.msgReceived)
 	}
 	// end of scanning
-	self.done <- nil
-	return
+	self.stream.close(nil)
 }
 
 func (self *H2Session) msgReceived(msg jlib.Message) {
@@ -158,53 +189,57 @@ func (self *H2Session) msgReceived(msg jlib.Message) {
 
 	resmsg, err := self.server.Actor.Feed(req)
 	if err != nil {
-		self.done <- errors.Wrap(err, "actor.Feed")
+		self.stream.close(errors.Wrap(err, "actor.Feed"))
 		return
 	}
 	if resmsg != nil {
-		if resmsg.IsResultOrError() {
-			self.sendChannel <- resmsg
-		} else {
-			self.Send(resmsg)
-		}
+		self.Send(resmsg)
 	}
 }
 
+// Send queues a message to the peer, what happens when the queue is
+// full depends on the SendPolicy
 func (self *H2Session) Send(msg jlib.Message) {
-	self.sendChannel <- msg
+	self.stream.enqueue(msg)
 }
 
-func (self H2Session) SessionID() string {
-	return self.sessionId
+// Call calls a request to the peer and waits for the result
+func (self *H2Session) Call(ctx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error) {
+	return self.stream.call(ctx, reqmsg)
 }
 
-func (self *H2Session) sendLoop() {
-	ctx, cancel := context.WithCancel(self.rootCtx)
-	defer cancel()
+// Stats returns the stats of the session
+func (self *H2Session) Stats() SessionStats {
+	return self.stream.stats()
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case msg, ok := <-self.sendChannel:
-			if !ok {
-				return
-			}
-			if self.decoder == nil {
-				return
-			}
-			marshaled, err := jlib.MessageBytes(msg)
-			if err != nil {
-				log.Warnf("marshal msg error %s", err)
-				return
-			}
+func (self H2Session) SessionID() string {
+	return self.sessionId
+}
 
-			marshaled = append(marshaled, []byte("\n")...)
-			if _, err := self.writer.Write(marshaled); err != nil {
-				log.Warnf("h2 writedata warning message %s\n", err)
-				return
-			}
-			self.flusher.Flush()
+func (self *H2Session) write(msg jlib.Message) error {
+	marshaled, err := jlib.MessageBytes(msg)
+	if err != nil {
+		return errors.Wrap(err, "marshal msg")
+	}
+	if deadliner, ok := self.writer.(writeDeadliner); ok {
+		if err := deadliner.SetWriteDeadline(self.stream.writeDeadline()); err != nil {
+			return errors.Wrap(err, "set write deadline")
 		}
 	}
+	marshaled = append(marshaled, []byte("\n")...)
+	if _, err := self.writer.Write(marshaled); err != nil {
+		return errors.Wrap(err, "h2 write data")
+	}
+	self.flusher.Flush()
+	return nil
+}
+
+func (self *H2Session) sessionAuth() *sessionAuth {
+	return self.authState
+}
+
+// Close the session
+func (self *H2Session) Close() {
+	self.stream.close(errors.New("session closed"))
 }
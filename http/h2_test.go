@@ -120,7 +120,7 @@ func TestTypedH2HandlerClient(t *testing.T) {
 	assert.True(resmsg1.IsError())
 	errbody1 := resmsg1.MustError()
 	assert.Equal(-32602, errbody1.Code) // params error
-	assert.Contains(errbody1.Message, "got unconvertible type")
+	assert.Contains(errbody1.Message, "cannot unmarshal")
 
 	// test params size
 	params2 := [](interface{}){}
@@ -150,7 +150,7 @@ func TestTypedH2HandlerClient(t *testing.T) {
 	assert.True(resmsg4.IsError())
 	errbody4 := resmsg4.MustError()
 	assert.Equal(-32602, errbody4.Code)
-	assert.Contains(errbody4.Message, "got unconvertible type")
+	assert.Contains(errbody4.Message, "cannot unmarshal")
 }
 
 func TestH2Close(t *testing.T) {
@@ -202,3 +202,60 @@ func TestH2Close(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 	assert.True(closeCalled[0])
 }
+
+func TestH2CallBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewH2Handler(rootCtx, nil)
+	server.Actor.OnTyped("add", func(a, b int) (int, error) {
+		return a + b, nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28801", server.H2CHandler(), nil)
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewH2Client(urlParse("h2c://127.0.0.1:28801"))
+	results, err := client.CallBatch(rootCtx, []jlib.Message{
+		jlib.NewRequestMessage(1, "add", []interface{}{1, 2}),
+		jlib.NewRequestMessage(2, "add", []interface{}{5, 6}),
+	})
+	assert.Nil(err)
+	assert.Equal(2, len(results))
+	assert.Equal(json.Number("3"), results[0].MustResult())
+	assert.Equal(json.Number("11"), results[1].MustResult())
+}
+
+func TestH2Bidirectional(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewH2Handler(rootCtx, nil)
+	server.Actor.OnRequest("ask", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		resmsg, err := req.Session().Call(req.Context(), jlib.NewRequestMessage(1, "whoami", nil))
+		if err != nil {
+			return nil, err
+		}
+		return resmsg.MustResult(), nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28802", server.H2CHandler(), nil)
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewH2Client(urlParse("h2c://127.0.0.1:28802"))
+	actor := NewActor()
+	actor.OnRequest("whoami", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		// the requests from server have no http request
+		if req.HasHttpRequest() {
+			return "unexpected http request", nil
+		}
+		return req.transportType + " client", nil
+	})
+	client.SetActor(actor)
+
+	resmsg, err := client.Call(rootCtx, jlib.NewRequestMessage(1, "ask", nil))
+	assert.Nil(err)
+	assert.Equal("http2 client", resmsg.MustResult())
+}
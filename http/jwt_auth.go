@@ -0,0 +1,515 @@
+package jlibhttp
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/hashicorp/golang-lru"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// JwtKeyConfig is a key to verify jwt tokens, either a HMAC secret
+// or a public key in PEM format, given inline or by a file
+type JwtKeyConfig struct {
+	// key id matched with the kid header of tokens, tokens without
+	// kid are verified by each key
+	Kid string `yaml:"kid,omitempty" json:"kid,omitempty"`
+
+	Secret string `yaml:"secret,omitempty" json:"secret,omitempty"`
+	PEM    string `yaml:"pem,omitempty" json:"pem,omitempty"`
+	File   string `yaml:"file,omitempty" json:"file,omitempty"`
+}
+
+type JwtAuthConfig struct {
+	// the HMAC secret
+	Secret string `yaml:"secret,omitempty" json:"secret,omitempty"`
+
+	// multiple active keys, so that keys can be rotated
+	Keys []JwtKeyConfig `yaml:"keys,omitempty" json:"keys,omitempty"`
+
+	// a local JWKS file, which is reloaded when it's changed
+	JwksFile string `yaml:"jwks_file,omitempty" json:"jwks_file,omitempty"`
+
+	// the allowed signing algorithms, e.g. HS256, RS256, ES256 and
+	// EdDSA, the default is derived from the types of keys
+	Algorithms []string `yaml:"algorithms,omitempty" json:"algorithms,omitempty"`
+
+	// the expected iss claim and the audience the aud claim must
+	// contain, not checked if empty
+	Issuer   string `yaml:"issuer,omitempty" json:"issuer,omitempty"`
+	Audience string `yaml:"audience,omitempty" json:"audience,omitempty"`
+
+	// seconds of clock skew tolerated when checking exp and nbf,
+	// the sessions authenticated by a token expire at exp plus
+	// the leeway
+	Leeway int `yaml:"leeway,omitempty" json:"leeway,omitempty"`
+
+	// the max number of verified tokens cached, default is 1000
+	CacheSize int `yaml:"cache_size,omitempty" json:"cache_size,omitempty"`
+}
+
+func (self JwtAuthConfig) validate() error {
+	if self.Secret == "" && len(self.Keys) == 0 && self.JwksFile == "" {
+		return errors.New("jwt has no secret or keys")
+	}
+	for _, alg := range self.Algorithms {
+		if jwt.GetSigningMethod(alg) == nil || alg == "none" {
+			return errors.Errorf("jwt algorithm %s is not supported", alg)
+		}
+	}
+	for _, keyCfg := range self.Keys {
+		if _, err := keyCfg.load(); err != nil {
+			return err
+		}
+	}
+	if self.JwksFile != "" {
+		if _, err := loadJwksFile(self.JwksFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jwtAudience is the aud claim, either a string or a list of strings
+type jwtAudience []string
+
+func (self *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*self = jwtAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return errors.New("aud must be a string or a list of strings")
+	}
+	*self = list
+	return nil
+}
+
+func (self jwtAudience) contains(aud string) bool {
+	for _, a := range self {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
+
+type jwtClaims struct {
+	Username string                 `json:"username"`
+	Settings map[string]interface{} `json:"settings,omitempty"`
+	jwt.StandardClaims
+
+	// overrides StandardClaims.Audience which cannot be a list
+	Audience jwtAudience `json:"aud,omitempty"`
+}
+
+type jwtKey struct {
+	kid string
+	key interface{}
+}
+
+func (self JwtKeyConfig) load() (jwtKey, error) {
+	if self.Secret != "" {
+		return jwtKey{kid: self.Kid, key: []byte(self.Secret)}, nil
+	}
+	data := []byte(self.PEM)
+	if self.File != "" {
+		var err error
+		data, err = os.ReadFile(self.File)
+		if err != nil {
+			return jwtKey{}, errors.Wrap(err, "read jwt key")
+		}
+	}
+	key, err := parsePublicKeyPEM(data)
+	if err != nil {
+		return jwtKey{}, err
+	}
+	return jwtKey{kid: self.Kid, key: key}, nil
+}
+
+// parse a RSA, ECDSA or Ed25519 public key or certificate in PEM
+func parsePublicKeyPEM(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("jwt key is not in PEM format")
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse jwt certificate")
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse jwt key")
+		}
+		return key, nil
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse jwt key")
+		}
+		return key, nil
+	}
+}
+
+// a JSON web key, refers to RFC 7517 and RFC 8037
+type jwkEntry struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+func loadJwksFile(path string) ([]jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read jwks file")
+	}
+	var jwks struct {
+		Keys []jwkEntry `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, errors.Wrap(err, "parse jwks file")
+	}
+	keys := make([]jwtKey, 0, len(jwks.Keys))
+	for _, entry := range jwks.Keys {
+		if entry.Use != "" && entry.Use != "sig" {
+			continue
+		}
+		key, err := entry.publicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "jwk %s", entry.Kid)
+		}
+		keys = append(keys, jwtKey{kid: entry.Kid, key: key})
+	}
+	return keys, nil
+}
+
+func (self jwkEntry) publicKey() (interface{}, error) {
+	decode := func(s string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	switch self.Kty {
+	case "RSA":
+		n, err := decode(self.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(self.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch self.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %s", self.Crv)
+		}
+		x, err := decode(self.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(self.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return key, nil
+	case "OKP":
+		if self.Crv != "Ed25519" {
+			return nil, errors.Errorf("unsupported curve %s", self.Crv)
+		}
+		x, err := decode(self.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		k, err := decode(self.K)
+		if err != nil {
+			return nil, err
+		}
+		return k, nil
+	default:
+		return nil, errors.Errorf("unsupported key type %s", self.Kty)
+	}
+}
+
+// the default algorithms allowed for a key
+func keyAlgorithm(key interface{}) string {
+	switch k := key.(type) {
+	case []byte:
+		return "HS256"
+	case *rsa.PublicKey:
+		return "RS256"
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P384():
+			return "ES384"
+		case elliptic.P521():
+			return "ES512"
+		default:
+			return "ES256"
+		}
+	case ed25519.PublicKey:
+		return "EdDSA"
+	default:
+		return ""
+	}
+}
+
+// jwtVerifier verifies jwt tokens against the keys configured and
+// the keys of the JWKS file, verified claims are cached until they
+// expire or the keys change.
+type jwtVerifier struct {
+	cfg   *JwtAuthConfig
+	cache *lru.Cache
+
+	lock        sync.RWMutex
+	staticKeys  []jwtKey
+	jwksKeys    []jwtKey
+	jwksModTime time.Time
+	jwksChecked time.Time
+	// increased whenever the keys change
+	version int
+}
+
+type cachedClaims struct {
+	claims  *jwtClaims
+	version int
+}
+
+// the interval to check whether the JWKS file changes
+var jwksCheckInterval = time.Second
+
+func newJwtVerifier(cfg *JwtAuthConfig) *jwtVerifier {
+	cacheSize := cfg.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = 1000
+	}
+	cache, err := lru.New(cacheSize)
+	if err != nil {
+		panic(err)
+	}
+	v := &jwtVerifier{cfg: cfg, cache: cache}
+	if cfg.Secret != "" {
+		v.staticKeys = append(v.staticKeys, jwtKey{key: []byte(cfg.Secret)})
+	}
+	for _, keyCfg := range cfg.Keys {
+		key, err := keyCfg.load()
+		if err != nil {
+			log.Errorf("load jwt key %s error %s", keyCfg.Kid, err)
+			continue
+		}
+		v.staticKeys = append(v.staticKeys, key)
+	}
+	return v
+}
+
+// reload the JWKS file if it's changed, returns the keys and the
+// version of them
+func (self *jwtVerifier) keys() ([]jwtKey, int) {
+	if self.cfg.JwksFile == "" {
+		return self.staticKeys, 0
+	}
+	self.lock.RLock()
+	if time.Since(self.jwksChecked) < jwksCheckInterval {
+		defer self.lock.RUnlock()
+		return self.mergedKeys(), self.version
+	}
+	self.lock.RUnlock()
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.jwksChecked = time.Now()
+	if info, err := os.Stat(self.cfg.JwksFile); err != nil {
+		log.Warnf("stat jwks file error %s", err)
+	} else if !info.ModTime().Equal(self.jwksModTime) {
+		if keys, err := loadJwksFile(self.cfg.JwksFile); err != nil {
+			log.Warnf("load jwks file error %s", err)
+		} else {
+			self.jwksKeys = keys
+			self.jwksModTime = info.ModTime()
+			self.version++
+		}
+	}
+	return self.mergedKeys(), self.version
+}
+
+func (self *jwtVerifier) mergedKeys() []jwtKey {
+	keys := make([]jwtKey, 0, len(self.jwksKeys)+len(self.staticKeys))
+	keys = append(keys, self.jwksKeys...)
+	return append(keys, self.staticKeys...)
+}
+
+func (self *jwtVerifier) allowed(alg string, keys []jwtKey) bool {
+	if len(self.cfg.Algorithms) > 0 {
+		for _, a := range self.cfg.Algorithms {
+			if a == alg {
+				return true
+			}
+		}
+		return false
+	}
+	for _, key := range keys {
+		if keyAlgorithm(key.key) == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify the token and returns the claims
+func (self *jwtVerifier) Verify(tokenStr string) (*jwtClaims, error) {
+	keys, version := self.keys()
+
+	sum := sha256.Sum256([]byte(tokenStr))
+	cacheKey := string(sum[:])
+	if cached, ok := self.cache.Get(cacheKey); ok {
+		entry, _ := cached.(cachedClaims)
+		if entry.version == version {
+			if err := self.validateClaims(entry.claims); err != nil {
+				self.cache.Remove(cacheKey)
+				return nil, err
+			}
+			return entry.claims, nil
+		}
+		self.cache.Remove(cacheKey)
+	}
+
+	claims := &jwtClaims{}
+	token, parts, err := new(jwt.Parser).ParseUnverified(tokenStr, claims)
+	if err != nil {
+		return nil, err
+	}
+	alg := token.Method.Alg()
+	if !self.allowed(alg, keys) {
+		return nil, errors.Errorf("jwt algorithm %s is not allowed", alg)
+	}
+	kid, _ := token.Header["kid"].(string)
+
+	signingString := strings.Join(parts[0:2], ".")
+	verified := false
+	for _, key := range keys {
+		if kid != "" && key.kid != kid {
+			continue
+		}
+		if err := token.Method.Verify(signingString, parts[2], key.key); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("jwt signature is invalid")
+	}
+	if err := self.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	self.cache.Add(cacheKey, cachedClaims{claims: claims, version: version})
+	return claims, nil
+}
+
+// the time the claims expire at including the leeway, which is taken
+// by both the verification and the sessions authenticated
+func (self *jwtVerifier) expiresAt(claims *jwtClaims) time.Time {
+	return time.Unix(claims.ExpiresAt+int64(self.cfg.Leeway), 0)
+}
+
+func (self *jwtVerifier) validateClaims(claims *jwtClaims) error {
+	now := time.Now().UTC().Unix()
+	leeway := int64(self.cfg.Leeway)
+	if time.Now().After(self.expiresAt(claims)) {
+		return errors.New("jwt is expired")
+	}
+	if claims.NotBefore-leeway > now {
+		return errors.New("jwt is not valid yet")
+	}
+	if claims.IssuedAt-leeway > now {
+		return errors.New("jwt is issued in the future")
+	}
+	if self.cfg.Issuer != "" && claims.Issuer != self.cfg.Issuer {
+		return errors.Errorf("jwt issuer %s is not expected", claims.Issuer)
+	}
+	if self.cfg.Audience != "" && !claims.Audience.contains(self.cfg.Audience) {
+		return errors.New("jwt audience is not expected")
+	}
+	return nil
+}
+
+// JwtAuthenticator authenticates the jwt tokens carried by the
+// Authorization header as bearer tokens
+type JwtAuthenticator struct {
+	verifier *jwtVerifier
+}
+
+func NewJwtAuthenticator(cfg *JwtAuthConfig) *JwtAuthenticator {
+	return &JwtAuthenticator{verifier: newJwtVerifier(cfg)}
+}
+
+func (self *JwtAuthenticator) Authenticate(r *http.Request) (*AuthInfo, bool) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return nil, false
+	}
+	if arr := strings.SplitN(authHeader, " ", 2); len(arr) == 2 && arr[0] == "Bearer" {
+		claims, err := self.verifier.Verify(arr[1])
+		if err != nil {
+			Logger(r).Warnf("jwt auth error %s", err)
+			return nil, false
+		}
+		username := claims.Username
+		if username == "" {
+			username = claims.Subject
+		}
+		return &AuthInfo{
+			Username:  username,
+			Settings:  claims.Settings,
+			ExpiresAt: self.verifier.expiresAt(claims)}, true
+	}
+	return nil, false
+}
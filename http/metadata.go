@@ -0,0 +1,81 @@
+package jlibhttp
+
+import (
+	"github.com/superisaac/jlib"
+	"github.com/superisaac/jlib/trace"
+	"net/http"
+	"strings"
+)
+
+// MetadataHeaderPrefix is the prefix of http headers which mirror the
+// metadata of messages sent over http/1.1, i.e. the metadata
+// {"tenant": "abc"} is mirrored as the header X-Jsonrpc-Meta-Tenant: abc,
+// except that the trace context is mirrored as the standard
+// traceparent and tracestate headers
+var MetadataHeaderPrefix = "X-Jsonrpc-Meta-"
+
+// the metadata keys mapped to standard http headers without prefix
+var standardMetaHeaders = map[string]string{
+	jlibtrace.TraceparentKey: "Traceparent",
+	jlibtrace.TracestateKey:  "Tracestate",
+}
+
+// set the metadata of a message to http headers, the keys or values
+// which are not valid in headers are left in the message body only.
+func metadataToHeader(md jlib.Metadata, header http.Header) {
+	for k, v := range md {
+		if !validHeaderKey(k) || strings.ContainsAny(v, "\r\n") {
+			continue
+		}
+		if hn, ok := standardMetaHeaders[k]; ok {
+			header.Set(hn, v)
+		} else {
+			header.Set(MetadataHeaderPrefix+k, v)
+		}
+	}
+}
+
+// merge the metadata carried by http headers into the message, keys
+// are lowercased, the metadata in message body takes precedence.
+func headerToMetadata(header http.Header, msg jlib.Message) {
+	for key, hn := range standardMetaHeaders {
+		if hv := header.Get(hn); hv != "" && !hasMetaKey(msg.Metadata(), key) {
+			msg.SetMeta(key, hv)
+		}
+	}
+	prefix := http.CanonicalHeaderKey(MetadataHeaderPrefix)
+	for hn, hvs := range header {
+		if len(hvs) == 0 || len(hn) <= len(prefix) || !strings.EqualFold(hn[:len(prefix)], prefix) {
+			continue
+		}
+		key := strings.ToLower(hn[len(prefix):])
+		if hasMetaKey(msg.Metadata(), key) {
+			continue
+		}
+		msg.SetMeta(key, hvs[0])
+	}
+}
+
+func hasMetaKey(md jlib.Metadata, key string) bool {
+	for k := range md {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// the token chars allowed in a header name
+func validHeaderKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
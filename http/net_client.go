@@ -0,0 +1,152 @@
+package jlibhttp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/superisaac/jlib"
+)
+
+// NetClient is the streaming client over raw tcp or unix socket
+// connections, the server url is like tcp://127.0.0.1:9000 or
+// unix:///var/run/jsonrpc.sock, with an optional query framing=length
+// to use the length prefixed framing instead of ndjson.
+type NetClient struct {
+	StreamingClient
+}
+
+type netTransport struct {
+	client  *NetClient
+	network string
+	address string
+	framing Framing
+
+	// the connection shared by the read and write loops
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *frameReader
+}
+
+func NewNetClient(serverUrl *url.URL, optlist ...ClientOptions) *NetClient {
+	network, address, framing, err := parseNetURL(serverUrl)
+	if err != nil {
+		log.Panicf("server url %s is not tcp or unix, %s", serverUrl, err)
+	}
+	c := &NetClient{}
+	transport := &netTransport{
+		client:  c,
+		network: network,
+		address: address,
+		framing: framing,
+	}
+	c.InitStreaming(serverUrl, transport, optlist...)
+	return c
+}
+
+func (self *NetClient) String() string {
+	return fmt.Sprintf("%s client %s", self.serverUrl.Scheme, self.serverUrl)
+}
+
+// net transport methods
+func (self *netTransport) transportType() string {
+	if self.network == "unix" {
+		return TransportUnix
+	}
+	return TransportTCP
+}
+
+func (self *netTransport) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.conn != nil {
+		self.conn.Close()
+		self.conn = nil
+		self.reader = nil
+	}
+}
+
+func (self *netTransport) Connected() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.conn != nil
+}
+
+// the header is not used by raw connections
+func (self *netTransport) Connect(rootCtx context.Context, serverUrl *url.URL, header http.Header) error {
+	opts := self.client.ClientOptions()
+	dialer := &net.Dialer{
+		Timeout:   opts.connectTimeout(),
+		KeepAlive: opts.pingInterval(),
+	}
+	conn, err := dialer.DialContext(rootCtx, self.network, self.address)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) {
+			self.client.Log().Infof("%s operror %s", self.network, opErr)
+			return TransportConnectFailed
+		}
+		return errors.Wrap(err, "nettransport.connect")
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if opts.ReadBufferSize > 0 {
+			tcpConn.SetReadBuffer(opts.ReadBufferSize)
+		}
+		if opts.WriteBufferSize > 0 {
+			tcpConn.SetWriteBuffer(opts.WriteBufferSize)
+		}
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.conn = conn
+	self.reader = newFrameReader(conn, self.framing, opts.MaxMessageSize)
+	return nil
+}
+
+func (self *netTransport) WriteMessage(msg jlib.Message) error {
+	marshaled, err := jlib.MessageBytes(msg)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	conn := self.conn
+	self.lock.Unlock()
+	if conn == nil {
+		return TransportClosed
+	}
+	if err := writeFrame(conn, self.framing, marshaled); err != nil {
+		if isClosedError(err) {
+			return TransportClosed
+		}
+		return errors.Wrap(err, "nettransport.write")
+	}
+	return nil
+}
+
+func (self *netTransport) ReadMessage() (jlib.Message, bool, error) {
+	self.lock.Lock()
+	reader := self.reader
+	self.lock.Unlock()
+	if reader == nil {
+		return nil, false, TransportClosed
+	}
+	data, err := reader.ReadFrame()
+	if err != nil {
+		if isClosedError(err) {
+			return nil, false, TransportClosed
+		}
+		return nil, false, errors.Wrap(err, "nettransport.read")
+	}
+	msg, err := jlib.ParseBytes(data)
+	if err != nil {
+		// the frame is intact, skip to the next one
+		self.client.Log().Warnf("bad jsonrpc message %s", data)
+		return nil, false, nil
+	}
+	return msg, true, nil
+}
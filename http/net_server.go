@@ -0,0 +1,292 @@
+package jlibhttp
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/superisaac/jlib"
+)
+
+// NetServer serves jsonrpc over raw tcp or unix socket connections
+// and stdio, each connection is a session like the websocket one
+type NetServer struct {
+	Actor     *Actor
+	serverCtx context.Context
+	// options
+	SpawnGoroutine bool
+	Session        SessionConfig
+	Framing        Framing
+
+	// the max size of a message received, default is 16MB
+	MaxMessageSize int64
+
+	sessions sessionRegistry
+}
+
+type NetSession struct {
+	server *NetServer
+	conn   io.ReadWriteCloser
+	// the pseudo http request carrying the remote address and the
+	// context of the connection
+	httpRequest   *http.Request
+	transportType string
+	rootCtx       context.Context
+	stream        *streamSession
+	sessionId     string
+	authState     *sessionAuth
+}
+
+func NewNetServer(serverCtx context.Context, actor *Actor) *NetServer {
+	if actor == nil {
+		actor = NewActor()
+	}
+	return &NetServer{
+		serverCtx:      serverCtx,
+		Actor:          actor,
+		SpawnGoroutine: true,
+		Framing:        FramingNDJSON,
+	}
+}
+
+// parse the bind url, i.e. tcp://127.0.0.1:9000 or
+// unix:///var/run/jsonrpc.sock, an optional query framing=length or
+// framing=header overrides the framing
+func parseNetURL(u *url.URL) (network string, address string, framing Framing, err error) {
+	switch u.Scheme {
+	case "tcp":
+		network, address = "tcp", u.Host
+	case "unix":
+		network, address = "unix", u.Host+u.Path
+	default:
+		return "", "", "", errors.Errorf("url scheme %s is not tcp or unix", u.Scheme)
+	}
+	framing = Framing(u.Query().Get("framing"))
+	if err := framing.validate(); err != nil {
+		return "", "", "", err
+	}
+	return network, address, framing, nil
+}
+
+// ListenAndServe listens at the bind url and serves until the server
+// context is done
+func (self *NetServer) ListenAndServe(bind string) error {
+	u, err := url.Parse(bind)
+	if err != nil {
+		return errors.Wrap(err, "url.Parse")
+	}
+	network, address, framing, err := parseNetURL(u)
+	if err != nil {
+		return err
+	}
+	if framing != "" {
+		self.Framing = framing
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return self.Serve(listener)
+}
+
+// Serve accepts connections from the listener until the server
+// context is done, the listener is closed then
+func (self *NetServer) Serve(listener net.Listener) error {
+	serverCtx, cancelServer := context.WithCancel(self.serverCtx)
+	defer cancelServer()
+
+	go func() {
+		<-serverCtx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if serverCtx.Err() != nil {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return errors.Wrap(err, "listener.Accept")
+		}
+		go self.ServeConn(serverCtx, conn)
+	}
+}
+
+// ServeConn serves a connection until it's closed
+func (self *NetServer) ServeConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	transportType := TransportTCP
+	if conn.LocalAddr().Network() == "unix" {
+		transportType = TransportUnix
+	}
+	r, err := http.NewRequestWithContext(connCtx, "CONNECT", transportType+"://"+conn.LocalAddr().String(), nil)
+	if err != nil {
+		log.Warnf("new pseudo request error %s", err)
+		return
+	}
+	if addr := conn.RemoteAddr(); addr != nil && addr.String() != "" {
+		r.RemoteAddr = addr.String()
+	} else {
+		// the unnamed unix socket peer
+		r.RemoteAddr = transportType
+	}
+
+	self.serveSession(connCtx, conn, transportType, r)
+}
+
+// serve a session over the byte stream until either side closes it
+func (self *NetServer) serveSession(ctx context.Context, conn io.ReadWriteCloser, transportType string, r *http.Request) {
+	session := &NetSession{
+		server:        self,
+		conn:          conn,
+		httpRequest:   r,
+		transportType: transportType,
+		rootCtx:       ctx,
+		stream:        newStreamSession(self.Session),
+		sessionId:     jlib.NewUuid(),
+		authState:     &sessionAuth{},
+	}
+	self.sessions.add(session.sessionId, session.stream)
+	self.Actor.startSession(r, session)
+	defer func() {
+		self.sessions.remove(session.sessionId)
+		session.authState.unbind()
+		self.Actor.HandleClose(r, session)
+	}()
+	session.wait()
+}
+
+// Stats sums up the stats of live sessions
+func (self *NetServer) Stats() SessionStats {
+	return self.sessions.stats()
+}
+
+func (self *NetSession) wait() {
+	go self.stream.sendLoop(self.rootCtx, self.write)
+	go self.recvLoop()
+
+	select {
+	case <-self.rootCtx.Done():
+	case <-self.stream.closed:
+		if err := self.stream.err(); err != nil {
+			log.Warnf("%s session error %s", self.transportType, err)
+		}
+	}
+	self.stream.close(nil)
+}
+
+func (self *NetSession) recvLoop() {
+	reader := newFrameReader(self.conn, self.server.Framing, self.server.MaxMessageSize)
+	for {
+		data, err := reader.ReadFrame()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				// the peer stops sending, reply the messages
+				// received before closing
+				self.stream.drain()
+			} else if isClosedError(err) {
+				self.stream.close(nil)
+			} else {
+				self.stream.close(errors.Wrap(err, "read frame"))
+			}
+			return
+		}
+		msg, err := jlib.ParseBytesWithOptions(data, self.server.Actor.DecodeOptions)
+		if err != nil {
+			log.Warnf("bad jsonrpc message %s", data)
+			self.Send(jlib.NewDecodeErrorMessage(err))
+			continue
+		}
+		self.stream.dispatch(msg, self.server.SpawnGoroutine, self.msgReceived)
+	}
+}
+
+func (self *NetSession) msgReceived(msg jlib.Message) {
+	req := NewRPCRequest(
+		self.rootCtx,
+		msg,
+		self.transportType,
+		self.httpRequest)
+	req.session = self
+
+	resmsg, err := self.server.Actor.Feed(req)
+	if err != nil {
+		self.stream.close(errors.Wrap(err, "actor.Feed"))
+		return
+	}
+	if resmsg != nil {
+		self.Send(resmsg)
+	}
+}
+
+// Send queues a message to the peer, what happens when the queue is
+// full depends on the SendPolicy
+func (self *NetSession) Send(msg jlib.Message) {
+	self.stream.enqueue(msg)
+}
+
+// Call calls a request to the peer and waits for the result
+func (self *NetSession) Call(ctx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error) {
+	return self.stream.call(ctx, reqmsg)
+}
+
+// Stats returns the stats of the session
+func (self *NetSession) Stats() SessionStats {
+	return self.stream.stats()
+}
+
+func (self NetSession) SessionID() string {
+	return self.sessionId
+}
+
+func (self *NetSession) write(msg jlib.Message) error {
+	marshaled, err := jlib.MessageBytes(msg)
+	if err != nil {
+		return errors.Wrap(err, "marshal msg")
+	}
+	if deadliner, ok := self.conn.(writeDeadliner); ok {
+		if err := deadliner.SetWriteDeadline(self.stream.writeDeadline()); err != nil {
+			return errors.Wrap(err, "conn.SetWriteDeadline()")
+		}
+	}
+	if err := writeFrame(self.conn, self.server.Framing, marshaled); err != nil {
+		return errors.Wrap(err, "write frame")
+	}
+	return nil
+}
+
+func (self *NetSession) sessionAuth() *sessionAuth {
+	return self.authState
+}
+
+// Close the session
+func (self *NetSession) Close() {
+	self.stream.close(errors.New("session closed"))
+}
+
+// the errors of reading a connection closed by either side
+func isClosedError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, os.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		strings.Contains(err.Error(), "connection reset by peer")
+}
@@ -0,0 +1,342 @@
+package jlibhttp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/superisaac/jlib"
+)
+
+func TestNetServerClient(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewNetServer(rootCtx, nil)
+	server.Actor.On("echo", func(params []interface{}) (interface{}, error) {
+		if len(params) > 0 {
+			return params[0], nil
+		} else {
+			return nil, jlib.ParamsError("no argument given")
+		}
+	})
+	server.Actor.OnRequest("push", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		req.Session().Send(jlib.NewNotifyMessage("pushed", params))
+		return "ok", nil
+	})
+	go server.ListenAndServe("tcp://127.0.0.1:28139")
+	time.Sleep(10 * time.Millisecond)
+
+	c, err := NewClient("tcp://127.0.0.1:28139")
+	assert.Nil(err)
+	client, ok := c.(*NetClient)
+	assert.True(ok)
+
+	resmsg, err := client.Call(rootCtx, jlib.NewRequestMessage(1, "echo", []interface{}{"hello tcp"}))
+	assert.Nil(err)
+	assert.Equal("hello tcp", resmsg.MustResult())
+
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(2, "echo", nil))
+	assert.Nil(err)
+	assert.True(resmsg.IsError())
+	assert.Equal(-32602, resmsg.MustError().Code)
+
+	// server pushes a notify through the session
+	pushed := make(chan jlib.Message, 1)
+	client.OnMessage(func(msg jlib.Message) {
+		pushed <- msg
+	})
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(3, "push", []interface{}{"news"}))
+	assert.Nil(err)
+	assert.Equal("ok", resmsg.MustResult())
+	select {
+	case msg := <-pushed:
+		assert.Equal("pushed", msg.MustMethod())
+		assert.Equal([]interface{}{"news"}, msg.MustParams())
+	case <-time.After(time.Second):
+		assert.Fail("no message pushed")
+	}
+
+	stats := server.Stats()
+	assert.Equal(1, stats.Sessions)
+	assert.Equal(uint64(3), stats.Received)
+
+	// batch over tcp
+	results, err := client.CallBatch(rootCtx, []jlib.Message{
+		jlib.NewRequestMessage(4, "echo", []interface{}{"a"}),
+		jlib.NewRequestMessage(5, "echo", []interface{}{"b"}),
+	})
+	assert.Nil(err)
+	assert.Equal(2, len(results))
+	assert.Equal("b", results[1].MustResult())
+
+	client.Close()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(0, server.Stats().Sessions)
+}
+
+func TestUnixLengthFraming(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewNetServer(rootCtx, nil)
+	server.Actor.On("echo", func(params []interface{}) (interface{}, error) {
+		return params, nil
+	})
+	sockPath := filepath.Join(t.TempDir(), "jsonrpc.sock")
+	go server.ListenAndServe("unix://" + sockPath + "?framing=length")
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewNetClient(urlParse("unix://" + sockPath + "?framing=length"))
+	resmsg, err := client.Call(rootCtx, jlib.NewRequestMessage(1, "echo", []interface{}{"hello", "unix"}))
+	assert.Nil(err)
+	assert.Equal([]interface{}{"hello", "unix"}, resmsg.MustResult())
+	client.Close()
+
+	// unknown framing
+	_, err = NewClient("tcp://127.0.0.1:28140?framing=xml")
+	assert.NotNil(err)
+
+	// a raw connection speaking the length prefixed framing
+	conn, err := net.Dial("unix", sockPath)
+	assert.Nil(err)
+	defer conn.Close()
+	reader := newFrameReader(conn, FramingLength, 0)
+	err = writeFrame(conn, FramingLength, []byte(`{"jsonrpc": "2.0", "id": 2, "method": "echo", "params": ["three"]}`))
+	assert.Nil(err)
+	data, err := reader.ReadFrame()
+	assert.Nil(err)
+	msg, err := jlib.ParseBytes(data)
+	assert.Nil(err)
+	assert.Equal([]interface{}{"three"}, msg.MustResult())
+}
+
+func TestNetClientBadMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a raw server replying a malformed message before the result
+	sockPath := filepath.Join(t.TempDir(), "jsonrpc.sock")
+	listener, err := net.Listen("unix", sockPath)
+	if !assert.Nil(err) {
+		return
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, err := newFrameReader(conn, FramingNDJSON, 0).ReadFrame()
+		if err != nil {
+			return
+		}
+		reqmsg, err := jlib.ParseBytes(data)
+		if err != nil {
+			return
+		}
+		writeFrame(conn, FramingNDJSON, []byte(`{"jsonrpc": "2.0", "id": `))
+		resmsg := jlib.NewResultMessage(reqmsg, "still connected")
+		marshaled, _ := jlib.MessageBytes(resmsg)
+		writeFrame(conn, FramingNDJSON, marshaled)
+		<-rootCtx.Done()
+	}()
+
+	client := NewNetClient(urlParse("unix://" + sockPath))
+	defer client.Close()
+	resmsg, err := client.Call(rootCtx, jlib.NewRequestMessage(1, "echo", nil))
+	assert.Nil(err)
+	assert.Equal("still connected", resmsg.MustResult())
+	assert.True(client.Connected())
+}
+
+func TestFrameReader(t *testing.T) {
+	assert := assert.New(t)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		c1.Write([]byte("\n{\"a\": 1}\n  \n{\"b\": 2}\n"))
+		c1.Write([]byte("0123456789abcdef0123\n"))
+	}()
+	reader := newFrameReader(c2, FramingNDJSON, 16)
+	data, err := reader.ReadFrame()
+	assert.Nil(err)
+	assert.Equal(`{"a": 1}`, string(data))
+	data, err = reader.ReadFrame()
+	assert.Nil(err)
+	assert.Equal(`{"b": 2}`, string(data))
+	_, err = reader.ReadFrame()
+	assert.ErrorIs(err, ErrMessageTooLarge)
+}
+
+func TestHeaderFraming(t *testing.T) {
+	assert := assert.New(t)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		writeFrame(c1, FramingHeader, []byte(`{"a": 1}`))
+		c1.Write([]byte("\r\nContent-Type: application/vscode-jsonrpc; charset=utf-8\r\ncontent-length: 8\r\n\r\n{\"b\": 2}"))
+		c1.Write([]byte("Content-Length: 17\r\n\r\n"))
+	}()
+	reader := newFrameReader(c2, FramingHeader, 16)
+	data, err := reader.ReadFrame()
+	assert.Nil(err)
+	assert.Equal(`{"a": 1}`, string(data))
+	data, err = reader.ReadFrame()
+	assert.Nil(err)
+	assert.Equal(`{"b": 2}`, string(data))
+	_, err = reader.ReadFrame()
+	assert.ErrorIs(err, ErrMessageTooLarge)
+}
+
+// the server run by the subprocess of TestStdioClient
+func runStdioTestServer() {
+	server := NewStdioServer(context.Background(), nil)
+	server.Actor.On("echo", func(params []interface{}) (interface{}, error) {
+		return params, nil
+	})
+	server.Actor.OnRequest("push", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		req.Session().Send(jlib.NewNotifyMessage("pushed", params))
+		return "ok", nil
+	})
+	server.Actor.On("pid", func(params []interface{}) (interface{}, error) {
+		return os.Getpid(), nil
+	})
+	server.Actor.On("exit", func(params []interface{}) (interface{}, error) {
+		os.Exit(0)
+		return nil, nil
+	})
+	server.ServeStdio()
+}
+
+func TestStdioClient(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "JLIB_TEST_STDIO_SERVER=1")
+	client := NewStdioClient(cmd)
+
+	pushed := make(chan jlib.Message, 1)
+	client.OnMessage(func(msg jlib.Message) {
+		pushed <- msg
+	})
+
+	// the subprocess outlives the deadline of the call spawned it
+	callCtx, callCancel := context.WithTimeout(rootCtx, 50*time.Millisecond)
+	defer callCancel()
+	resmsg, err := client.Call(callCtx, jlib.NewRequestMessage(4, "pid", nil))
+	assert.Nil(err)
+	pid := resmsg.MustResult()
+	<-callCtx.Done()
+	time.Sleep(20 * time.Millisecond)
+	assert.True(client.Connected())
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(5, "pid", nil))
+	assert.Nil(err)
+	assert.Equal(pid, resmsg.MustResult())
+
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(1, "echo", []interface{}{"hello stdio"}))
+	assert.Nil(err)
+	assert.Equal([]interface{}{"hello stdio"}, resmsg.MustResult())
+
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(2, "push", []interface{}{"news"}))
+	assert.Nil(err)
+	assert.Equal("ok", resmsg.MustResult())
+	select {
+	case msg := <-pushed:
+		assert.Equal("pushed", msg.MustMethod())
+	case <-time.After(time.Second):
+		assert.Fail("no message pushed")
+	}
+
+	// the subprocess exits and is spawned again on reconnecting
+	client.SetReconnect(&ReconnectConfig{InitialDelay: 10 * time.Millisecond})
+	reconnected := make(chan bool, 1)
+	client.OnReconnected(func() {
+		reconnected <- true
+	})
+	err = client.Send(rootCtx, jlib.NewNotifyMessage("exit", nil))
+	assert.Nil(err)
+	select {
+	case <-reconnected:
+	case <-time.After(3 * time.Second):
+		assert.Fail("not reconnected")
+	}
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(3, "echo", []interface{}{"again"}))
+	assert.Nil(err)
+	assert.Equal([]interface{}{"again"}, resmsg.MustResult())
+	client.Close()
+}
+
+func TestServeIO(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewStdioServer(rootCtx, nil)
+	server.Actor.On("echo", func(params []interface{}) (interface{}, error) {
+		return params, nil
+	})
+
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	served := make(chan bool)
+	go func() {
+		server.ServeIO(rootCtx, inReader, outWriter)
+		close(served)
+	}()
+
+	err := writeFrame(inWriter, FramingHeader, []byte(`{"jsonrpc": "2.0", "id": 1, "method": "echo", "params": ["io"]}`))
+	assert.Nil(err)
+	data, err := newFrameReader(outReader, FramingHeader, 0).ReadFrame()
+	assert.Nil(err)
+	msg, err := jlib.ParseBytes(data)
+	assert.Nil(err)
+	assert.Equal([]interface{}{"io"}, msg.MustResult())
+
+	// the session ends on EOF of input
+	inWriter.Close()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		assert.Fail("session not ended")
+	}
+
+	// the requests before EOF are replied before the session ends
+	server.Actor.On("slowEcho", func(params []interface{}) (interface{}, error) {
+		time.Sleep(20 * time.Millisecond)
+		return params, nil
+	})
+	var input, output bytes.Buffer
+	err = writeFrame(&input, FramingHeader, []byte(`{"jsonrpc": "2.0", "id": 2, "method": "slowEcho", "params": ["eof"]}`))
+	assert.Nil(err)
+	server.ServeIO(rootCtx, &input, &output)
+	data, err = newFrameReader(&output, FramingHeader, 0).ReadFrame()
+	assert.Nil(err)
+	msg, err = jlib.ParseBytes(data)
+	assert.Nil(err)
+	assert.Equal([]interface{}{"eof"}, msg.MustResult())
+}
@@ -0,0 +1,242 @@
+package jlibhttp
+
+import (
+	"math"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/superisaac/jlib"
+)
+
+// RateLimit is a token bucket, which refills Rate tokens per second
+// up to Burst tokens, each request or notify takes one token
+type RateLimit struct {
+	Rate  float64 `yaml:"rate" json:"rate"`
+	Burst int     `yaml:"burst" json:"burst"`
+}
+
+// RateLimitConfig configures the buckets a request must pass, the
+// buckets of each dimension are separated by user, method, remote
+// address or session.
+type RateLimitConfig struct {
+	// limit per AuthInfo.Username, anonymous requests are not
+	// limited by this
+	PerUser *RateLimit `yaml:"per_user,omitempty" json:"per_user,omitempty"`
+
+	// limits of methods matching the glob patterns, shared by all
+	// clients
+	PerMethod map[string]RateLimit `yaml:"per_method,omitempty" json:"per_method,omitempty"`
+
+	// limit per remote ip address
+	PerRemoteAddr *RateLimit `yaml:"per_remote_addr,omitempty" json:"per_remote_addr,omitempty"`
+
+	// limit per streaming session
+	PerSession *RateLimit `yaml:"per_session,omitempty" json:"per_session,omitempty"`
+}
+
+func (self RateLimit) validate() error {
+	if self.Rate <= 0 {
+		return errors.Errorf("rate limit rate %v is not positive", self.Rate)
+	}
+	return nil
+}
+
+func (self RateLimitConfig) ValidateValues() error {
+	for _, limit := range []*RateLimit{self.PerUser, self.PerRemoteAddr, self.PerSession} {
+		if limit != nil {
+			if err := limit.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	for pattern, limit := range self.PerMethod {
+		if err := limit.validate(); err != nil {
+			return errors.Wrapf(err, "method %s", pattern)
+		}
+	}
+	return nil
+}
+
+// RateLimitBucket is a token bucket a request takes a token from
+type RateLimitBucket struct {
+	Key   string
+	Limit RateLimit
+}
+
+// RateLimitStore keeps the token buckets, a store may be shared by
+// multiple servers, e.g. backed by redis.
+type RateLimitStore interface {
+	// Take a token from each of the buckets if all of them have
+	// tokens left, otherwise nothing is taken and false is
+	// returned with the duration to wait, which is zero if a
+	// bucket is never refilled
+	Take(buckets []RateLimitBucket) (ok bool, retryAfter time.Duration, err error)
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// the limit last taken with, by which the bucket is swept
+	rate  float64
+	burst float64
+}
+
+// refill the tokens by the time passed since last taken
+func (self *tokenBucket) refill(now time.Time) {
+	self.tokens = math.Min(self.burst, self.tokens+now.Sub(self.last).Seconds()*self.rate)
+	self.last = now
+}
+
+// MemoryRateLimitStore keeps the token buckets in memory, buckets
+// refilled up are dropped periodically
+type MemoryRateLimitStore struct {
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// the interval to drop the full buckets
+const rateLimitSweepInterval = time.Minute
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (self *MemoryRateLimitStore) Take(buckets []RateLimitBucket) (bool, time.Duration, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(self.lastSweep) > rateLimitSweepInterval {
+		self.sweep(now)
+	}
+
+	// check all the buckets before taking any tokens
+	taking := make([]*tokenBucket, 0, len(buckets))
+	rejected, refilled := false, true
+	var retryAfter time.Duration
+	for _, b := range buckets {
+		burst := float64(b.Limit.Burst)
+		if burst < 1 {
+			burst = 1
+		}
+		bucket, ok := self.buckets[b.Key]
+		if !ok {
+			bucket = &tokenBucket{tokens: burst, last: now}
+			self.buckets[b.Key] = bucket
+		}
+		bucket.rate = b.Limit.Rate
+		bucket.burst = burst
+		bucket.refill(now)
+		if bucket.tokens >= 1 {
+			taking = append(taking, bucket)
+			continue
+		}
+		rejected = true
+		if b.Limit.Rate <= 0 {
+			refilled = false
+			continue
+		}
+		wait := time.Duration((1 - bucket.tokens) / b.Limit.Rate * float64(time.Second))
+		if wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if rejected && !refilled {
+		// there is no time to retry after
+		return false, 0, nil
+	} else if rejected {
+		return false, retryAfter, nil
+	}
+	for _, bucket := range taking {
+		bucket.tokens--
+	}
+	return true, 0, nil
+}
+
+// drop the buckets which have been idle long enough to be full by
+// their own limits
+func (self *MemoryRateLimitStore) sweep(now time.Time) {
+	self.lastSweep = now
+	for key, bucket := range self.buckets {
+		if now.Sub(bucket.last) > rateLimitSweepInterval &&
+			bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate >= bucket.burst {
+			delete(self.buckets, key)
+		}
+	}
+}
+
+// RateLimitMiddleware rejects the requests exceeding the rate limits
+// with jlib.ErrRateLimited, whose data carries retry_after in
+// seconds, notifies exceeding the limits are dropped. The in-memory
+// store is used if store is nil. It panics if the rates of cfg are
+// not positive.
+func RateLimitMiddleware(cfg RateLimitConfig, store RateLimitStore) Middleware {
+	if err := cfg.ValidateValues(); err != nil {
+		log.Panicf("bad rate limit config %s", err)
+	}
+	if store == nil {
+		store = NewMemoryRateLimitStore()
+	}
+	return func(next Handler) Handler {
+		return func(req *RPCRequest) (jlib.Message, error) {
+			buckets := cfg.buckets(req)
+			if len(buckets) == 0 {
+				return next(req)
+			}
+			ok, retryAfter, err := store.Take(buckets)
+			if err != nil {
+				// let the request go if the store fails
+				req.Log().Warnf("rate limit store error %s", err)
+				return next(req)
+			}
+			if !ok {
+				req.Log().Warnf("rate limited")
+				if !req.Msg().IsRequest() {
+					return nil, nil
+				}
+				if retryAfter <= 0 {
+					return nil, jlib.ErrRateLimited
+				}
+				return nil, jlib.ErrRateLimited.WithData(map[string]interface{}{
+					"retry_after": math.Ceil(retryAfter.Seconds()*1000) / 1000,
+				})
+			}
+			return next(req)
+		}
+	}
+}
+
+// the buckets a request has to pass
+func (self RateLimitConfig) buckets(req *RPCRequest) []RateLimitBucket {
+	var buckets []RateLimitBucket
+	if self.PerSession != nil && req.Session() != nil {
+		buckets = append(buckets, RateLimitBucket{"session:" + req.Session().SessionID(), *self.PerSession})
+	}
+	if self.PerRemoteAddr != nil && req.r != nil {
+		host, _, err := net.SplitHostPort(req.r.RemoteAddr)
+		if err != nil {
+			host = req.r.RemoteAddr
+		}
+		buckets = append(buckets, RateLimitBucket{"addr:" + host, *self.PerRemoteAddr})
+	}
+	if self.PerUser != nil {
+		if authInfo, ok := AuthInfoFromContext(req.Context()); ok {
+			buckets = append(buckets, RateLimitBucket{"user:" + authInfo.Username, *self.PerUser})
+		}
+	}
+	method := req.Msg().MustMethod()
+	for pattern, limit := range self.PerMethod {
+		if ok, _ := path.Match(pattern, method); ok {
+			buckets = append(buckets, RateLimitBucket{"method:" + pattern, limit})
+		}
+	}
+	return buckets
+}
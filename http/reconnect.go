@@ -0,0 +1,193 @@
+package jlibhttp
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/superisaac/jlib"
+	"github.com/superisaac/jlib/trace"
+)
+
+// ErrConnectionLost is returned by the calls pending when the
+// connection of a streaming client drops
+var ErrConnectionLost = errors.New("connection lost")
+
+// ReconnectConfig enables a streaming client to reconnect when the
+// connection drops, the delay between attempts grows exponentially
+// from InitialDelay to MaxDelay with a random jitter.
+type ReconnectConfig struct {
+	// the delay of the first attempt, default is 500ms
+	InitialDelay time.Duration
+
+	// the max delay between attempts, default is 30s
+	MaxDelay time.Duration
+
+	// the fraction of delay randomized, default is 0.2, i.e. a delay
+	// of 1s varies in [0.8s, 1.2s]
+	Jitter float64
+
+	// give up after MaxRetries failed attempts, retry forever if
+	// zero
+	MaxRetries int
+}
+
+// the delay before the nth attempt, which starts from 0
+func (self ReconnectConfig) backoff(attempt int) time.Duration {
+	delay := self.InitialDelay
+	if delay <= 0 {
+		delay = 500 * time.Millisecond
+	}
+	maxDelay := self.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = 30 * time.Second
+	}
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	jitter := self.Jitter
+	if jitter <= 0 {
+		jitter = 0.2
+	}
+	delta := (rand.Float64()*2 - 1) * jitter * float64(delay)
+	return delay + time.Duration(delta)
+}
+
+// subscriptions are the calls replayed after reconnecting, in the
+// order of subscribing
+type subscriptions struct {
+	lock sync.Mutex
+	msgs []*jlib.RequestMessage
+}
+
+func (self *subscriptions) add(reqmsg *jlib.RequestMessage) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.msgs = append(self.msgs, reqmsg)
+}
+
+func (self *subscriptions) remove(id interface{}) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for i, reqmsg := range self.msgs {
+		if idKey(reqmsg.Id) == idKey(id) {
+			self.msgs = append(self.msgs[:i], self.msgs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (self *subscriptions) list() []*jlib.RequestMessage {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]*jlib.RequestMessage{}, self.msgs...)
+}
+
+// SetReconnect enables reconnecting when the connection drops, nil
+// disables it. Wait() returns only when the client is closed or it
+// gives up reconnecting.
+func (self *StreamingClient) SetReconnect(cfg *ReconnectConfig) {
+	self.reconnectConfig = cfg
+}
+
+// OnReconnected handler is called after the connection is
+// re-established and the subscriptions are replayed
+func (self *StreamingClient) OnReconnected(handler ConnectedHandler) error {
+	if self.reconnectedHandler != nil {
+		return errors.New("reconnected handler already exist!")
+	}
+	self.reconnectedHandler = handler
+	return nil
+}
+
+// Subscribe calls a request and registers it if the result is not
+// an error, the request is called again after each reconnecting so
+// that the subscription is restored on server.
+func (self *StreamingClient) Subscribe(rootCtx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error) {
+	resmsg, err := self.Call(rootCtx, reqmsg)
+	if err != nil {
+		return nil, err
+	}
+	if !resmsg.IsError() {
+		self.subscriptions.add(reqmsg)
+	}
+	return resmsg, nil
+}
+
+// Unsubscribe removes the subscription of the request id, the
+// subscription on server is not cancelled.
+func (self *StreamingClient) Unsubscribe(id interface{}) bool {
+	return self.subscriptions.remove(id)
+}
+
+// fail the calls pending for results
+func (self *StreamingClient) failPending(err error) {
+	self.pendingRequests.Range(func(k, v interface{}) bool {
+		if _, loaded := self.pendingRequests.LoadAndDelete(k); loaded {
+			if pending, ok := v.(*pendingRequest); ok {
+				self.expiry.remove(pending)
+				pending.err = err
+				close(pending.resultChannel)
+			}
+		}
+		return true
+	})
+}
+
+// reconnect until succeeded, ctx is cancelled when the client is
+// closed, and the connection is made with rootCtx
+func (self *StreamingClient) reconnectLoop(ctx context.Context, rootCtx context.Context, cfg ReconnectConfig) {
+	for attempt := 0; ; attempt++ {
+		delay := cfg.backoff(attempt)
+		self.Log().Infof("reconnect in %s, attempt %d", delay, attempt+1)
+		select {
+		case <-ctx.Done():
+			self.Reset(nil)
+			return
+		case <-time.After(delay):
+		}
+
+		err := self.Connect(rootCtx)
+		if err == nil && ctx.Err() != nil {
+			// closed while connecting
+			self.Close()
+			return
+		} else if err == nil {
+			self.replay(rootCtx)
+			if self.reconnectedHandler != nil {
+				self.reconnectedHandler()
+			}
+			return
+		}
+		self.Log().Warnf("reconnect failed %s", err)
+		if cfg.MaxRetries > 0 && attempt+1 >= cfg.MaxRetries {
+			self.Reset(errors.Wrap(err, "reconnect"))
+			return
+		}
+	}
+}
+
+// call the subscriptions again, the timeout and the trace context
+// of the original calls are stale, they are stripped from the copies
+// of subscriptions and set again by the call if needed
+func (self *StreamingClient) replay(ctx context.Context) {
+	for _, sub := range self.subscriptions.list() {
+		reqmsg := sub.Clone(sub.Id)
+		md := reqmsg.Metadata()
+		delete(md, TimeoutMetaKey)
+		delete(md, jlibtrace.TraceparentKey)
+		delete(md, jlibtrace.TracestateKey)
+		resmsg, err := self.Call(ctx, reqmsg)
+		if err != nil {
+			self.Log().Warnf("replay subscription %s error %s", reqmsg.Method, err)
+		} else if resmsg.IsError() {
+			self.Log().Warnf("replay subscription %s error %s", reqmsg.Method, resmsg.MustError())
+		}
+	}
+}
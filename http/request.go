@@ -6,17 +6,29 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/superisaac/jlib"
 	"github.com/superisaac/jlib/schema"
+	"github.com/superisaac/jlib/trace"
 	"net/http"
+	"sync"
+	"time"
 )
 
 const (
 	TransportHTTP      = "http"
 	TransportWebsocket = "websocket"
 	TransportHTTP2     = "http2"
+	TransportTCP       = "tcp"
+	TransportUnix      = "unix"
+	TransportStdio     = "stdio"
+	TransportSSE       = "sse"
 )
 
+// RPCSession is a streaming session through which the server can
+// push messages to the client or call the client and wait for the
+// result. When SpawnGoroutine is false, Call must not be used in the
+// handlers, because the results are not read until they return.
 type RPCSession interface {
 	Send(msg jlib.Message)
+	Call(ctx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error)
 	SessionID() string
 }
 
@@ -39,6 +51,29 @@ func NewRPCRequest(ctx context.Context, msg jlib.Message, transportType string,
 	}
 }
 
+// WithMsg derives a request of the same transport for another
+// message, e.g. an element of a batch or a rewritten message
+func (self RPCRequest) WithMsg(msg jlib.Message) *RPCRequest {
+	req := self
+	req.msg = msg
+	return &req
+}
+
+// WithContext derives a request with another context
+func (self RPCRequest) WithContext(ctx context.Context) *RPCRequest {
+	req := self
+	req.context = ctx
+	return &req
+}
+
+// WithData derives a request carrying arbitrary data, which can be
+// got by Data() in the handlers down the chain
+func (self RPCRequest) WithData(data interface{}) *RPCRequest {
+	req := self
+	req.data = data
+	return &req
+}
+
 func (self RPCRequest) Context() context.Context {
 	return self.context
 }
@@ -51,6 +86,9 @@ func (self RPCRequest) Session() RPCSession {
 	return self.session
 }
 
+// HttpRequest returns the http request which carries the message, it
+// panics if there is none, i.e. the requests served by the actor of a
+// streaming client, which can be checked by HasHttpRequest()
 func (self RPCRequest) HttpRequest() *http.Request {
 	if self.r == nil {
 		panic("Http Request is nil")
@@ -58,6 +96,10 @@ func (self RPCRequest) HttpRequest() *http.Request {
 	return self.r
 }
 
+func (self RPCRequest) HasHttpRequest() bool {
+	return self.r != nil
+}
+
 func (self RPCRequest) Data() interface{} {
 	return self.data
 }
@@ -81,14 +123,82 @@ type MsgCallback func(params []interface{}) (interface{}, error)
 type MissingCallback func(req *RPCRequest) (interface{}, error)
 type CloseCallback func(r *http.Request, session RPCSession)
 
+// Handler handles a request or notify fed to an actor, it returns
+// the response message or nil for notifies
+type Handler func(req *RPCRequest) (jlib.Message, error)
+
+// Middleware wraps a handler, it may inspect or modify the request
+// before calling next, short-circuit by returning without calling
+// next, and post-process the response returned by next. An RPCError
+// or an error known by the ErrorRegistry returned for a request is
+// replied as an error message.
+type Middleware func(next Handler) Handler
+
 // With method handler
 type MethodHandler struct {
-	callback RequestCallback
-	schema   jlibschema.Schema
+	callback   RequestCallback
+	schema     jlibschema.Schema
+	paramNames []string
+	timeout    time.Duration
+}
+
+// ParamNames returns the names of positional params, which are used
+// to map named params onto positions, the names are either declared
+// via WithParamNames or taken from the method schema.
+func (self MethodHandler) ParamNames() []string {
+	if len(self.paramNames) > 0 {
+		return self.paramNames
+	}
+	if methodSchema, ok := self.schema.(*jlibschema.MethodSchema); ok {
+		names := make([]string, len(methodSchema.Params))
+		for i, p := range methodSchema.Params {
+			if p.GetName() == "" {
+				// all params must be named
+				return nil
+			}
+			names[i] = p.GetName()
+		}
+		return names
+	}
+	return nil
+}
+
+// convert named params to positional params by names, trailing
+// absent names are dropped so that optional params remain optional
+func namedToList(named map[string]interface{}, names []string) []interface{} {
+	last := -1
+	for i, name := range names {
+		if _, ok := named[name]; ok {
+			last = i
+		}
+	}
+	params := make([]interface{}, last+1)
+	for i := 0; i <= last; i++ {
+		params[i] = named[names[i]]
+	}
+	return params
 }
 
 type HandlerSetter func(h *MethodHandler)
 
+// WithParamNames declares the names of params, so that a request
+// with named params, i.e. params is an object, can be handled as
+// positional params
+func WithParamNames(names ...string) HandlerSetter {
+	return func(h *MethodHandler) {
+		h.paramNames = names
+	}
+}
+
+// WithTimeout limits the time the handler runs, jlib.ErrTimeout is
+// replied when it exceeds and the context of the handler is cancelled.
+// The remaining budget of the caller is honored as well.
+func WithTimeout(timeout time.Duration) HandlerSetter {
+	return func(h *MethodHandler) {
+		h.timeout = timeout
+	}
+}
+
 func WithSchema(s jlibschema.Schema) HandlerSetter {
 	return func(h *MethodHandler) {
 		h.schema = s
@@ -116,10 +226,30 @@ func WithSchemaJson(jsonSchema string) HandlerSetter {
 type Actor struct {
 	ValidateSchema   bool
 	RecoverFromPanic bool
-	methodHandlers   map[string]*MethodHandler
-	missingHandler   MissingCallback
-	closeHandler     CloseCallback
-	children         []*Actor
+
+	// options to decode the incoming messages
+	DecodeOptions jlib.DecodeOptions
+
+	// the max number of batch elements dispatched concurrently,
+	// elements are fed one by one if it's less than 2
+	BatchConcurrency int
+
+	// the registry to convert errors returned by handlers into
+	// RPCErrors, jlib.DefaultErrorRegistry is used if nil
+	ErrorRegistry *jlib.ErrorRegistry
+
+	// the tracer to create a span around each request or notify
+	// fed, the span is carried by the context of the request
+	Tracer jlibtrace.Tracer
+
+	// in-band authentication of streaming sessions, disabled if nil
+	SessionAuth *SessionAuthConfig
+
+	methodHandlers map[string]*MethodHandler
+	missingHandler MissingCallback
+	closeHandler   CloseCallback
+	children       []*Actor
+	middlewares    []Middleware
 }
 
 func NewActor() *Actor {
@@ -136,6 +266,14 @@ func (self *Actor) AddChild(child *Actor) {
 	self.children = append(self.children, child)
 }
 
+// Use appends a middleware to the chain around the handlers, the
+// middleware used first is the outermost one. Middlewares of a child
+// actor are applied after the ones of its parent. Use is not safe to
+// call while the actor is serving.
+func (self *Actor) Use(middleware Middleware) {
+	self.middlewares = append(self.middlewares, middleware)
+}
+
 // register a method handler
 func (self *Actor) On(method string, callback MsgCallback, setters ...HandlerSetter) {
 
@@ -228,6 +366,14 @@ func (self *Actor) OnClose(handler CloseCallback) error {
 	return nil
 }
 
+// start a streaming session, the auth info of the upgrade request is
+// bound to the session if in-band authentication is enabled
+func (self *Actor) startSession(r *http.Request, session authSession) {
+	if self.SessionAuth != nil {
+		self.SessionAuth.bindUpgrade(r, session)
+	}
+}
+
 // call the close handler if possible
 func (self *Actor) HandleClose(r *http.Request, session RPCSession) {
 	// each child have to be called
@@ -291,6 +437,83 @@ func (self *Actor) getHandler(method string) (*MethodHandler, bool) {
 // give the actor a request message
 func (self *Actor) Feed(req *RPCRequest) (jlib.Message, error) {
 	msg := req.Msg()
+	if !msg.IsRequestOrNotify() {
+		return self.feed(req)
+	}
+	if self.Tracer == nil {
+		return self.handle(req)
+	}
+	ctx, span := jlibtrace.StartServerSpan(req.Context(), self.Tracer, msg)
+	resmsg, err := self.handle(req.WithContext(ctx))
+	jlibtrace.EndSpan(span, resmsg, err)
+	return resmsg, err
+}
+
+// handle a request or notify through the middleware chain
+func (self *Actor) handle(req *RPCRequest) (jlib.Message, error) {
+	next := Handler(self.feed)
+	login := false
+	if self.SessionAuth != nil {
+		if session, ok := req.Session().(authSession); ok {
+			if req.Msg().MustMethod() == SessionAuthMethod {
+				// logins pass the middlewares as well, i.e. the
+				// rate limiter, but not the ACL
+				login = true
+				next = func(req *RPCRequest) (jlib.Message, error) {
+					return self.SessionAuth.login(req, session), nil
+				}
+			} else {
+				var resmsg jlib.Message
+				var handled bool
+				req, resmsg, handled = self.SessionAuth.handle(req, session)
+				if handled {
+					return resmsg, nil
+				}
+			}
+		}
+	}
+	if acl, ok := ACLFromContext(req.Context()); ok && !login {
+		authInfo, _ := AuthInfoFromContext(req.Context())
+		if err := acl.Authorize(authInfo, req.Msg().MustMethod()); err != nil {
+			req.Log().Warnf("unauthorized call %s", err)
+			if !req.Msg().IsRequest() {
+				// notifies are dropped
+				return nil, nil
+			}
+			return self.wrapResult(nil, err, req.Msg())
+		}
+	}
+	if timeout, ok := callerTimeout(req.Msg()); ok {
+		// the deadline of the caller
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	if len(self.middlewares) == 0 {
+		return next(req)
+	}
+	h := next
+	for i := len(self.middlewares) - 1; i >= 0; i-- {
+		h = self.middlewares[i](h)
+	}
+	resmsg, err := h(req)
+	if err != nil && req.Msg().IsRequest() {
+		// the errors returned by middlewares
+		if rpcErr, ok := self.errorRegistry().ToRPCError(err); ok {
+			reqmsg, _ := req.Msg().(*jlib.RequestMessage)
+			if reqmsg != nil {
+				return rpcErr.ToMessage(reqmsg), nil
+			}
+		}
+	}
+	return resmsg, err
+}
+
+func (self *Actor) feed(req *RPCRequest) (jlib.Message, error) {
+	msg := req.Msg()
+	if msg.IsBatch() {
+		return self.feedBatch(req)
+	}
 	if !msg.IsRequestOrNotify() {
 		if self.missingHandler != nil {
 			res, err := self.missingHandler(req)
@@ -304,6 +527,13 @@ func (self *Actor) Feed(req *RPCRequest) (jlib.Message, error) {
 	// TODO: recover from panic
 	if handler, found := self.getHandler(msg.MustMethod()); found {
 		params := msg.MustParams()
+		mappedByName := false
+		if named := msg.NamedParams(); named != nil {
+			if names := handler.ParamNames(); len(names) > 0 {
+				params = namedToList(named, names)
+				mappedByName = true
+			}
+		}
 		if handler.schema != nil && self.ValidateSchema {
 			// validate the request
 			validator := jlibschema.NewSchemaValidator()
@@ -311,6 +541,10 @@ func (self *Actor) Feed(req *RPCRequest) (jlib.Message, error) {
 			if err != nil {
 				return nil, err
 			}
+			if mappedByName {
+				// validate the params mapped by names
+				m["params"] = params
+			}
 			errPos := validator.Validate(handler.schema, m)
 			if errPos != nil {
 				if reqmsg, ok := msg.(*jlib.RequestMessage); ok {
@@ -319,7 +553,9 @@ func (self *Actor) Feed(req *RPCRequest) (jlib.Message, error) {
 				return nil, errPos
 			}
 		}
-		return self.recoverCallHandler(handler, req, params)
+		return callWithDeadline(req, handler.timeout, func(req *RPCRequest) (jlib.Message, error) {
+			return self.recoverCallHandler(handler, req, params)
+		})
 	} else {
 		for _, child := range self.children {
 			if child.Has(msg.MustMethod()) {
@@ -327,7 +563,7 @@ func (self *Actor) Feed(req *RPCRequest) (jlib.Message, error) {
 			}
 		}
 		if self.missingHandler != nil {
-			return self.recoverCallMissingHandler(req)
+			return callWithDeadline(req, 0, self.recoverCallMissingHandler)
 		} else {
 			if msg.IsRequest() {
 				return jlib.ErrMethodNotFound.ToMessageFromId(
@@ -338,6 +574,69 @@ func (self *Actor) Feed(req *RPCRequest) (jlib.Message, error) {
 	return nil, nil
 }
 
+// feed the elements of a batch and collect the results in order,
+// notifies have no results, nil is returned if the batch has no
+// results at all.
+func (self *Actor) feedBatch(req *RPCRequest) (jlib.Message, error) {
+	batch, ok := req.Msg().(*jlib.BatchMessage)
+	if !ok {
+		return nil, errors.New("convert to batch message failed")
+	}
+
+	results := make([]jlib.Message, len(batch.Messages))
+	feedElem := func(i int, elem jlib.Message) {
+		if elem.IsError() {
+			// error elements are produced when decoding invalid
+			// batch elements, send them back as they are
+			results[i] = elem
+			return
+		}
+		resmsg, err := self.Feed(req.WithMsg(elem))
+		if err != nil {
+			elem.Log().Warnf("feed batch element error %s", err)
+			if elem.IsRequest() {
+				resmsg = jlib.ErrInternalError.ToMessageFromId(
+					elem.MustId(), elem.TraceId())
+			}
+		}
+		results[i] = resmsg
+	}
+
+	if self.BatchConcurrency > 1 {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, self.BatchConcurrency)
+		for i, elem := range batch.Messages {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, elem jlib.Message) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				feedElem(i, elem)
+			}(i, elem)
+		}
+		wg.Wait()
+	} else {
+		for i, elem := range batch.Messages {
+			feedElem(i, elem)
+		}
+	}
+
+	resmsgs := make([]jlib.Message, 0, len(results))
+	for _, resmsg := range results {
+		if resmsg != nil {
+			resmsgs = append(resmsgs, resmsg)
+		}
+	}
+	if len(resmsgs) == 0 {
+		return nil, nil
+	}
+	resbatch := jlib.NewBatchMessage(resmsgs)
+	resbatch.SetTraceId(batch.TraceId())
+	return resbatch, nil
+}
+
 func (self Actor) recoverCallHandler(handler *MethodHandler, req *RPCRequest, params []interface{}) (resmsg0 jlib.Message, err0 error) {
 	if self.RecoverFromPanic {
 		defer func() {
@@ -371,6 +670,13 @@ func (self Actor) recoverCallMissingHandler(req *RPCRequest) (resmsg0 jlib.Messa
 	return self.wrapResult(res, err, req.Msg())
 }
 
+func (self Actor) errorRegistry() *jlib.ErrorRegistry {
+	if self.ErrorRegistry != nil {
+		return self.ErrorRegistry
+	}
+	return jlib.DefaultErrorRegistry
+}
+
 func (self Actor) wrapResult(res interface{}, err error, msg jlib.Message) (jlib.Message, error) {
 	if !msg.IsRequest() {
 		if err != nil {
@@ -386,9 +692,8 @@ func (self Actor) wrapResult(res interface{}, err error, msg jlib.Message) (jlib
 	}
 
 	if err != nil {
-		var rpcErr *jlib.RPCError
 		var wrapErr *WrappedResponse
-		if errors.As(err, &rpcErr) {
+		if rpcErr, ok := self.errorRegistry().ToRPCError(err); ok {
 			return rpcErr.ToMessage(reqmsg), nil
 		} else if errors.As(err, &wrapErr) {
 			return nil, wrapErr
@@ -2,15 +2,22 @@ package jlibhttp
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"net/http"
+	"os"
 )
 
 type TLSConfig struct {
 	Certfile string
 	Keyfile  string
+
+	// the CA certificates to verify the client certificates, which
+	// are optional to clients, see MTLSAuthenticator
+	ClientCAfile string
 }
 
 func (self *TLSConfig) ValidateValues() error {
@@ -49,6 +56,20 @@ func ListenAndServe(rootCtx context.Context, bind string, handler http.Handler,
 	}()
 
 	if tlsConfig != nil {
+		if tlsConfig.ClientCAfile != "" {
+			caCert, err := os.ReadFile(tlsConfig.ClientCAfile)
+			if err != nil {
+				return errors.Wrap(err, "read client ca file")
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caCert) {
+				return errors.New("no client ca certificates")
+			}
+			server.TLSConfig = &tls.Config{
+				ClientCAs:  pool,
+				ClientAuth: tls.VerifyClientCertIfGiven,
+			}
+		}
 		return server.ServeTLS(
 			listener,
 			tlsConfig.Certfile,
@@ -0,0 +1,244 @@
+package jlibhttp
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/superisaac/jlib"
+)
+
+const (
+	// the method a streaming session calls to authenticate in band
+	SessionAuthMethod = "rpc.authenticate"
+
+	// the notify sent to a session whose authentication expires
+	SessionAuthExpiredMethod = "rpc.authExpired"
+)
+
+// SessionAuthConfig enables in-band authentication of streaming
+// sessions, i.e. websocket and http/2 sessions. A session calls
+// rpc.authenticate with the credentials, e.g. {"token": "..."},
+// {"username": "...", "password": "..."}, {"apikey": "..."} or
+// {"headers": {...}}, which are checked by the Authenticator as if
+// they were headers of the upgrade request. The AuthInfo is bound to
+// the session, and the session can re-authenticate at any time.
+// The calls of rpc.authenticate pass the middlewares of actor, e.g.
+// the rate limiter, but not the ACL.
+//
+// The AuthInfo authenticated at upgrade time by AuthHandler is bound
+// as well, so that its expiry is checked.
+type SessionAuthConfig struct {
+	Authenticator Authenticator
+
+	// the ACL to authorize the methods called by sessions
+	ACL *ACLConfig
+
+	// unauthenticated sessions can only call rpc.authenticate
+	Required bool
+
+	// close the session when its authentication expires, otherwise
+	// the session is downgraded to anonymous
+	CloseOnExpire bool
+}
+
+type sessionCredentials struct {
+	Token    string            `json:"token"`
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+	ApiKey   string            `json:"apikey"`
+	Headers  map[string]string `json:"headers"`
+}
+
+// the auth state bound to a streaming session
+type sessionAuth struct {
+	lock     sync.Mutex
+	authInfo *AuthInfo
+	timer    *time.Timer
+	// increased on each binding, so that a stale timer is ignored
+	generation int
+}
+
+// authSession is a streaming session which supports in-band auth
+type authSession interface {
+	RPCSession
+	sessionAuth() *sessionAuth
+	Close()
+}
+
+// bind the auth info, onExpire is called when the auth info expires
+func (self *sessionAuth) bind(authInfo *AuthInfo, onExpire func()) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stopTimer()
+	self.generation++
+	self.authInfo = authInfo
+	if authInfo != nil && !authInfo.ExpiresAt.IsZero() {
+		gen := self.generation
+		self.timer = time.AfterFunc(time.Until(authInfo.ExpiresAt), func() {
+			self.lock.Lock()
+			stale := gen != self.generation
+			self.lock.Unlock()
+			if !stale {
+				onExpire()
+			}
+		})
+	}
+}
+
+func (self *sessionAuth) unbind() {
+	self.bind(nil, nil)
+}
+
+func (self *sessionAuth) stopTimer() {
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
+}
+
+// current returns the auth info bound, false if it has just expired
+// and is unbound
+func (self *sessionAuth) current() (*AuthInfo, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.authInfo != nil && self.authInfo.Expired() {
+		self.stopTimer()
+		self.generation++
+		self.authInfo = nil
+		return nil, false
+	}
+	return self.authInfo, true
+}
+
+// bind the auth info authenticated at upgrade time
+func (self *SessionAuthConfig) bindUpgrade(r *http.Request, session authSession) {
+	if authInfo, ok := AuthInfoFromContext(r.Context()); ok {
+		session.sessionAuth().bind(authInfo, func() {
+			self.expire(session)
+		})
+	}
+}
+
+func (self *SessionAuthConfig) expire(session authSession) {
+	session.Send(jlib.NewNotifyMessage(SessionAuthExpiredMethod, nil))
+	if self.CloseOnExpire {
+		session.Close()
+	} else {
+		session.sessionAuth().unbind()
+	}
+}
+
+// handle returns the request carrying the auth info of the session,
+// or a response if the request is handled here, the logins are
+// handled by login()
+func (self *SessionAuthConfig) handle(req *RPCRequest, session authSession) (*RPCRequest, jlib.Message, bool) {
+	msg := req.Msg()
+	authInfo, ok := session.sessionAuth().current()
+	if !ok {
+		// expired before the timer fires
+		self.expire(session)
+	}
+	if authInfo == nil && (self.Required || (!ok && self.CloseOnExpire)) {
+		if msg.IsRequest() {
+			return req, jlib.ErrAuthFailed.WithData("session is not authenticated").ToMessageFromId(msg.MustId(), msg.TraceId()), true
+		}
+		return req, nil, true
+	}
+
+	// the auth info of the session overrides the one of upgrade
+	ctx := withAuthInfo(req.Context(), authInfo)
+	if self.ACL != nil {
+		ctx = context.WithValue(ctx, aclContextKey{}, self.ACL)
+	}
+	return req.WithContext(ctx), nil, false
+}
+
+func (self *SessionAuthConfig) login(req *RPCRequest, session authSession) jlib.Message {
+	msg := req.Msg()
+	reply := func(res interface{}, err error) jlib.Message {
+		if !msg.IsRequest() {
+			return nil
+		}
+		reqmsg, _ := msg.(*jlib.RequestMessage)
+		if err != nil {
+			var rpcErr *jlib.RPCError
+			if !errors.As(err, &rpcErr) {
+				rpcErr = jlib.ErrAuthFailed.WithData(err.Error())
+			}
+			return rpcErr.ToMessage(reqmsg)
+		}
+		return jlib.NewResultMessage(reqmsg, res)
+	}
+
+	if self.Authenticator == nil {
+		return reply(nil, errors.New("no authenticator"))
+	}
+	r, err := credentialsRequest(req)
+	if err != nil {
+		return reply(nil, err)
+	}
+	authInfo, ok := self.Authenticator.Authenticate(r)
+	if !ok || authInfo == nil || authInfo.Expired() {
+		req.Log().Warnf("session auth failed")
+		return reply(nil, jlib.ErrAuthFailed)
+	}
+	session.sessionAuth().bind(authInfo, func() {
+		self.expire(session)
+	})
+
+	res := map[string]interface{}{"username": authInfo.Username}
+	if !authInfo.ExpiresAt.IsZero() {
+		res["expires_at"] = authInfo.ExpiresAt.Unix()
+	}
+	return reply(res, nil)
+}
+
+// build a http request carrying the credentials as headers, derived
+// from the upgrade request so that tls states are kept
+func credentialsRequest(req *RPCRequest) (*http.Request, error) {
+	var creds sessionCredentials
+	params := req.Msg().MustParams()
+	if len(params) == 1 {
+		if token, ok := params[0].(string); ok {
+			creds.Token = token
+		}
+	}
+	if creds.Token == "" {
+		if req.Msg().NamedParams() == nil {
+			return nil, jlib.ParamsError("credentials must be an object or a token")
+		}
+		if err := req.Msg().DecodeParamsInto(&creds); err != nil {
+			return nil, jlib.ParamsError(err.Error())
+		}
+	}
+
+	var r *http.Request
+	if req.r != nil {
+		r = req.r.Clone(req.Context())
+	} else {
+		var err error
+		r, err = http.NewRequestWithContext(req.Context(), "POST", "/", nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.Body = http.NoBody
+	r.ContentLength = 0
+	r.Header = make(http.Header)
+	for k, v := range creds.Headers {
+		r.Header.Set(k, v)
+	}
+	if creds.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+creds.Token)
+	}
+	if creds.Username != "" {
+		r.SetBasicAuth(creds.Username, creds.Password)
+	}
+	if creds.ApiKey != "" {
+		r.Header.Set("X-Api-Key", creds.ApiKey)
+	}
+	return r, nil
+}
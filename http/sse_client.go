@@ -0,0 +1,347 @@
+package jlibhttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/superisaac/jlib"
+)
+
+// SSEClient is the streaming client over server-sent events, the
+// server url is like sse://127.0.0.1:8000/ or sses:// over TLS. The
+// event stream is resumed by the Last-Event-ID on reconnecting if the
+// session is still alive on server, otherwise a new session is
+// opened.
+type SSEClient struct {
+	StreamingClient
+}
+
+type sseTransport struct {
+	client     *SSEClient
+	httpClient *http.Client
+
+	// the states shared by the read and write loops
+	lock sync.Mutex
+	// the http url of the sse handler
+	endpoint    string
+	header      http.Header
+	cancel      context.CancelFunc
+	body        io.ReadCloser
+	reader      *bufio.Reader
+	connCtx     context.Context
+	sessionId   string
+	lastEventId string
+}
+
+func NewSSEClient(serverUrl *url.URL, optlist ...ClientOptions) *SSEClient {
+	if serverUrl.Scheme != "sse" && serverUrl.Scheme != "sses" {
+		log.Panicf("server url %s is not sse", serverUrl)
+	}
+	c := &SSEClient{}
+	transport := &sseTransport{
+		client: c,
+	}
+	c.InitStreaming(serverUrl, transport, optlist...)
+	return c
+}
+
+func (self *SSEClient) String() string {
+	return fmt.Sprintf("sse client %s", self.serverUrl)
+}
+
+// SessionID returns the id of the sse session, which is empty if not
+// connected yet
+func (self *SSEClient) SessionID() string {
+	if transport, ok := self.transport.(*sseTransport); ok {
+		transport.lock.Lock()
+		defer transport.lock.Unlock()
+		return transport.sessionId
+	}
+	return ""
+}
+
+// sse transport methods
+func (self *sseTransport) transportType() string {
+	return TransportSSE
+}
+
+func (self *sseTransport) Close() {
+	clientClosed := self.client.isClosed()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.cancel != nil {
+		self.cancel()
+		self.cancel = nil
+	}
+	if self.body != nil {
+		self.body.Close()
+		self.body = nil
+		self.reader = nil
+	}
+	self.connCtx = nil
+	if self.sessionId != "" && clientClosed {
+		// the client is closed deliberately, so that the session is
+		// no more resumed
+		go self.deleteSession(self.endpoint, self.sessionId)
+		self.sessionId = ""
+		self.lastEventId = ""
+	}
+}
+
+func (self *sseTransport) Connected() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.body != nil
+}
+
+func (self *sseTransport) Connect(rootCtx context.Context, serverUrl *url.URL, header http.Header) error {
+	if self.httpClient == nil {
+		self.httpClient = self.newHttpClient()
+	}
+	endpoint := *serverUrl
+	if serverUrl.Scheme == "sses" {
+		endpoint.Scheme = "https"
+	} else {
+		endpoint.Scheme = "http"
+	}
+	self.lock.Lock()
+	self.endpoint = endpoint.String()
+	self.header = header
+	self.lock.Unlock()
+
+	connCtx, cancel := context.WithCancel(rootCtx)
+	resp, err := self.openStream(connCtx)
+	if err == nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone) {
+		// the session expired or lost events on server, open a new
+		// one
+		resp.Body.Close()
+		self.lock.Lock()
+		self.client.Log().Infof("sse session %s not resumed, status %d", self.sessionId, resp.StatusCode)
+		self.sessionId = ""
+		self.lastEventId = ""
+		self.lock.Unlock()
+		resp, err = self.openStream(connCtx)
+	}
+	if err != nil {
+		cancel()
+		var opErr *net.OpError
+		if errors.As(err, &opErr) {
+			self.client.Log().Infof("sse operror %s", opErr)
+			return TransportConnectFailed
+		}
+		return errors.Wrap(err, "ssetransport.connect")
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		cancel()
+		return errors.Errorf("sse connect status %d", resp.StatusCode)
+	}
+	self.lock.Lock()
+	if sessionId := resp.Header.Get(SSESessionHeader); sessionId != "" {
+		self.sessionId = sessionId
+	}
+	self.connCtx = connCtx
+	self.cancel = cancel
+	self.body = resp.Body
+	self.reader = bufio.NewReader(resp.Body)
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *sseTransport) newHttpClient() *http.Client {
+	opts := self.client.ClientOptions()
+	dialer := &net.Dialer{
+		Timeout:   opts.connectTimeout(),
+		KeepAlive: 30 * time.Second,
+	}
+	tr := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: opts.connectTimeout(),
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     30 * time.Second,
+		ReadBufferSize:      opts.ReadBufferSize,
+		WriteBufferSize:     opts.WriteBufferSize,
+	}
+	if tlsConfig := self.client.ClientTLSConfig(); tlsConfig != nil {
+		tr.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Transport: tr}
+}
+
+// open the event stream, the session is resumed if there is one
+func (self *sseTransport) openStream(ctx context.Context) (*http.Response, error) {
+	req, err := self.newRequest(ctx, "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	self.lock.Lock()
+	if self.sessionId != "" && self.lastEventId != "" {
+		req.Header.Set("Last-Event-ID", self.lastEventId)
+	}
+	self.lock.Unlock()
+	return self.httpClient.Do(req)
+}
+
+// new a request to the endpoint with the extra header and the
+// session id
+func (self *sseTransport) newRequest(ctx context.Context, method string, body io.Reader) (*http.Request, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	req, err := http.NewRequestWithContext(ctx, method, self.endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	for hn, hvs := range self.header {
+		for _, hv := range hvs {
+			req.Header.Add(hn, hv)
+		}
+	}
+	if self.sessionId != "" {
+		req.Header.Set(SSESessionHeader, self.sessionId)
+	}
+	return req, nil
+}
+
+func (self *sseTransport) deleteSession(endpoint string, sessionId string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "DELETE", endpoint, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set(SSESessionHeader, sessionId)
+	resp, err := self.httpClient.Do(req)
+	if err != nil {
+		self.client.Log().Debugf("delete sse session error %s", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+func (self *sseTransport) WriteMessage(msg jlib.Message) error {
+	marshaled, err := jlib.MessageBytes(msg)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	connCtx := self.connCtx
+	self.lock.Unlock()
+	if connCtx == nil {
+		return TransportClosed
+	}
+	req, err := self.newRequest(connCtx, "POST", bytes.NewReader(marshaled))
+	if err != nil {
+		return errors.Wrap(err, "ssetransport.write")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := self.httpClient.Do(req)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return TransportClosed
+		}
+		return errors.Wrap(err, "ssetransport.write")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		// the session is gone
+		return TransportClosed
+	} else if resp.StatusCode >= 300 {
+		return errors.Errorf("sse post status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (self *sseTransport) ReadMessage() (jlib.Message, bool, error) {
+	self.lock.Lock()
+	reader := self.reader
+	self.lock.Unlock()
+	if reader == nil {
+		return nil, false, TransportClosed
+	}
+	id, event, data, err := readSSEEvent(reader, self.client.ClientOptions().MaxMessageSize)
+	if err != nil {
+		if isClosedError(err) || errors.Is(err, context.Canceled) {
+			return nil, false, TransportClosed
+		}
+		return nil, false, errors.Wrap(err, "ssetransport.read")
+	}
+	switch event {
+	case "session":
+		self.lock.Lock()
+		self.sessionId = string(data)
+		self.lock.Unlock()
+		return nil, false, nil
+	case "", "message":
+	default:
+		self.client.Log().Debugf("unknown sse event %s", event)
+		return nil, false, nil
+	}
+	if id != "" {
+		self.lock.Lock()
+		self.lastEventId = id
+		self.lock.Unlock()
+	}
+	msg, err := jlib.ParseBytes(data)
+	if err != nil {
+		// the event is intact, skip to the next one
+		self.client.Log().Warnf("bad jsonrpc message %s", data)
+		return nil, false, nil
+	}
+	return msg, true, nil
+}
+
+// read an event until an empty line, the comments are skipped
+func readSSEEvent(reader *bufio.Reader, maxSize int64) (id string, event string, data []byte, err error) {
+	if maxSize <= 0 {
+		maxSize = defaultMaxFrameSize
+	}
+	hasData := false
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", "", nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if hasData || event != "" {
+				return id, event, data, nil
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// comments, i.e. the heartbeats
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch name {
+		case "id":
+			id = value
+		case "event":
+			event = value
+		case "data":
+			if hasData {
+				data = append(data, '\n')
+			}
+			data = append(data, value...)
+			hasData = true
+			if int64(len(data)) > maxSize {
+				return "", "", nil, ErrMessageTooLarge
+			}
+		}
+	}
+}
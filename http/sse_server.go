@@ -0,0 +1,550 @@
+package jlibhttp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/superisaac/jlib"
+)
+
+// SSESessionHeader carries the session id of the sse transport, the
+// session id can also be given by the query session= if
+// SSEHandler.SessionIdInQuery is enabled
+const SSESessionHeader = "X-Jsonrpc-Session"
+
+const (
+	defaultSSEReplaySize     = 100
+	defaultSSESessionTimeout = time.Minute
+	defaultSSEPingInterval   = 15 * time.Second
+)
+
+// SSEHandler serves jsonrpc over server-sent events. A session is
+// opened by GET of the event stream, whose first event named session
+// carries the session id. The messages to server are POSTed with the
+// session id and accepted with 202, the results and server pushes
+// are sent as events through the event stream. A dropped event stream
+// can be resumed with the session id and the Last-Event-ID header,
+// the events buffered since then are replayed. DELETE closes the
+// session. Only the principal opened the session, i.e. the same
+// AuthInfo.Username or anonymous, may resume, post to or delete it.
+type SSEHandler struct {
+	Actor     *Actor
+	serverCtx context.Context
+	// options
+	SpawnGoroutine bool
+	Session        SessionConfig
+
+	// the number of events buffered, the events delivered are kept
+	// for resuming and dropped beyond ReplaySize, writing more events
+	// not delivered yet blocks the session, so that the SendPolicy of
+	// Session applies. Default is 100
+	ReplaySize int
+
+	// a session without event stream is closed after SessionTimeout,
+	// default is 1 minute
+	SessionTimeout time.Duration
+
+	// the interval of heartbeats through event streams, default is
+	// 15s
+	PingInterval time.Duration
+
+	// the max size of a POSTed body, default is 16MB
+	MaxMessageSize int64
+
+	// accept the session id from the query session= besides the
+	// header, for the clients can't set headers, i.e. EventSource of
+	// browsers. The session id may leak into the logs of proxies
+	SessionIdInQuery bool
+
+	sessions    sessionRegistry
+	sseSessions sync.Map
+}
+
+type sseEvent struct {
+	id   uint64
+	data []byte
+}
+
+type SSESession struct {
+	server *SSEHandler
+	// the request opened the session
+	httpRequest *http.Request
+	rootCtx     context.Context
+	cancel      context.CancelFunc
+	stream      *streamSession
+	sessionId   string
+	authState   *sessionAuth
+	// the principal opened the session
+	owner string
+
+	lock sync.Mutex
+	// events buffered for resuming
+	events []sseEvent
+	lastId uint64
+	// the last event id written to an event stream
+	delivered uint64
+	// closed and renewed when an event is buffered
+	changed chan struct{}
+	// closed and renewed when more events are delivered
+	progress chan struct{}
+	// closed when the event stream attached is replaced
+	detached  chan struct{}
+	idleTimer *time.Timer
+}
+
+func NewSSEHandler(serverCtx context.Context, actor *Actor) *SSEHandler {
+	if actor == nil {
+		actor = NewActor()
+	}
+	return &SSEHandler{
+		serverCtx:      serverCtx,
+		Actor:          actor,
+		SpawnGoroutine: true,
+	}
+}
+
+func (self *SSEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sessionId := self.sessionId(r)
+	if r.Method == "GET" && sessionId == "" {
+		self.serveStream(w, r, self.newSession(r), 0, false)
+		return
+	}
+	session, ok := self.getSession(sessionId)
+	if ok && session.owner != ssePrincipal(r) {
+		Logger(r).Warnf("sse session %s not owned by the requester", sessionId)
+		jlib.ErrorResponse(w, r, errors.New("session not owned"), http.StatusForbidden, "Forbidden")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		if !ok {
+			jlib.ErrorResponse(w, r, errors.New("session not found"), http.StatusNotFound, "Session not found")
+			return
+		}
+		lastEventId, resume, err := sseLastEventId(r)
+		if err != nil {
+			jlib.ErrorResponse(w, r, err, 400, "Bad request")
+			return
+		}
+		if resume && !session.canResume(lastEventId) {
+			// the events after lastEventId are dropped, the
+			// session cannot go on without them
+			err := errors.Errorf("sse events after %d lost", lastEventId)
+			session.stream.close(err)
+			jlib.ErrorResponse(w, r, err, http.StatusGone, "Events lost")
+			return
+		}
+		self.serveStream(w, r, session, lastEventId, resume)
+	case "POST":
+		if !ok {
+			jlib.ErrorResponse(w, r, errors.New("session not found"), http.StatusNotFound, "Session not found")
+			return
+		}
+		session.post(w, r)
+	case "DELETE":
+		if ok {
+			session.Close()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		jlib.ErrorResponse(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// Stats sums up the stats of live sessions
+func (self *SSEHandler) Stats() SessionStats {
+	return self.sessions.stats()
+}
+
+// the session id from the header, or the query if enabled
+func (self *SSEHandler) sessionId(r *http.Request) string {
+	if sessionId := r.Header.Get(SSESessionHeader); sessionId != "" {
+		return sessionId
+	}
+	if self.SessionIdInQuery {
+		return r.URL.Query().Get("session")
+	}
+	return ""
+}
+
+// the principal of a request, which is the username prefixed so that
+// an authenticated empty username differs from anonymous
+func ssePrincipal(r *http.Request) string {
+	if authInfo, ok := AuthInfoFromContext(r.Context()); ok {
+		return "user:" + authInfo.Username
+	}
+	return "anonymous"
+}
+
+// the Last-Event-ID header set by the resuming clients, or the query
+// last_event_id for those can't set headers
+func sseLastEventId(r *http.Request) (uint64, bool, error) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("last_event_id")
+	}
+	if v == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "bad Last-Event-ID")
+	}
+	return id, true, nil
+}
+
+func (self *SSEHandler) getSession(sessionId string) (*SSESession, bool) {
+	if sessionId == "" {
+		return nil, false
+	}
+	if v, ok := self.sseSessions.Load(sessionId); ok {
+		return v.(*SSESession), true
+	}
+	return nil, false
+}
+
+func (self *SSEHandler) newSession(r *http.Request) *SSESession {
+	rootCtx, cancel := context.WithCancel(self.serverCtx)
+	session := &SSESession{
+		server:      self,
+		httpRequest: r,
+		rootCtx:     rootCtx,
+		cancel:      cancel,
+		stream:      newStreamSession(self.Session),
+		sessionId:   jlib.NewUuid(),
+		authState:   &sessionAuth{},
+		owner:       ssePrincipal(r),
+		changed:     make(chan struct{}),
+		progress:    make(chan struct{}),
+	}
+	self.sseSessions.Store(session.sessionId, session)
+	self.sessions.add(session.sessionId, session.stream)
+	self.Actor.startSession(r, session)
+	go session.run()
+	return session
+}
+
+func (self *SSEHandler) replaySize() int {
+	if self.ReplaySize > 0 {
+		return self.ReplaySize
+	}
+	return defaultSSEReplaySize
+}
+
+func (self *SSEHandler) sessionTimeout() time.Duration {
+	if self.SessionTimeout > 0 {
+		return self.SessionTimeout
+	}
+	return defaultSSESessionTimeout
+}
+
+func (self *SSEHandler) pingInterval() time.Duration {
+	if self.PingInterval > 0 {
+		return self.PingInterval
+	}
+	return defaultSSEPingInterval
+}
+
+// write the events to the event stream until the client goes away or
+// another event stream of the session is attached
+func (self *SSEHandler) serveStream(w http.ResponseWriter, r *http.Request, session *SSESession, lastEventId uint64, resume bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		jlib.ErrorResponse(w, r, errors.New("streaming unsupported"), 500, "Streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// disable the buffering of nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set(SSESessionHeader, session.sessionId)
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "event: session\ndata: %s\n\n", session.sessionId)
+	flusher.Flush()
+
+	detached, sent := session.attach()
+	defer session.detach(detached)
+	if resume {
+		sent = lastEventId
+	}
+
+	ticker := time.NewTicker(self.pingInterval())
+	defer ticker.Stop()
+	for {
+		events, changed := session.eventsAfter(sent)
+		for _, ev := range events {
+			if err := writeSSEEvent(w, ev); err != nil {
+				session.Log().Debugf("write event error %s", err)
+				return
+			}
+			sent = ev.id
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+			session.markDelivered(sent)
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-detached:
+			return
+		case <-r.Context().Done():
+			return
+		case <-session.stream.closed:
+			return
+		}
+	}
+}
+
+// write an event, the data of multiple lines is split into data
+// fields
+func writeSSEEvent(w io.Writer, ev sseEvent) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "id: %d\n", ev.id)
+	for _, line := range bytes.Split(ev.data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// sse session
+func (self *SSESession) run() {
+	defer func() {
+		self.lock.Lock()
+		if self.idleTimer != nil {
+			self.idleTimer.Stop()
+		}
+		self.lock.Unlock()
+		self.server.sseSessions.Delete(self.sessionId)
+		self.server.sessions.remove(self.sessionId)
+		self.authState.unbind()
+		self.server.Actor.HandleClose(self.httpRequest, self)
+		self.cancel()
+	}()
+	go self.stream.sendLoop(self.rootCtx, self.write)
+
+	select {
+	case <-self.rootCtx.Done():
+	case <-self.stream.closed:
+		if err := self.stream.err(); err != nil {
+			log.Warnf("sse session error %s", err)
+		}
+	}
+	self.stream.close(nil)
+}
+
+// attach an event stream, the one attached before is detached, the
+// id of the last event delivered is returned
+func (self *SSESession) attach() (chan struct{}, uint64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.detached != nil {
+		close(self.detached)
+	}
+	if self.idleTimer != nil {
+		self.idleTimer.Stop()
+		self.idleTimer = nil
+	}
+	self.detached = make(chan struct{})
+	return self.detached, self.delivered
+}
+
+// detach the event stream, the session is closed if no event stream
+// is attached again in SessionTimeout
+func (self *SSESession) detach(detached chan struct{}) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.detached != detached {
+		// replaced by another event stream
+		return
+	}
+	self.detached = nil
+	self.idleTimer = time.AfterFunc(self.server.sessionTimeout(), func() {
+		self.stream.close(errors.New("session idle timeout"))
+	})
+}
+
+// whether the events after the id are all buffered
+func (self *SSESession) canResume(id uint64) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	firstId := self.lastId + 1 - uint64(len(self.events))
+	return id+1 >= firstId
+}
+
+// the events buffered after the id, and the channel closed when more
+// events are buffered
+func (self *SSESession) eventsAfter(id uint64) ([]sseEvent, chan struct{}) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var events []sseEvent
+	for _, ev := range self.events {
+		if ev.id > id {
+			events = append(events, ev)
+		}
+	}
+	return events, self.changed
+}
+
+func (self *SSESession) markDelivered(id uint64) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if id > self.delivered {
+		self.delivered = id
+		close(self.progress)
+		self.progress = make(chan struct{})
+	}
+}
+
+// buffer a message as an event, the write blocks while ReplaySize
+// events are not delivered yet, and fails if WriteTimeout exceeds.
+// The oldest delivered events beyond ReplaySize are dropped.
+func (self *SSESession) write(msg jlib.Message) error {
+	marshaled, err := jlib.MessageBytes(msg)
+	if err != nil {
+		return errors.Wrap(err, "marshal msg")
+	}
+	replaySize := self.server.replaySize()
+	var timeout <-chan time.Time
+	if deadline := self.stream.writeDeadline(); !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for self.lastId-self.delivered >= uint64(replaySize) {
+		progress := self.progress
+		self.lock.Unlock()
+		select {
+		case <-progress:
+		case <-timeout:
+			self.lock.Lock()
+			return errors.New("sse write timeout")
+		case <-self.stream.closed:
+			self.lock.Lock()
+			return errors.New("session closed")
+		}
+		self.lock.Lock()
+	}
+	self.lastId++
+	self.events = append(self.events, sseEvent{id: self.lastId, data: marshaled})
+	n := 0
+	for n < len(self.events)-replaySize && self.events[n].id <= self.delivered {
+		n++
+	}
+	if n > 0 {
+		self.events = append([]sseEvent{}, self.events[n:]...)
+	}
+	close(self.changed)
+	self.changed = make(chan struct{})
+	return nil
+}
+
+// handle a POSTed message, which is accepted before handled
+func (self *SSESession) post(w http.ResponseWriter, r *http.Request) {
+	maxSize := self.server.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxFrameSize
+	}
+	var buffer bytes.Buffer
+	if _, err := buffer.ReadFrom(http.MaxBytesReader(w, r.Body, maxSize)); err != nil {
+		jlib.ErrorResponse(w, r, err, 400, "Bad request")
+		return
+	}
+	msg, err := jlib.ParseBytesWithOptions(buffer.Bytes(), self.server.Actor.DecodeOptions)
+	if err != nil {
+		Logger(r).Warnf("bad jsonrpc message %s", err)
+		self.Send(jlib.NewDecodeErrorMessage(err))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if !msg.IsBatch() {
+		headerToMetadata(r.Header, msg)
+	}
+	// the values of POST request, i.e. the auth info, within the
+	// lifetime of session
+	ctx := sessionContext{Context: self.rootCtx, values: r.Context()}
+	self.stream.dispatch(msg, self.server.SpawnGoroutine, func(msg jlib.Message) {
+		self.msgReceived(ctx, msg, r)
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (self *SSESession) msgReceived(ctx context.Context, msg jlib.Message, r *http.Request) {
+	req := NewRPCRequest(ctx, msg, TransportSSE, r)
+	req.session = self
+
+	resmsg, err := self.server.Actor.Feed(req)
+	if err != nil {
+		self.stream.close(errors.Wrap(err, "actor.Feed"))
+		return
+	}
+	if resmsg != nil {
+		self.Send(resmsg)
+	}
+}
+
+// Send queues a message to the peer, what happens when the queue is
+// full depends on the SendPolicy
+func (self *SSESession) Send(msg jlib.Message) {
+	self.stream.enqueue(msg)
+}
+
+// Call calls a request to the peer and waits for the result
+func (self *SSESession) Call(ctx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error) {
+	return self.stream.call(ctx, reqmsg)
+}
+
+// Stats returns the stats of the session
+func (self *SSESession) Stats() SessionStats {
+	return self.stream.stats()
+}
+
+func (self *SSESession) SessionID() string {
+	return self.sessionId
+}
+
+func (self *SSESession) Log() *log.Entry {
+	return log.WithFields(log.Fields{
+		"session": self.sessionId,
+	})
+}
+
+func (self *SSESession) sessionAuth() *sessionAuth {
+	return self.authState
+}
+
+// Close the session
+func (self *SSESession) Close() {
+	self.stream.close(errors.New("session closed"))
+}
+
+// sessionContext takes the values of a request context and the
+// lifetime of a session
+type sessionContext struct {
+	context.Context
+	values context.Context
+}
+
+func (self sessionContext) Value(key interface{}) interface{} {
+	return self.values.Value(key)
+}
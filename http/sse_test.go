@@ -0,0 +1,410 @@
+package jlibhttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/superisaac/jlib"
+)
+
+func TestSSEServerClient(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewSSEHandler(rootCtx, nil)
+	server.Actor.On("echo", func(params []interface{}) (interface{}, error) {
+		if len(params) > 0 {
+			return params[0], nil
+		} else {
+			return nil, jlib.ParamsError("no argument given")
+		}
+	})
+	server.Actor.OnRequest("push", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		req.Session().Send(jlib.NewNotifyMessage("pushed", params))
+		return "ok", nil
+	})
+	server.Actor.OnRequest("ask", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		resmsg, err := req.Session().Call(req.Context(), jlib.NewRequestMessage(1, "whoami", nil))
+		if err != nil {
+			return nil, err
+		}
+		return resmsg.MustResult(), nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28900", server)
+	time.Sleep(10 * time.Millisecond)
+
+	c, err := NewClient("sse://127.0.0.1:28900")
+	assert.Nil(err)
+	client, ok := c.(*SSEClient)
+	assert.True(ok)
+
+	resmsg, err := client.Call(rootCtx, jlib.NewRequestMessage(1, "echo", []interface{}{"hello sse"}))
+	assert.Nil(err)
+	assert.Equal("hello sse", resmsg.MustResult())
+	assert.NotEqual("", client.SessionID())
+
+	// server pushes a notify through the event stream
+	pushed := make(chan jlib.Message, 1)
+	client.OnMessage(func(msg jlib.Message) {
+		pushed <- msg
+	})
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(2, "push", []interface{}{"news"}))
+	assert.Nil(err)
+	assert.Equal("ok", resmsg.MustResult())
+	select {
+	case msg := <-pushed:
+		assert.Equal("pushed", msg.MustMethod())
+	case <-time.After(time.Second):
+		assert.Fail("no message pushed")
+	}
+
+	// server calls the client, whose result is POSTed
+	actor := NewActor()
+	actor.On("whoami", func(params []interface{}) (interface{}, error) {
+		return "sse client", nil
+	})
+	client.SetActor(actor)
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(3, "ask", nil))
+	assert.Nil(err)
+	assert.Equal("sse client", resmsg.MustResult())
+
+	assert.Equal(1, server.Stats().Sessions)
+
+	// closing the client deletes the session
+	client.Close()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(0, server.Stats().Sessions)
+}
+
+func TestSSEResume(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewSSEHandler(rootCtx, nil)
+	server.SessionTimeout = 200 * time.Millisecond
+	server.Actor.On("echo", func(params []interface{}) (interface{}, error) {
+		return params, nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28901", server)
+	time.Sleep(10 * time.Millisecond)
+
+	endpoint := "http://127.0.0.1:28901"
+	httpTransport := &http.Transport{}
+	defer httpTransport.CloseIdleConnections()
+	httpClient := &http.Client{Transport: httpTransport}
+	openStream := func(sessionId string, lastEventId string) (*http.Response, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(rootCtx)
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+		assert.Nil(err)
+		req.Header.Set("Accept", "text/event-stream")
+		if sessionId != "" {
+			req.Header.Set(SSESessionHeader, sessionId)
+		}
+		if lastEventId != "" {
+			req.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatalf("open stream error %s", err)
+		}
+		return resp, cancel
+	}
+	post := func(sessionId string, body string) int {
+		req, err := http.NewRequest("POST", endpoint, bytes.NewBufferString(body))
+		assert.Nil(err)
+		req.Header.Set(SSESessionHeader, sessionId)
+		resp, err := httpClient.Do(req)
+		if !assert.Nil(err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	resp, cancelStream := openStream("", "")
+	assert.Equal(200, resp.StatusCode)
+	assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+	reader := bufio.NewReader(resp.Body)
+	_, event, data, err := readSSEEvent(reader, 0)
+	assert.Nil(err)
+	assert.Equal("session", event)
+	sessionId := string(data)
+	assert.Equal(sessionId, resp.Header.Get(SSESessionHeader))
+
+	assert.Equal(202, post(sessionId, `{"jsonrpc": "2.0", "id": 1, "method": "echo", "params": ["a"]}`))
+	id, _, data, err := readSSEEvent(reader, 0)
+	assert.Nil(err)
+	assert.Equal("1", id)
+	msg, err := jlib.ParseBytes(data)
+	assert.Nil(err)
+	assert.Equal([]interface{}{"a"}, msg.MustResult())
+
+	// the result is buffered while the event stream is dropped
+	cancelStream()
+	resp.Body.Close()
+	assert.Equal(202, post(sessionId, `{"jsonrpc": "2.0", "id": 2, "method": "echo", "params": ["b"]}`))
+	time.Sleep(20 * time.Millisecond)
+
+	// resume from the last event id
+	resp, cancelStream = openStream(sessionId, "1")
+	defer cancelStream()
+	assert.Equal(200, resp.StatusCode)
+	reader = bufio.NewReader(resp.Body)
+	_, event, _, err = readSSEEvent(reader, 0)
+	assert.Nil(err)
+	assert.Equal("session", event)
+	id, _, data, err = readSSEEvent(reader, 0)
+	assert.Nil(err)
+	assert.Equal("2", id)
+	msg, err = jlib.ParseBytes(data)
+	assert.Nil(err)
+	assert.Equal([]interface{}{"b"}, msg.MustResult())
+	cancelStream()
+	resp.Body.Close()
+
+	// unknown sessions
+	assert.Equal(404, post("no-such-session", `{"jsonrpc": "2.0", "id": 3, "method": "echo", "params": []}`))
+	resp, cancelUnknown := openStream("no-such-session", "")
+	defer cancelUnknown()
+	assert.Equal(404, resp.StatusCode)
+
+	// the session without event stream expires
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(0, server.Stats().Sessions)
+	assert.Equal(404, post(sessionId, `{"jsonrpc": "2.0", "id": 4, "method": "echo", "params": []}`))
+}
+
+func TestSSEClientResume(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewSSEHandler(rootCtx, nil)
+	server.Actor.On("echo", func(params []interface{}) (interface{}, error) {
+		return params, nil
+	})
+	sessions := make(chan *SSESession, 1)
+	server.Actor.OnRequest("session", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		sessions <- req.Session().(*SSESession)
+		return req.Session().SessionID(), nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28902", server)
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewSSEClient(urlParse("sse://127.0.0.1:28902"))
+	client.SetReconnect(&ReconnectConfig{InitialDelay: 10 * time.Millisecond})
+	reconnected := make(chan bool, 1)
+	client.OnReconnected(func() {
+		reconnected <- true
+	})
+	resmsg, err := client.Call(rootCtx, jlib.NewRequestMessage(1, "session", nil))
+	assert.Nil(err)
+	sessionId := client.SessionID()
+	assert.Equal(sessionId, resmsg.MustResult())
+
+	// attaching another event stream detaches the one of client,
+	// which reconnects to the same session
+	httpTransport := &http.Transport{}
+	defer httpTransport.CloseIdleConnections()
+	httpClient := &http.Client{Transport: httpTransport}
+	req, _ := http.NewRequest("GET", "http://127.0.0.1:28902/", nil)
+	req.Header.Set(SSESessionHeader, sessionId)
+	resp, err := httpClient.Do(req)
+	if assert.Nil(err) {
+		resp.Body.Close()
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		assert.Fail("not reconnected")
+	}
+	assert.Equal(sessionId, client.SessionID())
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(2, "echo", []interface{}{"again"}))
+	assert.Nil(err)
+	assert.Equal([]interface{}{"again"}, resmsg.MustResult())
+
+	// a new session is opened if the session is gone
+	(<-sessions).Close()
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		assert.Fail("not reconnected")
+	}
+	assert.NotEqual(sessionId, client.SessionID())
+	client.Close()
+}
+
+func TestSSEBackpressure(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewSSEHandler(rootCtx, nil)
+	server.ReplaySize = 2
+	server.Session = SessionConfig{SendQueueSize: 1, SendPolicy: SendDisconnect}
+	server.Actor.On("echo", func(params []interface{}) (interface{}, error) {
+		return params, nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28903", server)
+	time.Sleep(10 * time.Millisecond)
+
+	endpoint := "http://127.0.0.1:28903"
+	httpTransport := &http.Transport{}
+	defer httpTransport.CloseIdleConnections()
+	httpClient := &http.Client{Transport: httpTransport}
+	openStream := func(sessionId string, lastEventId string) (*http.Response, *bufio.Reader, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(rootCtx)
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+		assert.Nil(err)
+		if sessionId != "" {
+			req.Header.Set(SSESessionHeader, sessionId)
+			req.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatalf("open stream error %s", err)
+		}
+		return resp, bufio.NewReader(resp.Body), cancel
+	}
+	post := func(sessionId string, id int) int {
+		body := fmt.Sprintf(`{"jsonrpc": "2.0", "id": %d, "method": "echo", "params": [%d]}`, id, id)
+		req, err := http.NewRequest("POST", endpoint, bytes.NewBufferString(body))
+		assert.Nil(err)
+		req.Header.Set(SSESessionHeader, sessionId)
+		resp, err := httpClient.Do(req)
+		if !assert.Nil(err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the delivered events are dropped beyond ReplaySize, resuming
+	// from the events dropped fails and closes the session
+	resp, reader, cancelStream := openStream("", "")
+	_, _, data, err := readSSEEvent(reader, 0)
+	assert.Nil(err)
+	sessionId := string(data)
+	for i := 1; i <= 3; i++ {
+		assert.Equal(202, post(sessionId, i))
+		id, _, _, err := readSSEEvent(reader, 0)
+		assert.Nil(err)
+		assert.Equal(fmt.Sprintf("%d", i), id)
+	}
+	cancelStream()
+	resp.Body.Close()
+	resp, _, cancelStream = openStream(sessionId, "0")
+	assert.Equal(http.StatusGone, resp.StatusCode)
+	resp.Body.Close()
+	cancelStream()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(0, server.Stats().Sessions)
+
+	// the events not delivered are never dropped, the session is
+	// disconnected by the SendPolicy when the send queue is full
+	resp, reader, cancelStream = openStream("", "")
+	_, _, data, err = readSSEEvent(reader, 0)
+	assert.Nil(err)
+	sessionId = string(data)
+	cancelStream()
+	resp.Body.Close()
+	// 2 events buffered, 1 blocked in writing and 1 queued
+	for i := 1; i <= 5; i++ {
+		post(sessionId, i)
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(0, server.Stats().Sessions)
+	assert.Equal(404, post(sessionId, 6))
+
+	// the listener is closed asynchronously, wait for it so that the
+	// port is free for the reruns of test
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestSSESessionOwner(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	authcfg := &AuthConfig{
+		Basic: []BasicAuthConfig{
+			{Username: "monkey", Password: "banana"},
+			{Username: "donkey", Password: "grass"},
+		},
+	}
+	server := NewSSEHandler(rootCtx, nil)
+	server.Actor.On("echo", func(params []interface{}) (interface{}, error) {
+		return params, nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28904", NewAuthHandler(authcfg, server))
+	time.Sleep(10 * time.Millisecond)
+
+	endpoint := "http://127.0.0.1:28904/"
+	httpTransport := &http.Transport{}
+	defer httpTransport.CloseIdleConnections()
+	httpClient := &http.Client{Transport: httpTransport}
+	do := func(method, url, username, password, sessionId string) *http.Response {
+		var body *bytes.Buffer
+		if method == "POST" {
+			body = bytes.NewBufferString(`{"jsonrpc": "2.0", "id": 1, "method": "echo", "params": []}`)
+		} else {
+			body = &bytes.Buffer{}
+		}
+		ctx, cancelReq := context.WithTimeout(rootCtx, 100*time.Millisecond)
+		t.Cleanup(cancelReq)
+		req, err := http.NewRequestWithContext(ctx, method, url, body)
+		assert.Nil(err)
+		req.SetBasicAuth(username, password)
+		if sessionId != "" {
+			req.Header.Set(SSESessionHeader, sessionId)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatalf("request error %s", err)
+		}
+		return resp
+	}
+
+	resp := do("GET", endpoint, "monkey", "banana", "")
+	assert.Equal(200, resp.StatusCode)
+	sessionId := resp.Header.Get(SSESessionHeader)
+	resp.Body.Close()
+
+	// other principals cannot resume, post to or delete the session
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		resp = do(method, endpoint, "donkey", "grass", sessionId)
+		assert.Equal(403, resp.StatusCode, method)
+		resp.Body.Close()
+	}
+	resp = do("POST", endpoint, "monkey", "banana", sessionId)
+	assert.Equal(202, resp.StatusCode)
+	resp.Body.Close()
+
+	// the session id in query is ignored unless enabled
+	resp = do("GET", endpoint+"?session="+sessionId, "monkey", "banana", "")
+	assert.NotEqual(sessionId, resp.Header.Get(SSESessionHeader))
+	resp.Body.Close()
+	server.SessionIdInQuery = true
+	resp = do("GET", endpoint+"?session="+sessionId, "monkey", "banana", "")
+	assert.Equal(sessionId, resp.Header.Get(SSESessionHeader))
+	resp.Body.Close()
+
+	// the listener is closed asynchronously, wait for it so that the
+	// port is free for the reruns of test
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+}
@@ -0,0 +1,190 @@
+package jlibhttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/superisaac/jlib"
+)
+
+// the time to wait for the subprocess to exit after its stdin is
+// closed, it's killed then
+const stdioExitTimeout = 3 * time.Second
+
+// StdioClient is the streaming client which spawns a subprocess and
+// talks to it through stdin and stdout, i.e. a language server or a
+// plugin. A new subprocess is spawned on each connecting, so that
+// the client can reconnect after the subprocess exits.
+type StdioClient struct {
+	StreamingClient
+}
+
+type stdioTransport struct {
+	client *StdioClient
+	// the template of commands
+	command *exec.Cmd
+
+	// the states shared by the read and write loops
+	lock    sync.Mutex
+	framing Framing
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	reader  *frameReader
+}
+
+// NewStdioClient returns a client which runs the command, the Path,
+// Args, Env, Dir and Stderr of command are taken, the messages are
+// framed by Content-Length header by default.
+func NewStdioClient(command *exec.Cmd, optlist ...ClientOptions) *StdioClient {
+	c := &StdioClient{}
+	transport := &stdioTransport{
+		client:  c,
+		command: command,
+		framing: FramingHeader,
+	}
+	serverUrl := &url.URL{Scheme: TransportStdio, Path: command.Path}
+	c.InitStreaming(serverUrl, transport, optlist...)
+	// the subprocess outlives the contexts of calls, respawning it is
+	// costly
+	c.connectCtx = context.Background()
+	return c
+}
+
+// SetFraming changes the framing of messages, which takes effect on
+// next connecting
+func (self *StdioClient) SetFraming(framing Framing) error {
+	if err := framing.validate(); err != nil {
+		return err
+	}
+	if transport, ok := self.transport.(*stdioTransport); ok {
+		transport.lock.Lock()
+		transport.framing = framing
+		transport.lock.Unlock()
+	}
+	return nil
+}
+
+func (self *StdioClient) String() string {
+	return fmt.Sprintf("stdio client %s", self.serverUrl.Path)
+}
+
+// stdio transport methods
+func (self *stdioTransport) transportType() string {
+	return TransportStdio
+}
+
+func (self *stdioTransport) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.cmd == nil {
+		return
+	}
+	cmd := self.cmd
+	self.stdin.Close()
+	self.cmd = nil
+	self.stdin = nil
+	self.reader = nil
+
+	// the subprocess is expected to exit on stdin EOF
+	go func() {
+		exited := make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+		select {
+		case err := <-exited:
+			if err != nil {
+				self.client.Log().Debugf("subprocess exit %s", err)
+			}
+		case <-time.After(stdioExitTimeout):
+			self.client.Log().Warnf("subprocess not exit in %s, kill it", stdioExitTimeout)
+			cmd.Process.Kill()
+			<-exited
+		}
+	}()
+}
+
+func (self *stdioTransport) Connected() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.cmd != nil
+}
+
+// the subprocess runs until the transport is closed, the header is
+// not used
+func (self *stdioTransport) Connect(rootCtx context.Context, serverUrl *url.URL, header http.Header) error {
+	cmd := exec.Command(self.command.Path)
+	cmd.Args = self.command.Args
+	cmd.Env = self.command.Env
+	cmd.Dir = self.command.Dir
+	cmd.Stderr = self.command.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return errors.Wrap(err, "cmd.StdinPipe()")
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrap(err, "cmd.StdoutPipe()")
+	}
+	if err := cmd.Start(); err != nil {
+		self.client.Log().Infof("start subprocess error %s", err)
+		return TransportConnectFailed
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.cmd = cmd
+	self.stdin = stdin
+	self.reader = newFrameReader(stdout, self.framing, self.client.ClientOptions().MaxMessageSize)
+	return nil
+}
+
+func (self *stdioTransport) WriteMessage(msg jlib.Message) error {
+	marshaled, err := jlib.MessageBytes(msg)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	stdin, framing := self.stdin, self.framing
+	self.lock.Unlock()
+	if stdin == nil {
+		return TransportClosed
+	}
+	if err := writeFrame(stdin, framing, marshaled); err != nil {
+		if isClosedError(err) {
+			return TransportClosed
+		}
+		return errors.Wrap(err, "stdiotransport.write")
+	}
+	return nil
+}
+
+func (self *stdioTransport) ReadMessage() (jlib.Message, bool, error) {
+	self.lock.Lock()
+	reader := self.reader
+	self.lock.Unlock()
+	if reader == nil {
+		return nil, false, TransportClosed
+	}
+	data, err := reader.ReadFrame()
+	if err != nil {
+		if isClosedError(err) {
+			return nil, false, TransportClosed
+		}
+		return nil, false, errors.Wrap(err, "stdiotransport.read")
+	}
+	msg, err := jlib.ParseBytes(data)
+	if err != nil {
+		// the frame is intact, skip to the next one
+		self.client.Log().Warnf("bad jsonrpc message %s", data)
+		return nil, false, nil
+	}
+	return msg, true, nil
+}
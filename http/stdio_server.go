@@ -0,0 +1,68 @@
+package jlibhttp
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stdioConn joins a reader and a writer into a byte stream
+type stdioConn struct {
+	reader io.Reader
+	writer io.Writer
+}
+
+func (self stdioConn) Read(p []byte) (int, error) {
+	return self.reader.Read(p)
+}
+
+func (self stdioConn) Write(p []byte) (int, error) {
+	return self.writer.Write(p)
+}
+
+func (self stdioConn) Close() error {
+	if closer, ok := self.reader.(io.Closer); ok {
+		closer.Close()
+	}
+	if closer, ok := self.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// NewStdioServer returns a server speaking the Content-Length header
+// framing like language servers, which is expected to serve stdio
+// by ServeStdio()
+func NewStdioServer(serverCtx context.Context, actor *Actor) *NetServer {
+	server := NewNetServer(serverCtx, actor)
+	server.Framing = FramingHeader
+	return server
+}
+
+// ServeStdio serves the session over stdin and stdout until stdin
+// reaches EOF or the server context is done, logs must not be written
+// to stdout.
+func (self *NetServer) ServeStdio() {
+	self.ServeIO(self.serverCtx, os.Stdin, os.Stdout)
+}
+
+// ServeIO serves the session reading from in and writing to out,
+// both are closed when the session ends if they are io.Closer
+func (self *NetServer) ServeIO(ctx context.Context, in io.Reader, out io.Writer) {
+	conn := stdioConn{reader: in, writer: out}
+	defer conn.Close()
+
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(connCtx, "CONNECT", TransportStdio+"://", nil)
+	if err != nil {
+		log.Warnf("new pseudo request error %s", err)
+		return
+	}
+	r.RemoteAddr = TransportStdio
+	self.serveSession(connCtx, conn, TransportStdio, r)
+}
@@ -0,0 +1,373 @@
+package jlibhttp
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/superisaac/jlib"
+)
+
+// SendPolicy decides what a streaming session does when its send
+// queue is full
+type SendPolicy string
+
+const (
+	// block the sender until the queue has room or the session ends
+	SendBlock SendPolicy = "block"
+	// drop the oldest message in the queue
+	SendDropOldest SendPolicy = "drop_oldest"
+	// disconnect the session
+	SendDisconnect SendPolicy = "disconnect"
+)
+
+var ErrSendQueueFull = errors.New("send queue full")
+
+const (
+	defaultMaxInFlight   = 100
+	defaultSendQueueSize = 100
+)
+
+// SessionConfig configures the backpressure of websocket and http/2
+// sessions
+type SessionConfig struct {
+	// max messages of a session handled concurrently, the session
+	// stops reading when reached, default is 100
+	MaxInFlight int `yaml:"max_inflight,omitempty" json:"max_inflight,omitempty"`
+
+	// the size of send queue, default is 100
+	SendQueueSize int `yaml:"send_queue_size,omitempty" json:"send_queue_size,omitempty"`
+
+	// what to do when the send queue is full, default is block
+	SendPolicy SendPolicy `yaml:"send_policy,omitempty" json:"send_policy,omitempty"`
+
+	// the deadline of writing a message to the peer, zero means no
+	// deadline
+	WriteTimeout time.Duration `yaml:"write_timeout,omitempty" json:"write_timeout,omitempty"`
+}
+
+func (self SessionConfig) ValidateValues() error {
+	switch self.SendPolicy {
+	case "", SendBlock, SendDropOldest, SendDisconnect:
+	default:
+		return errors.Errorf("bad send policy %s", self.SendPolicy)
+	}
+	if self.MaxInFlight < 0 || self.SendQueueSize < 0 || self.WriteTimeout < 0 {
+		return errors.New("negative session config values")
+	}
+	return nil
+}
+
+// SessionStats is a snapshot of the counters of sessions
+type SessionStats struct {
+	Sessions   int    `json:"sessions"`
+	InFlight   int64  `json:"inflight"`
+	QueueDepth int    `json:"queue_depth"`
+	Received   uint64 `json:"received"`
+	Sent       uint64 `json:"sent"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+func (self *SessionStats) add(other SessionStats) {
+	self.Sessions += other.Sessions
+	self.InFlight += other.InFlight
+	self.QueueDepth += other.QueueDepth
+	self.Received += other.Received
+	self.Sent += other.Sent
+	self.Dropped += other.Dropped
+}
+
+// streamSession is the core shared by websocket and http/2 sessions,
+// it bounds the messages handled concurrently, queues the messages
+// to send and tracks the requests called to the peer
+type streamSession struct {
+	config    SessionConfig
+	sendQueue chan jlib.Message
+	slots     chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+
+	// the handlers running, and the channels closed when the peer
+	// stops sending and when the handlers are all done
+	handlers  sync.WaitGroup
+	eof       chan struct{}
+	drainOnce sync.Once
+	drained   chan struct{}
+
+	inflight int64
+	received uint64
+	sent     uint64
+	dropped  uint64
+
+	// the requests called to the peer pending for results
+	pendingCalls sync.Map
+}
+
+// a request called to the peer
+type pendingCall struct {
+	resultChannel chan jlib.Message
+}
+
+func newStreamSession(config SessionConfig) *streamSession {
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = defaultMaxInFlight
+	}
+	if config.SendQueueSize <= 0 {
+		config.SendQueueSize = defaultSendQueueSize
+	}
+	if config.SendPolicy == "" {
+		config.SendPolicy = SendBlock
+	}
+	return &streamSession{
+		config:    config,
+		sendQueue: make(chan jlib.Message, config.SendQueueSize),
+		slots:     make(chan struct{}, config.MaxInFlight),
+		closed:    make(chan struct{}),
+		eof:       make(chan struct{}),
+		drained:   make(chan struct{}),
+	}
+}
+
+// close the session with the error, only the first error is kept
+func (self *streamSession) close(err error) {
+	self.closeOnce.Do(func() {
+		self.closeErr = err
+		close(self.closed)
+	})
+}
+
+func (self *streamSession) err() error {
+	<-self.closed
+	return self.closeErr
+}
+
+// drain ends the session after the peer stops sending, i.e. the input
+// reaches EOF, the session is closed once the running handlers are
+// done and the queued messages are written. The calls to the peer
+// fail at once as no results would come.
+func (self *streamSession) drain() {
+	self.drainOnce.Do(func() {
+		close(self.eof)
+		go func() {
+			self.handlers.Wait()
+			close(self.drained)
+		}()
+	})
+}
+
+// dispatch runs the handler of a received message, it blocks when
+// there are MaxInFlight handlers running, so that the peer is not
+// read until a slot is released. The results of calls to the peer
+// are delivered at once without a slot, as the handlers waiting for
+// them hold the slots.
+func (self *streamSession) dispatch(msg jlib.Message, spawn bool, handler func(msg jlib.Message)) {
+	atomic.AddUint64(&self.received, 1)
+	if self.deliver(msg) {
+		return
+	}
+	if !spawn {
+		atomic.AddInt64(&self.inflight, 1)
+		self.handlers.Add(1)
+		defer func() {
+			atomic.AddInt64(&self.inflight, -1)
+			self.handlers.Done()
+		}()
+		handler(msg)
+		return
+	}
+	select {
+	case self.slots <- struct{}{}:
+	case <-self.closed:
+		return
+	}
+	atomic.AddInt64(&self.inflight, 1)
+	self.handlers.Add(1)
+	go func() {
+		defer func() {
+			atomic.AddInt64(&self.inflight, -1)
+			self.handlers.Done()
+			<-self.slots
+		}()
+		handler(msg)
+	}()
+}
+
+// enqueue a message to send by the policy, messages sent after the
+// session ends are discarded
+func (self *streamSession) enqueue(msg jlib.Message) {
+	select {
+	case <-self.closed:
+		return
+	default:
+	}
+
+	switch self.config.SendPolicy {
+	case SendDropOldest:
+		for {
+			select {
+			case self.sendQueue <- msg:
+				return
+			default:
+			}
+			select {
+			case <-self.sendQueue:
+				atomic.AddUint64(&self.dropped, 1)
+			default:
+			}
+		}
+	case SendDisconnect:
+		select {
+		case self.sendQueue <- msg:
+		default:
+			atomic.AddUint64(&self.dropped, 1)
+			self.close(ErrSendQueueFull)
+		}
+	default:
+		select {
+		case self.sendQueue <- msg:
+		case <-self.closed:
+		}
+	}
+}
+
+// sendLoop writes the queued messages until the session ends, a
+// write exceeding WriteTimeout closes the session. The session is
+// closed after the queue is flushed if it's drained.
+func (self *streamSession) sendLoop(ctx context.Context, write func(msg jlib.Message) error) {
+	send := func(msg jlib.Message) bool {
+		if err := write(msg); err != nil {
+			self.close(err)
+			return false
+		}
+		atomic.AddUint64(&self.sent, 1)
+		return true
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-self.closed:
+			return
+		case msg := <-self.sendQueue:
+			if !send(msg) {
+				return
+			}
+		case <-self.drained:
+			for {
+				select {
+				case msg := <-self.sendQueue:
+					if !send(msg) {
+						return
+					}
+				default:
+					self.close(nil)
+					return
+				}
+			}
+		}
+	}
+}
+
+// call sends a request to the peer and waits for the result, the
+// request is sent with a new id if its id is already pending. The
+// result is replaced by jlib.ErrTimeout if the context deadline
+// exceeds, defaultRequestTimeout applies if the context has no
+// deadline.
+func (self *streamSession) call(ctx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRequestTimeout)
+		defer cancel()
+	}
+
+	pending := &pendingCall{resultChannel: make(chan jlib.Message, 1)}
+	sendmsg := reqmsg
+	if _, loaded := self.pendingCalls.LoadOrStore(idKey(reqmsg.Id), pending); loaded {
+		sendmsg = reqmsg.Clone(jlib.NewUuid())
+		self.pendingCalls.Store(idKey(sendmsg.Id), pending)
+	}
+	key := idKey(sendmsg.Id)
+	defer func() {
+		if v, ok := self.pendingCalls.Load(key); ok && v == pending {
+			self.pendingCalls.Delete(key)
+		}
+	}()
+
+	injectTimeout(ctx, sendmsg)
+	self.enqueue(sendmsg)
+	select {
+	case resmsg := <-pending.resultChannel:
+		if sendmsg != reqmsg {
+			resmsg = resmsg.ReplaceId(reqmsg.Id)
+		}
+		return resmsg, nil
+	case <-self.closed:
+		return nil, ErrConnectionLost
+	case <-self.eof:
+		return nil, ErrConnectionLost
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return jlib.ErrTimeout.ToMessage(reqmsg), nil
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// deliver a result or an error message to the call pending for it,
+// false is returned if there is no such call
+func (self *streamSession) deliver(msg jlib.Message) bool {
+	if !msg.IsResultOrError() {
+		return false
+	}
+	v, ok := self.pendingCalls.LoadAndDelete(idKey(msg.MustId()))
+	if !ok {
+		return false
+	}
+	v.(*pendingCall).resultChannel <- msg
+	return true
+}
+
+// the write deadline of now, zero time means no deadline
+func (self *streamSession) writeDeadline() time.Time {
+	if self.config.WriteTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(self.config.WriteTimeout)
+}
+
+func (self *streamSession) stats() SessionStats {
+	return SessionStats{
+		Sessions:   1,
+		InFlight:   atomic.LoadInt64(&self.inflight),
+		QueueDepth: len(self.sendQueue),
+		Received:   atomic.LoadUint64(&self.received),
+		Sent:       atomic.LoadUint64(&self.sent),
+		Dropped:    atomic.LoadUint64(&self.dropped),
+	}
+}
+
+// sessionRegistry keeps the live sessions of a handler for stats
+type sessionRegistry struct {
+	sessions sync.Map
+}
+
+func (self *sessionRegistry) add(id string, stream *streamSession) {
+	self.sessions.Store(id, stream)
+}
+
+func (self *sessionRegistry) remove(id string) {
+	self.sessions.Delete(id)
+}
+
+func (self *sessionRegistry) stats() SessionStats {
+	var total SessionStats
+	self.sessions.Range(func(k, v interface{}) bool {
+		total.add(v.(*streamSession).stats())
+		return true
+	})
+	return total
+}
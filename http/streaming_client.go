@@ -6,6 +6,7 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/superisaac/jlib"
+	"github.com/superisaac/jlib/trace"
 	"net/http"
 	"net/url"
 	"sync"
@@ -14,8 +15,13 @@ import (
 
 type pendingRequest struct {
 	reqmsg        *jlib.RequestMessage
+	sendId        interface{}
 	resultChannel chan jlib.Message
 	expire        time.Time
+	// the index in expiry heap
+	index int
+	// set before the result channel is closed
+	err error
 }
 
 // errors
@@ -36,6 +42,13 @@ type StreamingClient struct {
 	// the server url it connects to
 	serverUrl *url.URL
 
+	// the transport type of the requests served by the actor
+	transportType string
+
+	// the context to connect with instead of the ones of calls if
+	// set, so that the connection lives until the client is closed
+	connectCtx context.Context
+
 	// extra http header taken to transports
 	extraHeader http.Header
 
@@ -45,6 +58,11 @@ type StreamingClient struct {
 	// jsonrpc request message pending for result
 	pendingRequests sync.Map
 
+	// expires the pending requests
+	expiry *expiryQueue
+
+	clientOptions ClientOptions
+
 	// on messsage handler
 	messageHandler MessageHandler
 
@@ -54,9 +72,29 @@ type StreamingClient struct {
 	// on close handler
 	closeHandler CloseHandler
 
+	// on reconnected handler
+	reconnectedHandler ConnectedHandler
+
+	// reconnect when the connection drops, disabled if nil
+	reconnectConfig *ReconnectConfig
+
+	// the calls replayed after reconnecting
+	subscriptions subscriptions
+
+	// the context of connecting, reconnecting stops when it's done
+	rootCtx context.Context
+
+	// cancel the pending reconnecting
+	reconnectCancel func()
+
+	// states guarded by connectLock
+	reconnecting bool
+	closed       bool
+
 	// func accompanied by context, this func is called when
 	// client want to deliberatly close the connection
 	cancelFunc func()
+	connCtx    context.Context
 
 	// send channel to write messsage sequencially
 	sendChannel chan jlib.Message
@@ -64,6 +102,19 @@ type StreamingClient struct {
 	// channel to wait until connection closed
 	closeChannel chan error
 
+	// registry to convert error messages into golang errors
+	errorRegistry *jlib.ErrorRegistry
+
+	// tracer to create spans around calls
+	tracer jlibtrace.Tracer
+
+	// interceptors around calls
+	interceptors []Interceptor
+
+	// the actor serving the requests from server
+	actor     *Actor
+	sessionId string
+
 	// the underline transport adaptor in charge of read/write
 	// bytes
 	transport Transport
@@ -98,21 +149,32 @@ func (self *StreamingClient) ServerURL() *url.URL {
 	return self.serverUrl
 }
 
-func (self *StreamingClient) InitStreaming(serverUrl *url.URL, transport Transport) {
+func (self *StreamingClient) InitStreaming(serverUrl *url.URL, transport Transport, optlist ...ClientOptions) {
 	self.serverUrl = serverUrl
 	self.transport = transport
+	if typed, ok := transport.(interface{ transportType() string }); ok {
+		self.transportType = typed.transportType()
+	} else {
+		self.transportType = schemeTransport(serverUrl.Scheme)
+	}
+	if len(optlist) > 0 {
+		self.clientOptions = optlist[0]
+	}
+	self.expiry = newExpiryQueue(self.expire)
 	self.sendChannel = nil
 	self.closeChannel = nil
 }
 
 func (self *StreamingClient) CloseChannel() chan error {
+	self.connectLock.Lock()
+	defer self.connectLock.Unlock()
 	return self.closeChannel
 }
 
 // wait connection close and return error
 func (self *StreamingClient) Wait() error {
-	if self.closeChannel != nil {
-		err := <-self.closeChannel
+	if closeChannel := self.CloseChannel(); closeChannel != nil {
+		err := <-closeChannel
 		return err
 	} else {
 		// client not connected, just return
@@ -121,23 +183,50 @@ func (self *StreamingClient) Wait() error {
 }
 
 func (self *StreamingClient) Close() {
-	if self.Connected() {
+	self.connectLock.Lock()
+	self.closed = true
+	reconnecting := self.reconnecting
+	if self.reconnectCancel != nil {
+		self.reconnectCancel()
+		self.reconnectCancel = nil
+	}
+	self.connectLock.Unlock()
+
+	if self.Connected() || reconnecting {
 		self.Reset(nil)
 	}
 }
 
 func (self *StreamingClient) Reset(err error) {
-	if self.cancelFunc != nil {
-		self.cancelFunc()
-		self.cancelFunc = nil
+	self.drop()
+	self.connectLock.Lock()
+	closeChannel := self.closeChannel
+	self.closeChannel = nil
+	self.connectLock.Unlock()
+	if closeChannel != nil {
+		closeChannel <- err
 	}
+	self.failPending(ErrConnectionLost)
+}
 
-	if self.closeChannel != nil {
-		self.closeChannel <- err
-		self.closeChannel = nil
+// drop the connection, the close channel is kept
+func (self *StreamingClient) drop() {
+	self.connectLock.Lock()
+	cancel := self.cancelFunc
+	self.cancelFunc = nil
+	self.sendChannel = nil
+	self.connectLock.Unlock()
+	if cancel != nil {
+		cancel()
 	}
 	self.transport.Close()
-	self.sendChannel = nil
+}
+
+// returns true if the client is closed deliberately
+func (self *StreamingClient) isClosed() bool {
+	self.connectLock.Lock()
+	defer self.connectLock.Unlock()
+	return self.closed
 }
 
 func (self *StreamingClient) OnMessage(handler MessageHandler) error {
@@ -164,6 +253,14 @@ func (self *StreamingClient) OnClose(handler CloseHandler) error {
 	return nil
 }
 
+// the context to connect with for a call of ctx
+func (self *StreamingClient) connectContext(ctx context.Context) context.Context {
+	if self.connectCtx != nil {
+		return self.connectCtx
+	}
+	return connectContext(ctx)
+}
+
 func (self *StreamingClient) Connect(rootCtx context.Context) error {
 	self.connectLock.Lock()
 	defer self.connectLock.Unlock()
@@ -178,10 +275,16 @@ func (self *StreamingClient) Connect(rootCtx context.Context) error {
 		}
 		connCtx, cancel := context.WithCancel(rootCtx)
 		self.cancelFunc = cancel
+		self.connCtx = connCtx
+		self.rootCtx = rootCtx
+		self.reconnecting = false
+		self.closed = false
 		self.sendChannel = make(chan jlib.Message, 100)
-		self.closeChannel = make(chan error, 10)
-		go self.sendLoop(connCtx)
-		go self.recvLoop()
+		if self.closeChannel == nil {
+			self.closeChannel = make(chan error, 10)
+		}
+		go self.sendLoop(rootCtx, connCtx, self.sendChannel)
+		go self.recvLoop(rootCtx)
 	} else {
 		self.Log().Debug("client already connected")
 	}
@@ -192,6 +295,34 @@ func (self *StreamingClient) handleError(err error) {
 	if errors.Is(err, TransportClosed) {
 		self.Log().Debug("transport closed")
 	}
+
+	self.connectLock.Lock()
+	if self.reconnecting {
+		// the drop is being handled by another loop
+		self.connectLock.Unlock()
+		return
+	}
+	cfg := self.reconnectConfig
+	rootCtx := self.rootCtx
+	reconnect := cfg != nil && !self.closed && rootCtx != nil && rootCtx.Err() == nil
+	var ctx context.Context
+	if reconnect {
+		self.reconnecting = true
+		ctx, self.reconnectCancel = context.WithCancel(rootCtx)
+	}
+	self.connectLock.Unlock()
+
+	if reconnect {
+		self.Log().Infof("connection dropped, %s", err)
+		self.drop()
+		self.failPending(ErrConnectionLost)
+		if self.closeHandler != nil {
+			self.closeHandler()
+		}
+		go self.reconnectLoop(ctx, rootCtx, *cfg)
+		return
+	}
+
 	self.Reset(err)
 	if self.closeHandler != nil {
 		self.closeHandler()
@@ -203,7 +334,7 @@ func (self *StreamingClient) Connected() bool {
 	return self.transport.Connected()
 }
 
-func (self *StreamingClient) sendLoop(connCtx context.Context) {
+func (self *StreamingClient) sendLoop(rootCtx context.Context, connCtx context.Context, sendChannel chan jlib.Message) {
 	//defer self.Reset(nil)
 	defer func() {
 		self.Log().Debug("sendLoop stop")
@@ -219,9 +350,12 @@ func (self *StreamingClient) sendLoop(connCtx context.Context) {
 		select {
 		case <-ctx.Done():
 			self.Log().Debug("ctx Done")
-			self.Close()
+			if rootCtx.Err() != nil {
+				// not cancelled by dropping the connection
+				self.Close()
+			}
 			return
-		case msg, ok := <-self.sendChannel:
+		case msg, ok := <-sendChannel:
 			if !ok {
 				return
 			}
@@ -238,7 +372,7 @@ func (self *StreamingClient) sendLoop(connCtx context.Context) {
 	}
 }
 
-func (self *StreamingClient) recvLoop() {
+func (self *StreamingClient) recvLoop(rootCtx context.Context) {
 	self.Log().Debug("recvLoop start")
 	defer func() {
 		self.Log().Debug("recvLoop stop")
@@ -257,18 +391,30 @@ func (self *StreamingClient) recvLoop() {
 		}
 
 		// assert msg != nil
-		if !msg.IsResultOrError() {
-			if self.messageHandler != nil {
-				self.messageHandler(msg)
-			} else {
-				msg.Log().Debug("no message handler found")
+		if batch, ok := msg.(*jlib.BatchMessage); ok {
+			for _, elem := range batch.Messages {
+				self.handleMessage(rootCtx, elem)
 			}
 		} else {
-			self.handleResult(msg)
+			self.handleMessage(rootCtx, msg)
 		}
 	}
 }
 
+func (self *StreamingClient) handleMessage(rootCtx context.Context, msg jlib.Message) {
+	if self.actorServes(msg) {
+		go self.feedActor(rootCtx, msg)
+	} else if !msg.IsResultOrError() {
+		if self.messageHandler != nil {
+			self.messageHandler(msg)
+		} else {
+			msg.Log().Debug("no message handler found")
+		}
+	} else {
+		self.handleResult(msg)
+	}
+}
+
 func (self *StreamingClient) handleResult(msg jlib.Message) {
 	msgId := msg.MustId()
 	v, loaded := self.pendingRequests.LoadAndDelete(msgId)
@@ -280,6 +426,7 @@ func (self *StreamingClient) handleResult(msg jlib.Message) {
 	}
 
 	if pending, ok := v.(*pendingRequest); ok {
+		self.expiry.remove(pending)
 		if msgId != pending.reqmsg.Id {
 			resmsg := msg.ReplaceId(pending.reqmsg.Id)
 			pending.resultChannel <- resmsg
@@ -289,21 +436,40 @@ func (self *StreamingClient) handleResult(msg jlib.Message) {
 	}
 }
 
-func (self *StreamingClient) expire(k interface{}, after time.Duration) {
-	// ctx, cancel := context.WithCancel(rootCtx)
-	// defer cancel()
-	select {
-	// case <- ctx.Done():
-	// 	return
-	case <-time.After(after):
-		v, loaded := self.pendingRequests.LoadAndDelete(k)
-		if loaded {
-			if pending, ok := v.(*pendingRequest); ok {
-				timeout := jlib.ErrTimeout.ToMessage(pending.reqmsg)
-				pending.resultChannel <- timeout
-			}
-		}
+// reply timeout to a pending request which is expired, unless the
+// id has been taken by another request
+func (self *StreamingClient) expire(pending *pendingRequest) {
+	if v, ok := self.pendingRequests.Load(pending.sendId); !ok || v != pending {
+		return
+	}
+	if _, loaded := self.pendingRequests.LoadAndDelete(pending.sendId); loaded {
+		timeout := jlib.ErrTimeout.ToMessage(pending.reqmsg)
+		pending.resultChannel <- timeout
+	}
+}
+
+// ClientOptions returns the options of client
+func (self *StreamingClient) ClientOptions() ClientOptions {
+	return self.clientOptions
+}
+
+// the time to wait for the result of a request
+func (self *StreamingClient) requestTimeout(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
 	}
+	if self.clientOptions.Timeout > 0 {
+		return time.Duration(self.clientOptions.Timeout) * time.Second
+	}
+	return defaultRequestTimeout
+}
+
+func (self *StreamingClient) SetErrorRegistry(registry *jlib.ErrorRegistry) {
+	self.errorRegistry = registry
+}
+
+func (self *StreamingClient) SetTracer(tracer jlibtrace.Tracer) {
+	self.tracer = tracer
 }
 
 func (self *StreamingClient) UnwrapCall(rootCtx context.Context, reqmsg *jlib.RequestMessage, output interface{}) error {
@@ -312,17 +478,27 @@ func (self *StreamingClient) UnwrapCall(rootCtx context.Context, reqmsg *jlib.Re
 		return err
 	}
 	if resmsg.IsResult() {
-		err := jlib.DecodeInterface(resmsg.MustResult(), output)
+		err := resmsg.DecodeResultInto(output)
 		if err != nil {
 			return errors.Wrapf(err, "RPC(%s)", reqmsg.Method)
 		}
 		return nil
 	} else {
-		return resmsg.MustError()
+		return unwrapError(self.errorRegistry, resmsg.MustError())
 	}
 }
 
+func (self *StreamingClient) Use(interceptor Interceptor) {
+	self.interceptors = append(self.interceptors, interceptor)
+}
+
 func (self *StreamingClient) Call(rootCtx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error) {
+	ctx, cancel := self.clientOptions.callContext(rootCtx)
+	defer cancel()
+	return invokeCall(ctx, reqmsg, self.interceptors, self.tracer, self.call)
+}
+
+func (self *StreamingClient) call(rootCtx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error) {
 	resmsg, err := self.request(rootCtx, reqmsg)
 	if err != nil {
 		return resmsg, errors.Wrapf(err, "RPC(%s)", reqmsg.Method)
@@ -331,42 +507,152 @@ func (self *StreamingClient) Call(rootCtx context.Context, reqmsg *jlib.RequestM
 }
 
 func (self *StreamingClient) request(rootCtx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error) {
-	err := self.Connect(rootCtx)
+	err := self.Connect(self.connectContext(rootCtx))
 	if err != nil {
 		return nil, err
 	}
-	ch := make(chan jlib.Message, 10)
+	sendmsg, pending := self.addPending(reqmsg, self.requestTimeout(rootCtx))
+	ch := pending.resultChannel
 
-	sendmsg := reqmsg
-	if _, loaded := self.pendingRequests.Load(reqmsg.Id); loaded {
-		sendmsg = reqmsg.Clone(jlib.NewUuid())
+	err = self.send(rootCtx, sendmsg)
+	if err != nil {
+		self.removePending(pending)
+		return nil, err
 	}
 
+	select {
+	case resmsg, ok := <-ch:
+		if !ok {
+			if pending.err != nil {
+				return nil, pending.err
+			}
+			return nil, errors.New("result channel closed")
+		}
+		return resmsg, nil
+	case <-rootCtx.Done():
+		self.removePending(pending)
+		return nil, rootCtx.Err()
+	}
+}
+
+// the default time to wait for the result of a request when neither
+// the context has a deadline nor the Timeout option is set
+const defaultRequestTimeout = 10 * time.Second
+
+// register a pending request waiting for result, the request
+// message is cloned with a new id if its id is already pending
+func (self *StreamingClient) addPending(reqmsg *jlib.RequestMessage, timeout time.Duration) (*jlib.RequestMessage, *pendingRequest) {
 	p := &pendingRequest{
 		reqmsg:        reqmsg,
-		resultChannel: ch,
-		expire:        time.Now().Add(time.Second * 10),
+		sendId:        reqmsg.Id,
+		resultChannel: make(chan jlib.Message, 10),
+		expire:        time.Now().Add(timeout),
+	}
+
+	sendmsg := reqmsg
+	if _, loaded := self.pendingRequests.LoadOrStore(reqmsg.Id, p); loaded {
+		// the uuid never collides
+		sendmsg = reqmsg.Clone(jlib.NewUuid())
+		p.sendId = sendmsg.Id
+		self.pendingRequests.Store(sendmsg.Id, p)
+	}
+	self.expiry.add(p)
+	return sendmsg, p
+}
+
+// remove a pending request which is no more waited
+func (self *StreamingClient) removePending(pending *pendingRequest) {
+	if v, ok := self.pendingRequests.Load(pending.sendId); ok && v == pending {
+		self.pendingRequests.Delete(pending.sendId)
+	}
+	self.expiry.remove(pending)
+}
+
+func (self *StreamingClient) CallBatch(rootCtx context.Context, msgs []jlib.Message) ([]jlib.Message, error) {
+	ctx, cancel := self.clientOptions.callContext(rootCtx)
+	defer cancel()
+	return invokeBatch(ctx, msgs, self.interceptors, self.tracer, self.callBatch)
+}
+
+func (self *StreamingClient) callBatch(rootCtx context.Context, msgs []jlib.Message) ([]jlib.Message, error) {
+	if err := checkBatchIds(msgs); err != nil {
+		return nil, err
+	}
+	err := self.Connect(self.connectContext(rootCtx))
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := self.requestTimeout(rootCtx)
+	sendmsgs := make([]jlib.Message, 0, len(msgs))
+	pendings := []*pendingRequest{}
+	for _, msg := range msgs {
+		if reqmsg, ok := msg.(*jlib.RequestMessage); ok {
+			sendmsg, pending := self.addPending(reqmsg, timeout)
+			sendmsgs = append(sendmsgs, sendmsg)
+			pendings = append(pendings, pending)
+		} else {
+			sendmsgs = append(sendmsgs, msg)
+		}
 	}
-	self.pendingRequests.Store(sendmsg.Id, p)
 
-	err = self.Send(rootCtx, sendmsg)
+	err = self.send(rootCtx, jlib.NewBatchMessage(sendmsgs))
 	if err != nil {
+		for _, pending := range pendings {
+			self.removePending(pending)
+		}
 		return nil, err
 	}
-	go self.expire(sendmsg.Id, time.Second*10)
 
-	resmsg, ok := <-ch
-	if !ok {
-		return nil, errors.New("result channel closed")
+	results := make([]jlib.Message, 0, len(pendings))
+	for i, pending := range pendings {
+		select {
+		case resmsg, ok := <-pending.resultChannel:
+			if !ok {
+				if pending.err != nil {
+					return nil, pending.err
+				}
+				return nil, errors.New("result channel closed")
+			}
+			results = append(results, resmsg)
+		case <-rootCtx.Done():
+			for _, p := range pendings[i:] {
+				self.removePending(p)
+			}
+			return nil, rootCtx.Err()
+		}
 	}
-	return resmsg, nil
+	return results, nil
 }
 
 func (self *StreamingClient) Send(rootCtx context.Context, msg jlib.Message) error {
-	err := self.Connect(rootCtx)
+	return invokeSend(rootCtx, msg, self.interceptors, self.tracer, self.send)
+}
+
+func (self *StreamingClient) send(rootCtx context.Context, msg jlib.Message) error {
+	err := self.Connect(self.connectContext(rootCtx))
 	if err != nil {
 		return err
 	}
-	self.sendChannel <- msg
-	return nil
+	self.connectLock.Lock()
+	sendChannel, connCtx := self.sendChannel, self.connCtx
+	self.connectLock.Unlock()
+	if sendChannel == nil {
+		// dropped right after connecting
+		return ErrConnectionLost
+	}
+	select {
+	case sendChannel <- msg:
+		return nil
+	default:
+	}
+	// the queue is full, wait unless the connection is dropped
+	select {
+	case sendChannel <- msg:
+		return nil
+	case <-connCtx.Done():
+		return ErrConnectionLost
+	case <-rootCtx.Done():
+		return rootCtx.Err()
+	}
 }
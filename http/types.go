@@ -6,16 +6,74 @@ package jlibhttp
 import (
 	"context"
 	"crypto/tls"
+	"github.com/pkg/errors"
 	"github.com/superisaac/jlib"
+	"github.com/superisaac/jlib/trace"
 	"net/http"
 	"net/url"
+	"time"
 )
 
+// ClientOptions are honored by all kinds of clients unless noted,
+// durations are in seconds.
 type ClientOptions struct {
-	// client request timeout
+	// client request timeout, used when the context of a call has
+	// no deadline, the default is 5 for http/1.1 clients and 10 for
+	// streaming clients
 	Timeout int `json:"timeout" yaml:"timeout"`
+
+	// the timeout of dialing and handshaking with server, no timeout
+	// if zero
+	ConnectTimeout int `json:"connect_timeout,omitempty" yaml:"connect_timeout,omitempty"`
+
+	// the io buffer sizes in bytes of http/1.1 and websocket
+	// connections, the defaults are taken if zero
+	ReadBufferSize  int `json:"read_buffer_size,omitempty" yaml:"read_buffer_size,omitempty"`
+	WriteBufferSize int `json:"write_buffer_size,omitempty" yaml:"write_buffer_size,omitempty"`
+
+	// the interval to ping server of streaming connections, the
+	// connection is closed if the server doesn't respond in another
+	// interval, no pings if zero
+	PingInterval int `json:"ping_interval,omitempty" yaml:"ping_interval,omitempty"`
+
+	// the max size in bytes of a message received, no limit if zero
+	MaxMessageSize int64 `json:"max_message_size,omitempty" yaml:"max_message_size,omitempty"`
+}
+
+func (self ClientOptions) connectTimeout() time.Duration {
+	return time.Duration(self.ConnectTimeout) * time.Second
 }
 
+func (self ClientOptions) pingInterval() time.Duration {
+	return time.Duration(self.PingInterval) * time.Second
+}
+
+// the context of a call, whose deadline is set by Timeout if the
+// context has no deadline, so that the deadline is sent to server
+func (self ClientOptions) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || self.Timeout <= 0 {
+		return ctx, func() {}
+	}
+	ctx1, cancel := context.WithTimeout(ctx, time.Duration(self.Timeout)*time.Second)
+	return context.WithValue(ctx1, connectContextKey{}, ctx), cancel
+}
+
+type connectContextKey struct{}
+
+// the context streaming clients connect with, which is the one
+// before the Timeout applies, so that the connection outlives the
+// call
+func connectContext(ctx context.Context) context.Context {
+	if parent, ok := ctx.Value(connectContextKey{}).(context.Context); ok {
+		return parent
+	}
+	return ctx
+}
+
+// ErrMessageTooLarge is returned when a message received exceeds
+// ClientOptions.MaxMessageSize
+var ErrMessageTooLarge = errors.New("message too large")
+
 // Client is an abstract interface a client type must implement
 type Client interface {
 	// Returns the server URL
@@ -24,15 +82,33 @@ type Client interface {
 	// Call a Request message and expect a Result|Error message.
 	Call(ctx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error)
 
+	// Call a batch of Request and Notify messages in one round
+	// trip, the Result|Error messages of the requests are returned
+	// in the order of the requests.
+	CallBatch(ctx context.Context, msgs []jlib.Message) ([]jlib.Message, error)
+
 	// Call a Request message and unwrap the result message into a
 	// given structure, when an Error message comes it is turned
-	// into a golang error object typed *jlib.ErrorBody
+	// into the golang error registered in the error registry, or
+	// *jlib.RPCError if the code is not registered
 	UnwrapCall(ctx context.Context, reqmsg *jlib.RequestMessage, output interface{}) error
 
+	// Set the error registry used by UnwrapCall, the default is
+	// jlib.DefaultErrorRegistry
+	SetErrorRegistry(registry *jlib.ErrorRegistry)
+
+	// Set the tracer to create spans around calls, the trace
+	// context is propagated to server via message metadata
+	SetTracer(tracer jlibtrace.Tracer)
+
 	// Send a JSONRPC message(usually a notify) to server without
 	// expecting any result.
 	Send(ctx context.Context, msg jlib.Message) error
 
+	// Use appends an interceptor around Call, CallBatch, Send and
+	// UnwrapCall, the interceptor used first is the outermost one.
+	Use(interceptor Interceptor)
+
 	// Set the client tls config
 	SetClientTLSConfig(cfg *tls.Config)
 
@@ -43,6 +119,17 @@ type Client interface {
 	IsStreaming() bool
 }
 
+// Invoker delivers a message to server, a Request message is replied
+// with a Result|Error message, a Batch message is replied with a
+// Batch message of the results in the order of the requests, and a
+// message sent by Client.Send is replied with nil.
+type Invoker func(ctx context.Context, msg jlib.Message) (jlib.Message, error)
+
+// Interceptor wraps an invoker of a client, it may modify the message
+// before calling next, retry or short-circuit the call, and
+// post-process the reply.
+type Interceptor func(next Invoker) Invoker
+
 type MessageHandler func(msg jlib.Message)
 type ConnectedHandler func()
 type CloseHandler func()
@@ -55,4 +142,16 @@ type Streamable interface {
 	OnMessage(handler MessageHandler) error
 	OnClose(handler CloseHandler) error
 	Wait() error
+
+	// reconnect when the connection drops, nil disables it
+	SetReconnect(cfg *ReconnectConfig)
+	OnReconnected(handler ConnectedHandler) error
+
+	// Subscribe calls a request which is called again after each
+	// reconnecting
+	Subscribe(ctx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error)
+	Unsubscribe(id interface{}) bool
+
+	// SetActor sets the actor serving the requests from server
+	SetActor(actor *Actor)
 }
@@ -1,58 +1,29 @@
 package jlibhttp
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 	"github.com/superisaac/jlib"
 	"reflect"
 )
 
-func typeIsStruct(tp reflect.Type) bool {
-	return (tp.Kind() == reflect.Struct ||
-		(tp.Kind() == reflect.Ptr && typeIsStruct(tp.Elem())))
-}
-
+// decode a param into the value of outputType following the
+// semantics of encoding/json
 func interfaceToValue(a interface{}, outputType reflect.Type) (reflect.Value, error) {
-	output := reflect.Zero(outputType).Interface()
-	config := &mapstructure.DecoderConfig{
-		Metadata: nil,
-		TagName:  "json",
-		Result:   &output,
-	}
-	decoder, err := mapstructure.NewDecoder(config)
+	data, err := json.Marshal(a)
 	if err != nil {
 		return reflect.Value{}, err
 	}
-	err = decoder.Decode(a)
-	if err != nil {
+	output := reflect.New(outputType)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(output.Interface()); err != nil {
 		return reflect.Value{}, err
 	}
-	return reflect.ValueOf(output), nil
-}
-
-func valueToInterface(tp reflect.Type, val reflect.Value) (interface{}, error) {
-	var output interface{}
-	if typeIsStruct(tp) {
-		output = make(map[string]interface{})
-	} else {
-		output = reflect.Zero(tp).Interface()
-	}
-	config := &mapstructure.DecoderConfig{
-		Metadata: nil,
-		TagName:  "json",
-		Result:   &output,
-	}
-	decoder, err := mapstructure.NewDecoder(config)
-	if err != nil {
-		return nil, err
-	}
-	err = decoder.Decode(val.Interface())
-	if err != nil {
-		return nil, err
-	}
-	return output, nil
+	return output.Elem(), nil
 }
 
 type FirstArgSpec interface {
@@ -151,7 +122,6 @@ func wrapTyped(tfunc interface{}, firstArgSpec FirstArgSpec) (RequestCallback, e
 
 		// wrap result
 		resValues := reflect.ValueOf(tfunc).Call(fnArgs)
-		resType := funcType.Out(0)
 		errRes := resValues[1].Interface()
 		if errRes != nil {
 			if err, ok := errRes.(error); ok {
@@ -161,9 +131,9 @@ func wrapTyped(tfunc interface{}, firstArgSpec FirstArgSpec) (RequestCallback, e
 			}
 		}
 
-		res, err := valueToInterface(
-			resType, resValues[0])
-		return res, err
+		// the result is encoded as it is, so that json.Marshaler
+		// implementations are respected
+		return resValues[0].Interface(), nil
 	}
 
 	return handler, nil
@@ -3,11 +3,17 @@ package jlibhttp
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/websocket"
 	//log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/superisaac/jlib"
+	"github.com/superisaac/jlib/trace"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -111,7 +117,7 @@ func TestTypedWSHandlerClient(t *testing.T) {
 	assert.True(resmsg1.IsError())
 	errbody1 := resmsg1.MustError()
 	assert.Equal(-32602, errbody1.Code) // params error
-	assert.True(strings.Contains(errbody1.Message, "got unconvertible type"))
+	assert.True(strings.Contains(errbody1.Message, "cannot unmarshal"))
 	// test params size
 	params2 := [](interface{}){}
 	reqmsg2 := jlib.NewRequestMessage(2, "echoTyped", params2)
@@ -140,7 +146,7 @@ func TestTypedWSHandlerClient(t *testing.T) {
 	assert.True(resmsg4.IsError())
 	errbody4 := resmsg4.MustError()
 	assert.Equal(-32602, errbody4.Code)
-	assert.True(strings.Contains(errbody4.Message, "got unconvertible type"))
+	assert.True(strings.Contains(errbody4.Message, "cannot unmarshal"))
 }
 
 func TestWSClose(t *testing.T) {
@@ -184,3 +190,641 @@ func TestWSClose(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 	assert.True(closeCalled[0])
 }
+
+func TestWSBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewWSHandler(rootCtx, nil)
+	server.Actor.On("echo", func(params []interface{}) (interface{}, error) {
+		return params[0], nil
+	})
+	server.Actor.On("log", func(params []interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28130", server)
+	time.Sleep(10 * time.Millisecond)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:28130", nil)
+	assert.Nil(err)
+	defer ws.Close()
+
+	// a batch of notifies gets no frame back, the batch of the echo
+	// requests is replied
+	err = ws.WriteMessage(websocket.TextMessage, []byte(`[{"jsonrpc": "2.0", "method": "log", "params": []}]`))
+	assert.Nil(err)
+	err = ws.WriteMessage(websocket.TextMessage, []byte(`[{"jsonrpc": "2.0", "id": 1, "method": "echo", "params": ["ws1"]}, {"jsonrpc": "2.0", "id": 2, "method": "echo", "params": ["ws2"]}]`))
+	assert.Nil(err)
+
+	_, data, err := ws.ReadMessage()
+	assert.Nil(err)
+	resmsg, err := jlib.ParseBytes(data)
+	assert.Nil(err)
+	assert.True(resmsg.IsBatch())
+	batch, _ := resmsg.(*jlib.BatchMessage)
+	assert.Equal(2, len(batch.Messages))
+	assert.Equal("ws1", batch.Messages[0].MustResult())
+	assert.Equal("ws2", batch.Messages[1].MustResult())
+}
+
+func TestWSCallBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewWSHandler(rootCtx, nil)
+	server.Actor.OnTyped("add", func(a, b int) (int, error) {
+		return a + b, nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28131", server)
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewWSClient(urlParse("ws://127.0.0.1:28131"))
+	results, err := client.CallBatch(rootCtx, []jlib.Message{
+		jlib.NewRequestMessage(1, "add", []interface{}{1, 2}),
+		jlib.NewNotifyMessage("add", []interface{}{0, 0}),
+		jlib.NewRequestMessage(2, "add", []interface{}{5, 6}),
+	})
+	assert.Nil(err)
+	assert.Equal(2, len(results))
+	assert.Equal(1, results[0].MustId())
+	assert.Equal(json.Number("3"), results[0].MustResult())
+	assert.Equal(2, results[1].MustId())
+	assert.Equal(json.Number("11"), results[1].MustResult())
+}
+
+func TestWSTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serverTracer := jlibtrace.NewMemoryTracer()
+	server := NewWSHandler(rootCtx, nil)
+	server.Actor.Tracer = serverTracer
+	server.Actor.OnTyped("add", func(a, b int) (int, error) {
+		return a + b, nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28132", server)
+	time.Sleep(10 * time.Millisecond)
+
+	clientTracer := jlibtrace.NewMemoryTracer()
+	client := NewWSClient(urlParse("ws://127.0.0.1:28132"))
+	client.SetTracer(clientTracer)
+
+	var res int
+	err := client.UnwrapCall(rootCtx, jlib.NewRequestMessage(1, "add", []interface{}{1, 2}), &res)
+	assert.Nil(err)
+	assert.Equal(3, res)
+
+	clientSpans := clientTracer.Spans()
+	serverSpans := serverTracer.Spans()
+	assert.Equal(1, len(clientSpans))
+	assert.Equal(1, len(serverSpans))
+	assert.Equal(jlibtrace.SpanKindClient, clientSpans[0].Kind)
+	assert.Equal(jlibtrace.SpanKindServer, serverSpans[0].Kind)
+	assert.Equal(clientSpans[0].Context.TraceID, serverSpans[0].Context.TraceID)
+	assert.Equal(clientSpans[0].Context.SpanID, serverSpans[0].ParentID)
+	assert.Equal(1, serverSpans[0].Attributes[jlibtrace.AttrRPCRequestId])
+}
+
+func TestWSClientInterceptor(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewWSHandler(rootCtx, nil)
+	server.Actor.OnTyped("add", func(a, b int) (int, error) {
+		return a + b, nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28133", server)
+	time.Sleep(10 * time.Millisecond)
+
+	client, err := NewClient("ws://127.0.0.1:28133")
+	assert.Nil(err)
+	// double the first param
+	client.Use(func(next Invoker) Invoker {
+		return func(ctx context.Context, msg jlib.Message) (jlib.Message, error) {
+			if reqmsg, ok := msg.(*jlib.RequestMessage); ok {
+				params := reqmsg.MustParams()
+				params[0] = 2 * params[0].(int)
+				msg = jlib.NewRequestMessage(reqmsg.Id, reqmsg.Method, params)
+			}
+			return next(ctx, msg)
+		}
+	})
+
+	var res int
+	err = client.UnwrapCall(rootCtx, jlib.NewRequestMessage(1, "add", []interface{}{1, 2}), &res)
+	assert.Nil(err)
+	assert.Equal(4, res)
+}
+
+func TestWSSessionAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	authcfg := &AuthConfig{
+		Basic: []BasicAuthConfig{{Username: "monkey", Password: "banana"}},
+		Jwt:   &JwtAuthConfig{Secret: "JwtIsUniversal"},
+	}
+	server := NewWSHandler(rootCtx, nil)
+	server.Actor.SessionAuth = &SessionAuthConfig{
+		Authenticator: authcfg.Authenticators(),
+		Required:      true,
+	}
+	server.Actor.Use(RateLimitMiddleware(RateLimitConfig{
+		PerMethod: map[string]RateLimit{SessionAuthMethod: {Rate: 0.001, Burst: 3}},
+	}, nil))
+	server.Actor.OnRequest("whoami", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		authInfo, _ := AuthInfoFromContext(req.Context())
+		return authInfo.Username, nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28134", server)
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewWSClient(urlParse("ws://127.0.0.1:28134"))
+	expired := make(chan bool, 1)
+	client.OnMessage(func(msg jlib.Message) {
+		if msg.IsNotify() && msg.MustMethod() == SessionAuthExpiredMethod {
+			expired <- true
+		}
+	})
+
+	whoami := func() jlib.Message {
+		resmsg, err := client.Call(rootCtx, jlib.NewRequestMessage(jlib.NewUuid(), "whoami", nil))
+		assert.Nil(err)
+		return resmsg
+	}
+	assert.Equal(jlib.ErrAuthFailed.Code, whoami().MustError().Code)
+
+	// a token expires in a second
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtClaims{
+		Username: "jake",
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(time.Second).Unix(),
+		},
+	})
+	tokenStr, err := token.SignedString([]byte("JwtIsUniversal"))
+	assert.Nil(err)
+
+	resmsg, err := client.Call(rootCtx, jlib.NewRequestMessage(1, SessionAuthMethod, []interface{}{tokenStr}))
+	assert.Nil(err)
+	assert.Equal("jake", resmsg.MustResult().(map[string]interface{})["username"])
+	assert.Equal("jake", whoami().MustResult())
+
+	select {
+	case <-expired:
+	case <-time.After(3 * time.Second):
+		assert.Fail("auth not expired")
+	}
+	assert.Equal(jlib.ErrAuthFailed.Code, whoami().MustError().Code)
+
+	// re-auth without reconnecting
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(2, SessionAuthMethod, map[string]interface{}{
+		"username": "monkey", "password": "wrong"}))
+	assert.Nil(err)
+	assert.Equal(jlib.ErrAuthFailed.Code, resmsg.MustError().Code)
+
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(3, SessionAuthMethod, map[string]interface{}{
+		"username": "monkey", "password": "banana"}))
+	assert.Nil(err)
+	assert.True(resmsg.IsResult())
+	assert.Equal("monkey", whoami().MustResult())
+
+	// logins pass the rate limiter
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(4, SessionAuthMethod, map[string]interface{}{
+		"username": "monkey", "password": "banana"}))
+	assert.Nil(err)
+	assert.Equal(jlib.ErrRateLimited.Code, resmsg.MustError().Code)
+}
+
+func TestWSSessionBackpressure(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewWSHandler(rootCtx, nil)
+	server.Session = SessionConfig{MaxInFlight: 2, WriteTimeout: time.Second}
+	release := make(chan struct{})
+	server.Actor.On("wait", func(params []interface{}) (interface{}, error) {
+		<-release
+		return "done", nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28135", server)
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewWSClient(urlParse("ws://127.0.0.1:28135"))
+	for i := 0; i < 5; i++ {
+		err := client.Send(rootCtx, jlib.NewNotifyMessage("wait", nil))
+		assert.Nil(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// the session stops reading when 2 messages are in flight, the
+	// third one read waits for a slot
+	stats := server.Stats()
+	assert.Equal(1, stats.Sessions)
+	assert.Equal(int64(2), stats.InFlight)
+	assert.Equal(uint64(3), stats.Received)
+
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	stats = server.Stats()
+	assert.Equal(int64(0), stats.InFlight)
+	assert.Equal(uint64(5), stats.Received)
+}
+
+func TestSessionSendPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NotNil(SessionConfig{SendPolicy: "bad"}.ValidateValues())
+
+	// drop oldest keeps the latest messages
+	stream := newStreamSession(SessionConfig{SendQueueSize: 2, SendPolicy: SendDropOldest})
+	for i := 0; i < 5; i++ {
+		stream.enqueue(jlib.NewNotifyMessage("tick", []interface{}{i}))
+	}
+	stats := stream.stats()
+	assert.Equal(2, stats.QueueDepth)
+	assert.Equal(uint64(3), stats.Dropped)
+	msg := <-stream.sendQueue
+	assert.Equal(3, msg.MustParams()[0])
+
+	// disconnect closes the session on overflow
+	stream = newStreamSession(SessionConfig{SendQueueSize: 1, SendPolicy: SendDisconnect})
+	stream.enqueue(jlib.NewNotifyMessage("tick", nil))
+	stream.enqueue(jlib.NewNotifyMessage("tick", nil))
+	assert.ErrorIs(stream.err(), ErrSendQueueFull)
+
+	// block is released when the session ends
+	stream = newStreamSession(SessionConfig{SendQueueSize: 1})
+	stream.enqueue(jlib.NewNotifyMessage("tick", nil))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		stream.close(nil)
+	}()
+	stream.enqueue(jlib.NewNotifyMessage("tick", nil))
+	assert.Equal(1, stream.stats().QueueDepth)
+}
+
+func TestWSDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewWSHandler(rootCtx, nil)
+	server.Actor.OnContext("budget", func(ctx context.Context, params []interface{}) (interface{}, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return -1, nil
+		}
+		return time.Until(deadline).Milliseconds(), nil
+	})
+	server.Actor.OnContext("sleep", func(ctx context.Context, params []interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return "woken", nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28136", server)
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewWSClient(urlParse("ws://127.0.0.1:28136"))
+
+	ctx, cancelCall := context.WithTimeout(rootCtx, time.Second)
+	defer cancelCall()
+	resmsg, err := client.Call(ctx, jlib.NewRequestMessage(1, "budget", nil))
+	assert.Nil(err)
+	budget, err := resmsg.MustResult().(json.Number).Int64()
+	assert.Nil(err)
+	assert.True(budget > 500 && budget <= 1000)
+
+	// the server replies timeout when the budget of caller runs out
+	ctx1, cancelCall1 := context.WithTimeout(rootCtx, 50*time.Millisecond)
+	defer cancelCall1()
+	start := time.Now()
+	resmsg, err = client.Call(ctx1, jlib.NewRequestMessage(2, "sleep", nil))
+	if err == nil {
+		assert.Equal(jlib.ErrTimeout.Code, resmsg.MustError().Code)
+	}
+	assert.True(time.Since(start) < 500*time.Millisecond)
+}
+
+func TestWSClientOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewWSHandler(rootCtx, nil)
+	server.Actor.OnContext("sleep", func(ctx context.Context, params []interface{}) (interface{}, error) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(3 * time.Second):
+		}
+		return "woken", nil
+	})
+	server.Actor.On("big", func(params []interface{}) (interface{}, error) {
+		return strings.Repeat("x", 4096), nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28137", server)
+	time.Sleep(10 * time.Millisecond)
+
+	c, err := NewClient("ws://127.0.0.1:28137", ClientOptions{
+		Timeout:        1,
+		ConnectTimeout: 1,
+		PingInterval:   1,
+		MaxMessageSize: 1024,
+	})
+	assert.Nil(err)
+	client, ok := c.(*WSClient)
+	assert.True(ok)
+	assert.Equal(1, client.ClientOptions().Timeout)
+
+	// the call timeout option, either the server replies timeout or
+	// the client gives up at the same time
+	start := time.Now()
+	resmsg, err := client.Call(rootCtx, jlib.NewRequestMessage(1, "sleep", nil))
+	if err == nil {
+		assert.Equal(jlib.ErrTimeout.Code, resmsg.MustError().Code)
+	} else {
+		assert.ErrorIs(err, context.DeadlineExceeded)
+	}
+	assert.True(time.Since(start) < 2*time.Second)
+	assert.Equal(0, client.expiry.len())
+	// the connection outlives the call timeout
+	time.Sleep(10 * time.Millisecond)
+	assert.True(client.Connected())
+
+	// messages exceeding the max size close the connection
+	ctx, cancelCall := context.WithTimeout(rootCtx, 200*time.Millisecond)
+	defer cancelCall()
+	resmsg, err = client.Call(ctx, jlib.NewRequestMessage(2, "big", nil))
+	assert.True(err != nil || resmsg.IsError())
+	assert.False(client.Connected())
+}
+
+func TestExpiryQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	var lock sync.Mutex
+	expired := []string{}
+	q := newExpiryQueue(func(p *pendingRequest) {
+		lock.Lock()
+		defer lock.Unlock()
+		expired = append(expired, p.sendId.(string))
+	})
+	now := time.Now()
+	p30 := &pendingRequest{sendId: "30", expire: now.Add(30 * time.Millisecond)}
+	p10 := &pendingRequest{sendId: "10", expire: now.Add(10 * time.Millisecond)}
+	p20 := &pendingRequest{sendId: "20", expire: now.Add(20 * time.Millisecond)}
+	q.add(p30)
+	q.add(p10)
+	q.add(p20)
+	assert.Equal(3, q.len())
+	q.remove(p20)
+	assert.Equal(2, q.len())
+
+	time.Sleep(60 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal([]string{"10", "30"}, expired)
+	assert.Equal(0, q.len())
+}
+
+func TestWSReconnect(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewWSHandler(rootCtx, nil)
+	var subscribed int32
+	subscribeMeta := make(chan jlib.Metadata, 10)
+	server.Actor.OnRequest("subscribe", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		atomic.AddInt32(&subscribed, 1)
+		subscribeMeta <- req.Msg().Metadata().Clone()
+		return "ok", nil
+	})
+	server.Actor.OnRequest("drop", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		req.Session().(*WSSession).Close()
+		return nil, nil
+	})
+	server.Actor.OnContext("hang", func(ctx context.Context, params []interface{}) (interface{}, error) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(2 * time.Second):
+		}
+		return "hang", nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28138", server)
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewWSClient(urlParse("ws://127.0.0.1:28138"))
+	client.SetReconnect(&ReconnectConfig{
+		InitialDelay: 10 * time.Millisecond,
+		MaxDelay:     50 * time.Millisecond,
+	})
+	reconnected := make(chan bool, 10)
+	err := client.OnReconnected(func() {
+		reconnected <- true
+	})
+	assert.Nil(err)
+
+	submsg := jlib.NewRequestMessage(1, "subscribe", nil)
+	submsg.SetMeta("timeout", "5000")
+	submsg.SetMeta("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	submsg.SetMeta("tenant", "t1")
+	resmsg, err := client.Subscribe(rootCtx, submsg)
+	assert.Nil(err)
+	assert.Equal("ok", resmsg.MustResult())
+	assert.Equal(int32(1), atomic.LoadInt32(&subscribed))
+	md := <-subscribeMeta
+	assert.Equal("5000", md.Get("timeout"))
+	assert.NotEqual("", md.Get("traceparent"))
+
+	// the pending call fails immediately when the connection drops
+	hangErr := make(chan error, 1)
+	go func() {
+		_, err := client.Call(rootCtx, jlib.NewRequestMessage(2, "hang", nil))
+		hangErr <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	err = client.Send(rootCtx, jlib.NewNotifyMessage("drop", nil))
+	assert.Nil(err)
+
+	select {
+	case err := <-hangErr:
+		assert.ErrorIs(err, ErrConnectionLost)
+	case <-time.After(time.Second):
+		assert.Fail("pending call not failed")
+	}
+
+	// the subscription is replayed after reconnecting
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		assert.Fail("not reconnected")
+	}
+	assert.Equal(int32(2), atomic.LoadInt32(&subscribed))
+	assert.True(client.Connected())
+
+	// the stale timeout and trace context are not replayed
+	md = <-subscribeMeta
+	assert.Equal("", md.Get("timeout"))
+	assert.Equal("", md.Get("traceparent"))
+	assert.Equal("t1", md.Get("tenant"))
+
+	assert.True(client.Unsubscribe(1))
+	assert.False(client.Unsubscribe(1))
+
+	// closing the client stops reconnecting
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- client.Wait()
+	}()
+	client.Close()
+	select {
+	case err := <-waitErr:
+		assert.Nil(err)
+	case <-time.After(time.Second):
+		assert.Fail("wait not returned")
+	}
+
+	// the listener is closed asynchronously, wait for it so that the
+	// port is free for the reruns of test
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := ReconnectConfig{
+		InitialDelay: 100 * time.Millisecond,
+		MaxDelay:     time.Second,
+		Jitter:       0.1,
+	}
+	for i := 0; i < 10; i++ {
+		d := cfg.backoff(0)
+		assert.True(d >= 90*time.Millisecond && d <= 110*time.Millisecond)
+		d = cfg.backoff(2)
+		assert.True(d >= 360*time.Millisecond && d <= 440*time.Millisecond)
+		d = cfg.backoff(10)
+		assert.True(d >= 900*time.Millisecond && d <= 1100*time.Millisecond)
+	}
+}
+
+func TestWSBidirectional(t *testing.T) {
+	assert := assert.New(t)
+
+	rootCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	server := NewWSHandler(rootCtx, nil)
+	// the results of calls to the client don't wait for the slot
+	// held by the calling handler
+	server.Session = SessionConfig{MaxInFlight: 1}
+	server.Actor.OnRequest("ask", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		// call the client within the handler
+		resmsg, err := req.Session().Call(req.Context(), jlib.NewRequestMessage(1, "whoami", params))
+		if err != nil {
+			return nil, err
+		}
+		if resmsg.IsError() {
+			return nil, resmsg.MustError()
+		}
+		return resmsg.MustResult(), nil
+	})
+	go ListenAndServe(rootCtx, "127.0.0.1:28141", server)
+	time.Sleep(10 * time.Millisecond)
+
+	client := NewWSClient(urlParse("ws://127.0.0.1:28141"))
+	actor := NewActor()
+	actor.OnRequest("whoami", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		if req.transportType != TransportWebsocket {
+			return nil, fmt.Errorf("bad transport %s", req.transportType)
+		}
+		return fmt.Sprintf("client %s", params[0]), nil
+	})
+	actor.OnRequest("greet", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		req.Session().Send(jlib.NewNotifyMessage("greeted", nil))
+		return "hi", nil
+	})
+	client.SetActor(actor)
+	notified := make(chan jlib.Message, 10)
+	client.OnMessage(func(msg jlib.Message) {
+		notified <- msg
+	})
+
+	resmsg, err := client.Call(rootCtx, jlib.NewRequestMessage(1, "ask", []interface{}{"abc"}))
+	assert.Nil(err)
+	assert.Equal("client abc", resmsg.MustResult())
+
+	// the method the client actor doesn't serve
+	server.Actor.OnRequest("askMissing", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		resmsg, err := req.Session().Call(req.Context(), jlib.NewRequestMessage(2, "missing", nil))
+		if err != nil {
+			return nil, err
+		}
+		return resmsg.MustError().Code, nil
+	})
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(2, "askMissing", nil))
+	assert.Nil(err)
+	assert.Equal(json.Number("-32601"), resmsg.MustResult())
+
+	// notifies the actor doesn't serve go to the message handler
+	server.Actor.OnRequest("notifyClient", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		req.Session().Send(jlib.NewNotifyMessage("news", nil))
+		return "ok", nil
+	})
+	_, err = client.Call(rootCtx, jlib.NewRequestMessage(3, "notifyClient", nil))
+	assert.Nil(err)
+	select {
+	case msg := <-notified:
+		assert.Equal("news", msg.MustMethod())
+	case <-time.After(time.Second):
+		assert.Fail("no message notified")
+	}
+
+	// the call to client times out by the context
+	server.Actor.OnRequest("askSlow", func(req *RPCRequest, params []interface{}) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(req.Context(), 50*time.Millisecond)
+		defer cancel()
+		resmsg, err := req.Session().Call(ctx, jlib.NewRequestMessage(4, "sleep", nil))
+		if err != nil {
+			return nil, err
+		}
+		return nil, resmsg.MustError()
+	})
+	actor.OnContext("sleep", func(ctx context.Context, params []interface{}) (interface{}, error) {
+		time.Sleep(200 * time.Millisecond)
+		return "awake", nil
+	})
+	resmsg, err = client.Call(rootCtx, jlib.NewRequestMessage(4, "askSlow", nil))
+	assert.Nil(err)
+	assert.True(resmsg.IsError())
+	assert.Equal(jlib.ErrTimeout.Code, resmsg.MustError().Code)
+}
+
+func TestSessionCallClosed(t *testing.T) {
+	assert := assert.New(t)
+
+	stream := newStreamSession(SessionConfig{})
+	go func() {
+		<-stream.sendQueue
+		stream.close(nil)
+	}()
+	_, err := stream.call(context.Background(), jlib.NewRequestMessage(1, "ping", nil))
+	assert.ErrorIs(err, ErrConnectionLost)
+
+	// the result not pending is not delivered
+	assert.False(stream.deliver(jlib.NewResultMessage(jlib.NewRequestMessage(1, "ping", nil), "pong")))
+}
@@ -12,6 +12,8 @@ import (
 	"net/http"
 	"net/url"
 	"reflect"
+	"sync"
+	"time"
 )
 
 type WSClient struct {
@@ -19,18 +21,23 @@ type WSClient struct {
 }
 
 type wsTransport struct {
-	ws *websocket.Conn
-
 	client *WSClient
+
+	// the connection shared by the read and write loops
+	lock sync.Mutex
+	ws   *websocket.Conn
+
+	// closed to stop pinging
+	stopPing chan struct{}
 }
 
-func NewWSClient(serverUrl *url.URL) *WSClient {
+func NewWSClient(serverUrl *url.URL, optlist ...ClientOptions) *WSClient {
 	if serverUrl.Scheme != "ws" && serverUrl.Scheme != "wss" {
 		log.Panicf("server url %s is not websocket", serverUrl)
 	}
 	c := &WSClient{}
 	transport := &wsTransport{client: c}
-	c.InitStreaming(serverUrl, transport)
+	c.InitStreaming(serverUrl, transport, optlist...)
 	return c
 }
 
@@ -39,21 +46,49 @@ func (self *WSClient) String() string {
 }
 
 // websocket transport methods
+func (self *wsTransport) transportType() string {
+	return TransportWebsocket
+}
+
 func (self *wsTransport) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	if self.ws != nil {
+		if self.stopPing != nil {
+			close(self.stopPing)
+			self.stopPing = nil
+		}
 		self.ws.Close()
 		self.ws = nil
 	}
 }
 
-func (self wsTransport) Connected() bool {
+func (self *wsTransport) Connected() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	return self.ws != nil
 }
 
+// the current connection, nil if closed
+func (self *wsTransport) conn() *websocket.Conn {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.ws
+}
+
 func (self *wsTransport) Connect(rootCtx context.Context, serverUrl *url.URL, header http.Header) error {
-	dailer := websocket.DefaultDialer
-	dailer.TLSClientConfig = self.client.ClientTLSConfig()
-	ws, _, err := dailer.Dial(serverUrl.String(), header)
+	opts := self.client.ClientOptions()
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = self.client.ClientTLSConfig()
+	dialer.ReadBufferSize = opts.ReadBufferSize
+	dialer.WriteBufferSize = opts.WriteBufferSize
+	if opts.ConnectTimeout > 0 {
+		dialer.HandshakeTimeout = opts.connectTimeout()
+		var cancel func()
+		rootCtx, cancel = context.WithTimeout(rootCtx, opts.connectTimeout())
+		defer cancel()
+	}
+	ws, _, err := dialer.DialContext(rootCtx, serverUrl.String(), header)
 	if err != nil {
 		var opErr *net.OpError
 		if errors.As(err, &opErr) {
@@ -62,10 +97,41 @@ func (self *wsTransport) Connect(rootCtx context.Context, serverUrl *url.URL, he
 		}
 		return errors.Wrap(err, "wstransport.connect")
 	}
+	if opts.MaxMessageSize > 0 {
+		ws.SetReadLimit(opts.MaxMessageSize)
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	self.ws = ws
+	if interval := opts.pingInterval(); interval > 0 {
+		ws.SetReadDeadline(time.Now().Add(2 * interval))
+		ws.SetPongHandler(func(string) error {
+			return ws.SetReadDeadline(time.Now().Add(2 * interval))
+		})
+		self.stopPing = make(chan struct{})
+		go self.pingLoop(ws, interval, self.stopPing)
+	}
 	return nil
 }
 
+// ping server periodically, the read deadline is extended on each
+// pong, so that the connection is closed if server doesn't respond
+func (self *wsTransport) pingLoop(ws *websocket.Conn, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+				self.client.Log().Debugf("ws ping error %s", err)
+				return
+			}
+		}
+	}
+}
+
 func (self *wsTransport) handleWebsocketError(err error) error {
 	logger := self.client.Log()
 	var closeErr *websocket.CloseError
@@ -87,14 +153,22 @@ func (self *wsTransport) WriteMessage(msg jlib.Message) error {
 		return err
 	}
 
-	if err := self.ws.WriteMessage(websocket.TextMessage, marshaled); err != nil {
+	ws := self.conn()
+	if ws == nil {
+		return TransportClosed
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, marshaled); err != nil {
 		return self.handleWebsocketError(err)
 	}
 	return nil
 }
 
 func (self *wsTransport) ReadMessage() (jlib.Message, bool, error) {
-	messageType, msgBytes, err := self.ws.ReadMessage()
+	ws := self.conn()
+	if ws == nil {
+		return nil, false, TransportClosed
+	}
+	messageType, msgBytes, err := ws.ReadMessage()
 	if err != nil {
 		return nil, false, self.handleWebsocketError(err)
 	}
@@ -20,6 +20,9 @@ type WSHandler struct {
 	serverCtx context.Context
 	// options
 	SpawnGoroutine bool
+	Session        SessionConfig
+
+	sessions sessionRegistry
 }
 
 type WSSession struct {
@@ -27,9 +30,9 @@ type WSSession struct {
 	ws          *websocket.Conn
 	httpRequest *http.Request
 	rootCtx     context.Context
-	done        chan error
-	sendChannel chan jlib.Message
+	stream      *streamSession
 	sessionId   string
+	authState   *sessionAuth
 }
 
 func NewWSHandler(serverCtx context.Context, actor *Actor) *WSHandler {
@@ -58,15 +61,23 @@ func (self *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		rootCtx:     r.Context(),
 		httpRequest: r,
 		ws:          ws,
-		done:        make(chan error, 10),
-		sendChannel: make(chan jlib.Message, 100),
+		stream:      newStreamSession(self.Session),
 		sessionId:   jlib.NewUuid(),
+		authState:   &sessionAuth{},
 	}
+	self.sessions.add(session.sessionId, session.stream)
+	self.Actor.startSession(r, session)
 	defer func() {
+		self.sessions.remove(session.sessionId)
+		session.authState.unbind()
 		self.Actor.HandleClose(r, session)
 	}()
 	session.wait()
-	session.server = nil
+}
+
+// Stats sums up the stats of live sessions
+func (self *WSHandler) Stats() SessionStats {
+	return self.sessions.stats()
 }
 
 // websocket session
@@ -77,29 +88,25 @@ func (self *WSSession) wait() {
 	serverCtx, cancelServer := context.WithCancel(self.server.serverCtx)
 	defer cancelServer()
 
-	go self.sendLoop()
+	go self.stream.sendLoop(connCtx, self.write)
 	go self.recvLoop()
 
-	for {
-		select {
-		case <-connCtx.Done():
-			return
-		case <-serverCtx.Done():
-			return
-		case err, ok := <-self.done:
-			if ok && err != nil {
-				log.Warnf("websocket error %s", err)
-			}
-			return
+	select {
+	case <-connCtx.Done():
+	case <-serverCtx.Done():
+	case <-self.stream.closed:
+		if err := self.stream.err(); err != nil {
+			log.Warnf("websocket error %s", err)
 		}
 	}
+	self.stream.close(nil)
 }
 
 func (self *WSSession) recvLoop() {
 	for {
 		messageType, msgBytes, err := self.ws.ReadMessage()
 		if err != nil {
-			self.done <- errors.Wrap(err, "ws.ReadMessage()")
+			self.stream.close(errors.Wrap(err, "ws.ReadMessage()"))
 			return
 		}
 		if messageType != websocket.TextMessage {
@@ -107,22 +114,17 @@ func (self *WSSession) recvLoop() {
 			continue
 		}
 
-		if self.server.SpawnGoroutine {
-			go self.msgBytesReceived(msgBytes)
-		} else {
-			self.msgBytesReceived(msgBytes)
+		msg, err := jlib.ParseBytesWithOptions(msgBytes, self.server.Actor.DecodeOptions)
+		if err != nil {
+			log.Warnf("bad jsonrpc message %s", msgBytes)
+			self.Send(jlib.NewDecodeErrorMessage(err))
+			continue
 		}
+		self.stream.dispatch(msg, self.server.SpawnGoroutine, self.msgReceived)
 	}
 }
 
-func (self *WSSession) msgBytesReceived(msgBytes []byte) {
-	msg, err := jlib.ParseBytes(msgBytes)
-	if err != nil {
-		log.Warnf("bad jsonrpc message %s", msgBytes)
-		self.done <- errors.New("bad jsonrpc message")
-		return
-	}
-
+func (self *WSSession) msgReceived(msg jlib.Message) {
 	req := NewRPCRequest(
 		self.rootCtx,
 		msg,
@@ -132,51 +134,53 @@ func (self *WSSession) msgBytesReceived(msgBytes []byte) {
 
 	resmsg, err := self.server.Actor.Feed(req)
 	if err != nil {
-		self.done <- errors.Wrap(err, "actor.Feed")
+		self.stream.close(errors.Wrap(err, "actor.Feed"))
 		return
 	}
 	if resmsg != nil {
-		if resmsg.IsResultOrError() {
-			self.sendChannel <- resmsg
-		} else {
-			self.Send(resmsg)
-		}
+		self.Send(resmsg)
 	}
 }
 
+// Send queues a message to the peer, what happens when the queue is
+// full depends on the SendPolicy
 func (self *WSSession) Send(msg jlib.Message) {
-	self.sendChannel <- msg
+	self.stream.enqueue(msg)
+}
+
+// Call calls a request to the peer and waits for the result
+func (self *WSSession) Call(ctx context.Context, reqmsg *jlib.RequestMessage) (jlib.Message, error) {
+	return self.stream.call(ctx, reqmsg)
+}
+
+// Stats returns the stats of the session
+func (self *WSSession) Stats() SessionStats {
+	return self.stream.stats()
 }
 
 func (self WSSession) SessionID() string {
 	return self.sessionId
 }
 
-func (self *WSSession) sendLoop() {
-	ctx, cancel := context.WithCancel(self.rootCtx)
-	defer cancel()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case msg, ok := <-self.sendChannel:
-			if !ok {
-				return
-			}
-			if self.ws == nil {
-				return
-			}
-			marshaled, err := jlib.MessageBytes(msg)
-			if err != nil {
-				log.Warnf("marshal msg error %s", err)
-				return
-			}
-
-			if err := self.ws.WriteMessage(websocket.TextMessage, marshaled); err != nil {
-				log.Warnf("write warning message %s", err)
-				return
-			}
-		}
+func (self *WSSession) write(msg jlib.Message) error {
+	marshaled, err := jlib.MessageBytes(msg)
+	if err != nil {
+		return errors.Wrap(err, "marshal msg")
+	}
+	if err := self.ws.SetWriteDeadline(self.stream.writeDeadline()); err != nil {
+		return errors.Wrap(err, "ws.SetWriteDeadline()")
 	}
+	if err := self.ws.WriteMessage(websocket.TextMessage, marshaled); err != nil {
+		return errors.Wrap(err, "ws.WriteMessage()")
+	}
+	return nil
+}
+
+func (self *WSSession) sessionAuth() *sessionAuth {
+	return self.authState
+}
+
+// Close the session
+func (self *WSSession) Close() {
+	self.stream.close(errors.New("session closed"))
 }
@@ -1,7 +1,10 @@
 package jlib
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"io"
@@ -281,3 +284,484 @@ func TestMessages(t *testing.T) {
 	assert.True(NewNotifyMessage("aaa", nil).paramsAreList)
 
 }
+
+func TestBatchMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	j1 := `[
+{"jsonrpc": "2.0", "id": 1, "method": "add", "params": [1, 2]},
+{"jsonrpc": "2.0", "method": "log", "params": ["hello"]},
+{"jsonrpc": "2.0", "id": "bad1", "method": 5, "params": [1]},
+{"foo": "bar"},
+3
+]`
+	msg, err := ParseBytes([]byte(j1))
+	assert.Nil(err)
+	assert.True(msg.IsBatch())
+	assert.False(msg.IsRequestOrNotify())
+	assert.False(msg.IsResultOrError())
+
+	batch, ok := msg.(*BatchMessage)
+	assert.True(ok)
+	assert.Equal(5, len(batch.Messages))
+
+	assert.True(batch.Messages[0].IsRequest())
+	assert.Equal(1, batch.Messages[0].MustId())
+	assert.True(batch.Messages[1].IsNotify())
+
+	// malformed elements are turned into invalid request errors
+	assert.True(batch.Messages[2].IsError())
+	assert.Equal("bad1", batch.Messages[2].MustId())
+	assert.Equal(ErrInvalidRequest.Code, batch.Messages[2].MustError().Code)
+	assert.True(batch.Messages[3].IsError())
+	assert.Nil(batch.Messages[3].MustId())
+	assert.True(batch.Messages[4].IsError())
+	assert.Nil(batch.Messages[4].MustId())
+
+	msgtype, _ := msg.Log().Data["msgtype"]
+	assert.Equal("batch", msgtype)
+
+	// re-encode
+	batch1 := NewBatchMessage([]Message{
+		NewRequestMessage(10, "add", []interface{}{5, 6}),
+		NewNotifyMessage("log", []interface{}{"hi"}),
+	})
+	data, err := MessageBytes(batch1)
+	assert.Nil(err)
+	assert.Equal(`[{"jsonrpc":"2.0","method":"add","id":10,"params":[5,6]},{"jsonrpc":"2.0","method":"log","params":["hi"]}]`, string(data))
+
+	msg2, err := ParseBytes(data)
+	assert.Nil(err)
+	batch2, _ := msg2.(*BatchMessage)
+	assert.Equal(2, len(batch2.Messages))
+	assert.Equal("add", batch2.Messages[0].MustMethod())
+	assert.Equal("log", batch2.Messages[1].MustMethod())
+
+	// empty batch
+	_, err = ParseBytes([]byte(`[]`))
+	assert.NotNil(err)
+	assert.Equal("error decode: empty batch", err.Error())
+
+	// nested batch is not allowed
+	assert.Panics(func() {
+		NewBatchMessage([]Message{batch1})
+	})
+}
+
+func TestDecodeBatchStream(t *testing.T) {
+	assert := assert.New(t)
+
+	input := `
+{"id": 1, "method": "single", "params": []}
+[{"id": 2, "result": "ok"}, {"id": 3, "error": {"code": -32601, "message": "method not found"}}]
+`
+	dec := json.NewDecoder(strings.NewReader(input))
+
+	msg1, err := DecodeMessage(dec)
+	assert.Nil(err)
+	assert.True(msg1.IsRequest())
+
+	msg2, err := DecodeMessage(dec)
+	assert.Nil(err)
+	assert.True(msg2.IsBatch())
+	batch, _ := msg2.(*BatchMessage)
+	assert.True(batch.Messages[0].IsResult())
+	assert.Equal("ok", batch.Messages[0].MustResult())
+	assert.True(batch.Messages[1].IsError())
+	assert.Equal(3, batch.Messages[1].MustId())
+
+	_, err = DecodeMessage(dec)
+	assert.Equal(io.EOF, err)
+}
+
+func TestNamedParams(t *testing.T) {
+	assert := assert.New(t)
+
+	j1 := `{"jsonrpc":"2.0","method":"greet","id":1,"params":{"age":8,"name":"jake"}}`
+	msg, err := ParseBytes([]byte(j1))
+	assert.Nil(err)
+	named := msg.NamedParams()
+	assert.Equal("jake", named["name"])
+	assert.Equal(json.Number("8"), named["age"])
+
+	// round trip keeps the params as an object
+	assert.Equal(j1, MessageString(msg))
+	reqmsg, _ := msg.(*RequestMessage)
+	assert.Equal(`{"jsonrpc":"2.0","method":"greet","id":2,"params":{"age":8,"name":"jake"}}`, MessageString(reqmsg.Clone(2)))
+
+	msg1, err := ParseBytes([]byte(`{"method":"greet","params":["jake", 8]}`))
+	assert.Nil(err)
+	assert.Nil(msg1.NamedParams())
+
+	type greeting struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+	ntfmsg := NewNotifyMessage("greet", greeting{Name: "jim", Age: 9})
+	named2 := ntfmsg.NamedParams()
+	assert.Equal("jim", named2["name"])
+	assert.Equal(json.Number("9"), named2["age"])
+
+	resmsg := NewResultMessage(reqmsg, "ok")
+	assert.Panics(func() {
+		resmsg.NamedParams()
+	})
+}
+
+func TestStrictDecode(t *testing.T) {
+	assert := assert.New(t)
+
+	strict := DecodeOptions{Strict: true}
+
+	// params can be omitted in strict mode
+	msg, err := ParseBytesWithOptions([]byte(`{"jsonrpc": "2.0", "id": 1, "method": "list"}`), strict)
+	assert.Nil(err)
+	assert.True(msg.IsRequest())
+	assert.Equal(0, len(msg.MustParams()))
+
+	msg, err = ParseBytesWithOptions([]byte(`{"jsonrpc": "2.0", "id": null, "error": {"code": -32700, "message": "parse error"}}`), strict)
+	assert.Nil(err)
+	assert.True(msg.IsError())
+	assert.Nil(msg.MustId())
+
+	cases := []struct {
+		input  string
+		code   int
+		id     interface{}
+		errmsg string
+	}{
+		{`{"id": 1, "method": "list", "params": []}`, -32600, 1, "jsonrpc version is not 2.0"},
+		{`{"jsonrpc": "1.0", "id": "a", "method": "list", "params": []}`, -32600, "a", "jsonrpc version is not 2.0"},
+		{`{"jsonrpc": "2.0", "id": 1.5, "method": "list", "params": []}`, -32600, nil, "id must be a string or an integer"},
+		{`{"jsonrpc": "2.0", "id": {"a": 1}, "method": "list", "params": []}`, -32600, nil, "id must be a string or an integer"},
+		{`{"jsonrpc": "2.0", "id": 2, "method": "list", "params": 5}`, -32600, 2, "params must be an array or an object"},
+		{`{"jsonrpc": "2.0", "id": 3}`, -32600, 3, "no result or error field"},
+		{`{"jsonrpc": "2.0", "result": 3}`, -32600, nil, "no id field"},
+		{`{"jsonrpc": "2.0", "id": 4, "error": {"message": "no code"}}`, -32600, 4, "error object requires code and message"},
+		{`{"jsonrpc": "2.0", "id": 5, "method": 8}`, -32600, 5, "method must be a string"},
+		{`{"jsonrpc": "2.0", "id": 6, "method": "list"`, -32700, nil, "unexpected EOF"},
+	}
+
+	for _, c := range cases {
+		_, err := ParseBytesWithOptions([]byte(c.input), strict)
+		assert.NotNil(err, c.input)
+		errmsg := NewDecodeErrorMessage(err)
+		assert.Equal(c.code, errmsg.Error.Code, c.input)
+		assert.Equal(c.id, errmsg.Id, c.input)
+		assert.Equal(c.errmsg, errmsg.Error.Data, c.input)
+	}
+
+	// the same messages are accepted in non-strict mode
+	msg, err = ParseBytes([]byte(`{"id": 3}`))
+	assert.Nil(err)
+	assert.True(msg.IsResult())
+
+	// elements of a batch are checked one by one
+	msg, err = ParseBytesWithOptions([]byte(`[{"jsonrpc": "2.0", "id": 1, "method": "list"}, {"id": 2, "method": "list"}]`), strict)
+	assert.Nil(err)
+	batch, _ := msg.(*BatchMessage)
+	assert.True(batch.Messages[0].IsRequest())
+	assert.True(batch.Messages[1].IsError())
+	assert.Equal(2, batch.Messages[1].MustId())
+}
+
+func TestCodecCompatible(t *testing.T) {
+	assert := assert.New(t)
+
+	errmsg := rawErrorMessage(5, ErrMethodNotFound.WithData(map[string]interface{}{"b": 1.5e-9, "a": []interface{}{true, nil}}))
+	errmsg.SetTraceId("tr<1>")
+	msgs := []Message{
+		NewRequestMessage(1, "add", []interface{}{1, 2.5, "hi \"there\"\n", json.Number("30")}),
+		NewRequestMessage("abc", "query", map[string]interface{}{"q": "a&b", "limit": 10}),
+		NewNotifyMessage("log", []interface{}{"中文", " ", "\x01", int64(-7), 1e21}),
+		rawResultMessage(2, map[string]interface{}{"z": nil, "y": []interface{}{}}),
+		rawResultMessage("x", nil),
+		errmsg,
+		NewBatchMessage([]Message{
+			NewNotifyMessage("ping", nil),
+			rawResultMessage(3, uint(9)),
+		}),
+	}
+
+	for _, msg := range msgs {
+		expect, err := json.Marshal(msg.Interface())
+		assert.Nil(err)
+		data, err := MessageBytes(msg)
+		assert.Nil(err)
+		assert.Equal(string(expect), string(data))
+
+		// decoded messages are encoded from the raw bytes
+		msg1, err := ParseBytes(data)
+		assert.Nil(err)
+		data1, err := MessageBytes(msg1)
+		assert.Nil(err)
+		assert.Equal(string(expect), string(data1))
+	}
+}
+
+func TestLazyDecode(t *testing.T) {
+	assert := assert.New(t)
+
+	data := []byte(`{"jsonrpc": "2.0", "id": 1, "method": "add", "params": [1, {"a": "<b>"}]}`)
+	lazy := DecodeOptions{LazyValues: true}
+
+	// the params are decoded by default
+	msg, err := ParseBytes(data)
+	assert.Nil(err)
+	reqmsg, _ := msg.(*RequestMessage)
+	assert.Equal([]interface{}{json.Number("1"), map[string]interface{}{"a": "<b>"}}, reqmsg.Params)
+	assert.Nil(reqmsg.rawParams)
+	resmsg, err := ParseBytes([]byte(`{"jsonrpc": "2.0", "id": 1, "result": [1, 2]}`))
+	assert.Nil(err)
+	assert.Equal([]interface{}{json.Number("1"), json.Number("2")}, resmsg.(*ResultMessage).Result)
+
+	msg, err = ParseBytesWithOptions(data, lazy)
+	assert.Nil(err)
+	reqmsg, _ = msg.(*RequestMessage)
+	assert.Nil(reqmsg.Params)
+	assert.NotNil(reqmsg.rawParams)
+
+	// whitespaces are elided and html characters are escaped
+	assert.Equal(`{"jsonrpc":"2.0","method":"add","id":1,"params":[1,{"a":"\u003cb\u003e"}]}`, MessageString(msg))
+
+	params := msg.MustParams()
+	assert.Equal(2, len(params))
+	assert.Equal(json.Number("1"), params[0])
+
+	// cloned messages share the raw params
+	msg1 := msg.ReplaceId(2)
+	assert.Equal(params, msg1.MustParams())
+
+	resmsg, err = ParseBytesWithOptions([]byte(`{"jsonrpc": "2.0", "id": 1, "result": {"value": 3}}`), lazy)
+	assert.Nil(err)
+	assert.Nil(resmsg.(*ResultMessage).Result)
+	res, _ := resmsg.MustResult().(map[string]interface{})
+	assert.Equal(json.Number("3"), res["value"])
+	assert.Equal(res, resmsg.ReplaceId(2).MustResult())
+
+	// keys are matched case insensitively
+	msg2, err := ParseBytes([]byte(`{"ID": 3, "Method": "add", "params": []}`))
+	assert.Nil(err)
+	assert.True(msg2.IsRequest())
+	assert.Equal(3, msg2.MustId())
+
+	_, err = ParseBytes([]byte(`[1, 2`))
+	assert.NotNil(err)
+	assert.Equal(ErrParseMessage.Code, NewDecodeErrorMessage(err).Error.Code)
+}
+
+var benchRequest = []byte(`{"jsonrpc":"2.0","method":"query","id":1001,"params":["users",{"name":"jake","age":8,"tags":["a","b","c"]},true,3.14],"traceid":"e3b0c442"}`)
+
+func BenchmarkParseBytes(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseBytes(benchRequest); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseBytesLazy(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseBytesWithOptions(benchRequest, DecodeOptions{LazyValues: true}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseBytesReflect(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var m map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(benchRequest))
+		dec.UseNumber()
+		if err := dec.Decode(&m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMessageBytes(b *testing.B) {
+	msg := NewRequestMessage(1001, "query", []interface{}{"users", map[string]interface{}{"name": "jake", "age": 8, "tags": []interface{}{"a", "b", "c"}}, true, 3.14})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := MessageBytes(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMessageBytesReflect(b *testing.B) {
+	msg := NewRequestMessage(1001, "query", []interface{}{"users", map[string]interface{}{"name": "jake", "age": 8, "tags": []interface{}{"a", "b", "c"}}, true, 3.14})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(msg.Interface()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkForward(b *testing.B) {
+	// decode and encode a message without touching params, like
+	// what a gateway does
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg, err := ParseBytesWithOptions(benchRequest, DecodeOptions{LazyValues: true})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := MessageBytes(msg.ReplaceId(2002)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeInto(t *testing.T) {
+	assert := assert.New(t)
+
+	msg, err := ParseBytes([]byte(`{"jsonrpc": "2.0", "id": 1, "method": "transfer", "params": [123456789012345678901234567890, "alice"]}`))
+	assert.Nil(err)
+
+	var params []json.RawMessage
+	err = msg.DecodeParamsInto(&params)
+	assert.Nil(err)
+	assert.Equal(2, len(params))
+
+	// json.Unmarshaler implementations are respected
+	var amount Bigint
+	err = json.Unmarshal(params[0], &amount)
+	assert.Nil(err)
+	assert.Equal("123456789012345678901234567890", amount.String())
+
+	// named params
+	msg1 := NewNotifyMessage("transfer", map[string]interface{}{"to": "bob", "amount": json.Number("99999999999999999999")})
+	var named struct {
+		To     string  `json:"to"`
+		Amount *Bigint `json:"amount"`
+	}
+	err = msg1.DecodeParamsInto(&named)
+	assert.Nil(err)
+	assert.Equal("bob", named.To)
+	assert.Equal("99999999999999999999", named.Amount.String())
+
+	resmsg, err := ParseBytes([]byte(`{"jsonrpc": "2.0", "id": 1, "result": {"to": "carol", "amount": "12"}}`))
+	assert.Nil(err)
+	err = resmsg.DecodeResultInto(&named)
+	assert.Nil(err)
+	assert.Equal("carol", named.To)
+	assert.Equal("12", named.Amount.String())
+
+	var res1 []int
+	err = NewResultMessage(msg, []interface{}{1, 2}).DecodeResultInto(&res1)
+	assert.Nil(err)
+	assert.Equal([]int{1, 2}, res1)
+
+	// wrong message kinds
+	assert.NotNil(resmsg.DecodeParamsInto(&params))
+	assert.NotNil(msg.DecodeResultInto(&res1))
+}
+
+type quotaError struct {
+	Limit int `json:"limit"`
+}
+
+func (self *quotaError) Error() string {
+	return fmt.Sprintf("quota exceeded, limit %d", self.Limit)
+}
+
+func TestErrorRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	errNotFound := errors.New("not found")
+
+	registry := NewErrorRegistry()
+	assert.NotNil(registry.RegisterRange("json", -32100, -32000))
+	assert.NotNil(registry.RegisterRange("http", 100, 999))
+	assert.NotNil(registry.RegisterSentinel(errNotFound, 1001, ""))
+	assert.Nil(registry.RegisterRange("store", 1000, 1099))
+	assert.NotNil(registry.RegisterRange("other", 1050, 1200))
+	assert.Nil(registry.RegisterSentinel(errNotFound, 1001, ""))
+	assert.NotNil(registry.RegisterSentinel(errors.New("dup"), 1001, ""))
+	assert.Nil(RegisterErrorType[*quotaError](registry, 1002, ""))
+
+	// forward mapping
+	rpcErr, ok := registry.ToRPCError(errors.Wrap(errNotFound, "get user"))
+	assert.True(ok)
+	assert.Equal(1001, rpcErr.Code)
+	assert.Equal("not found", rpcErr.Message)
+
+	rpcErr, ok = registry.ToRPCError(&quotaError{Limit: 5})
+	assert.True(ok)
+	assert.Equal(1002, rpcErr.Code)
+	assert.Equal("quota exceeded, limit 5", rpcErr.Message)
+
+	rpcErr, ok = registry.ToRPCError(ErrTimeout)
+	assert.True(ok)
+	assert.Equal(ErrTimeout, rpcErr)
+
+	_, ok = registry.ToRPCError(errors.New("unknown"))
+	assert.False(ok)
+
+	// reverse mapping, data is carried by json
+	errmsg, err := ParseBytes([]byte(`{"jsonrpc": "2.0", "id": 1, "error": {"code": 1002, "message": "quota exceeded, limit 7", "data": {"limit": 7}}}`))
+	assert.Nil(err)
+	err = registry.FromRPCError(errmsg.MustError())
+	var qe *quotaError
+	assert.True(errors.As(err, &qe))
+	assert.Equal(7, qe.Limit)
+	var rpcErr1 *RPCError
+	assert.True(errors.As(err, &rpcErr1))
+	assert.Equal(1002, rpcErr1.Code)
+
+	err = registry.FromRPCError(&RPCError{1001, "not found", nil})
+	assert.True(errors.Is(err, errNotFound))
+
+	err = registry.FromRPCError(ErrMethodNotFound)
+	assert.Equal(ErrMethodNotFound, err)
+}
+
+func TestMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	reqmsg := NewRequestMessage(1, "query", []interface{}{"a"})
+	reqmsg.SetMeta("tenant", "t1")
+	reqmsg.SetMeta("deadline", "100")
+	assert.Equal(`{"jsonrpc":"2.0","method":"query","id":1,"params":["a"],"metadata":{"deadline":"100","tenant":"t1"}}`, MessageString(reqmsg))
+
+	msg, err := ParseBytes([]byte(MessageString(reqmsg)))
+	assert.Nil(err)
+	assert.Equal("t1", msg.Metadata().Get("tenant"))
+	assert.Equal("100", msg.Metadata().Get("deadline"))
+
+	// cloned messages carry copies of metadata
+	msg1 := msg.ReplaceId(2)
+	msg1.SetMeta("tenant", "t2")
+	assert.Equal("t1", msg.Metadata().Get("tenant"))
+	assert.Equal("t2", msg1.Metadata().Get("tenant"))
+
+	m, err := MessageMap(msg)
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{"tenant": "t1", "deadline": "100"}, m["metadata"])
+
+	// values which are not strings are dropped
+	msg2, err := ParseBytes([]byte(`{"id": 1, "result": 5, "metadata": {"a": "b", "c": 1}}`))
+	assert.Nil(err)
+	assert.Equal(Metadata{"a": "b"}, msg2.Metadata())
+
+	_, err = ParseBytesWithOptions([]byte(`{"jsonrpc": "2.0", "id": 1, "result": 5, "metadata": {"c": 1}}`), DecodeOptions{Strict: true})
+	assert.NotNil(err)
+	assert.Equal("error decode: metadata values must be strings", err.Error())
+
+	// the key is configurable
+	MetadataKey = "_meta"
+	defer func() { MetadataKey = "metadata" }()
+	ntfmsg := NewNotifyMessage("log", nil)
+	ntfmsg.SetMeta("k", "v")
+	assert.Equal(`{"jsonrpc":"2.0","method":"log","params":[],"_meta":{"k":"v"}}`, MessageString(ntfmsg))
+	msg3, err := ParseBytes([]byte(MessageString(ntfmsg)))
+	assert.Nil(err)
+	assert.Equal("v", msg3.Metadata().Get("k"))
+}
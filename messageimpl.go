@@ -3,6 +3,7 @@ package jlib
 // implementations of message kinds
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
@@ -71,15 +72,22 @@ func (self BaseMessage) IsResultOrError() bool {
 	return self.IsResult() || self.IsError()
 }
 
+// IsBatch() returns if the message is a BatchMessage
+func (self BaseMessage) IsBatch() bool {
+	return self.kind == MKBatch
+}
+
 // Message methods
 func EncodePretty(msg Message) (string, error) {
-	v := msg.Interface()
-	bytes, err := json.MarshalIndent(v, "", "  ")
-	//bytes, err := MessageJson(msg).EncodePretty()
+	data, err := MessageBytes(msg)
 	if err != nil {
-		return "", errors.Wrap(err, "json.MarshalIndent")
+		return "", errors.Wrap(err, "MessageBytes")
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return "", errors.Wrap(err, "json.Indent")
 	}
-	return string(bytes), nil
+	return buf.String(), nil
 }
 
 func MessageString(msg Message) string {
@@ -91,8 +99,7 @@ func MessageString(msg Message) string {
 }
 
 func MessageBytes(msg Message) ([]byte, error) {
-	v := msg.Interface()
-	return json.Marshal(v)
+	return appendMessage(make([]byte, 0, 128), msg)
 }
 
 func MessageMap(msg Message) (map[string]interface{}, error) {
@@ -101,9 +108,15 @@ func MessageMap(msg Message) (map[string]interface{}, error) {
 	err := DecodeInterface(v, &m)
 	if err != nil {
 		return nil, err
-	} else {
-		return m, nil
 	}
+	if md := msg.Metadata(); len(md) > 0 {
+		mdmap := make(map[string]interface{}, len(md))
+		for k, v := range md {
+			mdmap[k] = v
+		}
+		m[MetadataKey] = mdmap
+	}
+	return m, nil
 }
 
 func (self *BaseMessage) SetTraceId(traceId string) {
@@ -114,6 +127,38 @@ func (self BaseMessage) TraceId() string {
 	return self.traceId
 }
 
+func (self BaseMessage) Metadata() Metadata {
+	return self.metadata
+}
+
+func (self *BaseMessage) SetMetadata(md Metadata) {
+	self.metadata = md
+}
+
+func (self *BaseMessage) SetMeta(key string, value string) {
+	if self.metadata == nil {
+		self.metadata = make(Metadata)
+	}
+	self.metadata[key] = value
+}
+
+// Get returns the value of key, or empty string if key is absent
+func (self Metadata) Get(key string) string {
+	return self[key]
+}
+
+// Clone returns a copy of metadata
+func (self Metadata) Clone() Metadata {
+	if self == nil {
+		return nil
+	}
+	md := make(Metadata, len(self))
+	for k, v := range self {
+		md[k] = v
+	}
+	return md
+}
+
 // Log
 func (self RequestMessage) Log() *log.Entry {
 	return log.WithFields(log.Fields{
@@ -146,6 +191,14 @@ func (self ErrorMessage) Log() *log.Entry {
 	})
 }
 
+func (self BatchMessage) Log() *log.Entry {
+	return log.WithFields(log.Fields{
+		"traceid": self.traceId,
+		"msgtype": "batch",
+		"size":    len(self.Messages),
+	})
+}
+
 func (self RequestMessage) ReplaceId(newId interface{}) Message {
 	return self.Clone(newId)
 }
@@ -156,16 +209,23 @@ func (self NotifyMessage) ReplaceId(newId interface{}) Message {
 
 func (self ResultMessage) ReplaceId(newId interface{}) Message {
 	resmsg := rawResultMessage(newId, self.Result)
+	resmsg.rawResult = self.rawResult
 	resmsg.SetTraceId(self.TraceId())
+	resmsg.SetMetadata(self.metadata.Clone())
 	return resmsg
 }
 
 func (self ErrorMessage) ReplaceId(newId interface{}) Message {
 	errmsg := rawErrorMessage(newId, self.Error)
 	errmsg.SetTraceId(self.TraceId())
+	errmsg.SetMetadata(self.metadata.Clone())
 	return errmsg
 }
 
+func (self BatchMessage) ReplaceId(newId interface{}) Message {
+	panic(NewErrMsgType("ReplaceId"))
+}
+
 // Must methods
 
 // MustId
@@ -181,6 +241,9 @@ func (self ResultMessage) MustId() interface{} {
 func (self ErrorMessage) MustId() interface{} {
 	return self.Id
 }
+func (self BatchMessage) MustId() interface{} {
+	panic(NewErrMsgType("MustId"))
+}
 
 // MustMethod
 func (self RequestMessage) MustMethod() string {
@@ -196,13 +259,16 @@ func (self ResultMessage) MustMethod() string {
 func (self ErrorMessage) MustMethod() string {
 	panic(NewErrMsgType("MustMethod"))
 }
+func (self BatchMessage) MustMethod() string {
+	panic(NewErrMsgType("MustMethod"))
+}
 
 // MustParams
 func (self RequestMessage) MustParams() []interface{} {
-	return self.Params
+	return loadParams(self.Params, self.rawParams, self.paramsAreList)
 }
 func (self NotifyMessage) MustParams() []interface{} {
-	return self.Params
+	return loadParams(self.Params, self.rawParams, self.paramsAreList)
 }
 func (self ResultMessage) MustParams() []interface{} {
 	panic(NewErrMsgType("MustParams"))
@@ -210,6 +276,63 @@ func (self ResultMessage) MustParams() []interface{} {
 func (self ErrorMessage) MustParams() []interface{} {
 	panic(NewErrMsgType("MustParams"))
 }
+func (self BatchMessage) MustParams() []interface{} {
+	panic(NewErrMsgType("MustParams"))
+}
+
+// NamedParams
+func (self RequestMessage) NamedParams() map[string]interface{} {
+	return namedParams(self.MustParams(), self.paramsAreList)
+}
+func (self NotifyMessage) NamedParams() map[string]interface{} {
+	return namedParams(self.MustParams(), self.paramsAreList)
+}
+func (self ResultMessage) NamedParams() map[string]interface{} {
+	panic(NewErrMsgType("NamedParams"))
+}
+func (self ErrorMessage) NamedParams() map[string]interface{} {
+	panic(NewErrMsgType("NamedParams"))
+}
+func (self BatchMessage) NamedParams() map[string]interface{} {
+	panic(NewErrMsgType("NamedParams"))
+}
+
+// loadParams returns the params, decode them from the raw json if
+// they are not decoded yet
+func loadParams(params []interface{}, raw *rawValue, paramsAreList bool) []interface{} {
+	if params != nil || raw == nil {
+		return params
+	}
+	v := raw.load()
+	if paramsAreList {
+		if arr, ok := v.([]interface{}); ok {
+			return arr
+		}
+		return []interface{}{}
+	}
+	return []interface{}{v}
+}
+
+func namedParams(params []interface{}, paramsAreList bool) map[string]interface{} {
+	if paramsAreList || len(params) != 1 {
+		return nil
+	}
+	if m, ok := params[0].(map[string]interface{}); ok {
+		return m
+	}
+	// params object may be a struct, convert it into map
+	data, err := json.Marshal(params[0])
+	if err != nil {
+		return nil
+	}
+	var m map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil
+	}
+	return m
+}
 
 // MustResult
 func (self RequestMessage) MustResult() interface{} {
@@ -219,11 +342,83 @@ func (self NotifyMessage) MustResult() interface{} {
 	panic(NewErrMsgType("MustResult"))
 }
 func (self ResultMessage) MustResult() interface{} {
+	if self.Result == nil && self.rawResult != nil {
+		return self.rawResult.load()
+	}
 	return self.Result
 }
 func (self ErrorMessage) MustResult() interface{} {
 	panic(NewErrMsgType("MustResult"))
 }
+func (self BatchMessage) MustResult() interface{} {
+	panic(NewErrMsgType("MustResult"))
+}
+
+// DecodeParamsInto
+func (self RequestMessage) DecodeParamsInto(v interface{}) error {
+	return decodeParamsInto(self.Params, self.rawParams, self.paramsAreList, v)
+}
+func (self NotifyMessage) DecodeParamsInto(v interface{}) error {
+	return decodeParamsInto(self.Params, self.rawParams, self.paramsAreList, v)
+}
+func (self ResultMessage) DecodeParamsInto(v interface{}) error {
+	return NewErrMsgType("DecodeParamsInto")
+}
+func (self ErrorMessage) DecodeParamsInto(v interface{}) error {
+	return NewErrMsgType("DecodeParamsInto")
+}
+func (self BatchMessage) DecodeParamsInto(v interface{}) error {
+	return NewErrMsgType("DecodeParamsInto")
+}
+
+func decodeParamsInto(params []interface{}, raw *rawValue, paramsAreList bool, v interface{}) error {
+	if params == nil && raw != nil {
+		return decodeJsonInto(raw.data, v)
+	}
+	var data []byte
+	var err error
+	if paramsAreList || len(params) == 0 {
+		data, err = appendValue(nil, params)
+	} else {
+		data, err = appendValue(nil, params[0])
+	}
+	if err != nil {
+		return err
+	}
+	return decodeJsonInto(data, v)
+}
+
+// DecodeResultInto
+func (self RequestMessage) DecodeResultInto(v interface{}) error {
+	return NewErrMsgType("DecodeResultInto")
+}
+func (self NotifyMessage) DecodeResultInto(v interface{}) error {
+	return NewErrMsgType("DecodeResultInto")
+}
+func (self ResultMessage) DecodeResultInto(v interface{}) error {
+	if self.Result == nil && self.rawResult != nil {
+		return decodeJsonInto(self.rawResult.data, v)
+	}
+	data, err := appendValue(nil, self.Result)
+	if err != nil {
+		return err
+	}
+	return decodeJsonInto(data, v)
+}
+func (self ErrorMessage) DecodeResultInto(v interface{}) error {
+	return NewErrMsgType("DecodeResultInto")
+}
+func (self BatchMessage) DecodeResultInto(v interface{}) error {
+	return NewErrMsgType("DecodeResultInto")
+}
+
+// decode json data into v, numbers are decoded as json.Number when
+// v is an interface
+func decodeJsonInto(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
 
 // MustError
 func (self RequestMessage) MustError() *RPCError {
@@ -238,6 +433,9 @@ func (self ResultMessage) MustError() *RPCError {
 func (self ErrorMessage) MustError() *RPCError {
 	return self.Error
 }
+func (self BatchMessage) MustError() *RPCError {
+	panic(NewErrMsgType("MustError"))
+}
 
 // Interface
 func (self *RequestMessage) Interface() interface{} {
@@ -247,10 +445,11 @@ func (self *RequestMessage) Interface() interface{} {
 		Method:  self.Method,
 		Id:      self.Id,
 	}
-	if self.paramsAreList || len(self.Params) == 0 {
-		tmp.Params = self.Params
+	params := self.MustParams()
+	if self.paramsAreList || len(params) == 0 {
+		tmp.Params = params
 	} else {
-		tmp.Params = self.Params[0]
+		tmp.Params = params[0]
 	}
 	return tmp
 }
@@ -261,10 +460,11 @@ func (self *NotifyMessage) Interface() interface{} {
 		TraceId: self.TraceId(),
 		Method:  self.Method,
 	}
-	if self.paramsAreList || len(self.Params) == 0 {
-		tmp.Params = self.Params
+	params := self.MustParams()
+	if self.paramsAreList || len(params) == 0 {
+		tmp.Params = params
 	} else {
-		tmp.Params = self.Params[0]
+		tmp.Params = params[0]
 	}
 	return tmp
 }
@@ -274,7 +474,7 @@ func (self *ResultMessage) Interface() interface{} {
 		Jsonrpc: "2.0",
 		TraceId: self.TraceId(),
 		Id:      self.Id,
-		Result:  self.Result,
+		Result:  self.MustResult(),
 	}
 	return tmp
 }
@@ -289,6 +489,14 @@ func (self *ErrorMessage) Interface() interface{} {
 	return tmp
 }
 
+func (self *BatchMessage) Interface() interface{} {
+	tmp := make([]interface{}, len(self.Messages))
+	for i, msg := range self.Messages {
+		tmp[i] = msg.Interface()
+	}
+	return tmp
+}
+
 func NewRequestMessage(id interface{}, method string, params interface{}) *RequestMessage {
 	if id == nil {
 		panic(ErrNilId)
@@ -319,12 +527,24 @@ func NewRequestMessage(id interface{}, method string, params interface{}) *Reque
 
 func (self RequestMessage) Clone(newId interface{}) *RequestMessage {
 	newReq := NewRequestMessage(newId, self.Method, self.Params)
+	newReq.setRawParams(self.rawParams, self.paramsAreList)
 	newReq.SetTraceId(self.traceId)
+	newReq.SetMetadata(self.metadata.Clone())
 	return newReq
 }
 
+// setRawParams makes the params decoded from raw on demand, raw may
+// be nil for empty params
+func (self *RequestMessage) setRawParams(raw *rawValue, paramsAreList bool) {
+	self.paramsAreList = paramsAreList
+	if raw != nil {
+		self.Params = nil
+		self.rawParams = raw
+	}
+}
+
 func (self RequestMessage) CacheKey(prefix string) string {
-	paramBytes, err := json.Marshal(self.Params)
+	paramBytes, err := json.Marshal(self.MustParams())
 	if err != nil {
 		panic(err)
 	}
@@ -355,6 +575,36 @@ func NewNotifyMessage(method string, params interface{}) *NotifyMessage {
 	return msg
 }
 
+// setRawParams makes the params decoded from raw on demand, raw may
+// be nil for empty params
+func (self *NotifyMessage) setRawParams(raw *rawValue, paramsAreList bool) {
+	self.paramsAreList = paramsAreList
+	if raw != nil {
+		self.Params = nil
+		self.rawParams = raw
+	}
+}
+
+// decode the raw params into Params
+func (self *RequestMessage) loadRawParams() {
+	self.Params = loadParams(self.Params, self.rawParams, self.paramsAreList)
+	self.rawParams = nil
+}
+
+// decode the raw params into Params
+func (self *NotifyMessage) loadRawParams() {
+	self.Params = loadParams(self.Params, self.rawParams, self.paramsAreList)
+	self.rawParams = nil
+}
+
+// decode the raw result into Result
+func (self *ResultMessage) loadRawResult() {
+	if self.Result == nil && self.rawResult != nil {
+		self.Result = self.rawResult.load()
+	}
+	self.rawResult = nil
+}
+
 func rawResultMessage(id interface{}, result interface{}) *ResultMessage {
 	msg := &ResultMessage{}
 	msg.kind = MKResult
@@ -398,3 +648,17 @@ func RPCErrorMessageFromId(reqId interface{}, traceId string, code int, message
 	errbody := &RPCError{code, message, data}
 	return NewErrorMessageFromId(reqId, traceId, errbody)
 }
+
+// NewBatchMessage creates a batch message from a list of messages,
+// nested batches are not allowed.
+func NewBatchMessage(msgs []Message) *BatchMessage {
+	msg := &BatchMessage{}
+	msg.kind = MKBatch
+	for _, elem := range msgs {
+		if elem.IsBatch() {
+			panic(NewErrMsgType("nested batch"))
+		}
+	}
+	msg.Messages = msgs
+	return msg
+}
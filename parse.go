@@ -3,24 +3,171 @@ package jlib
 import (
 	"bytes"
 	"encoding/json"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
 )
 
+// DecodeOptions controls how messages are decoded
+type DecodeOptions struct {
+	// Strict requires messages to comply with the JSONRPC 2.0
+	// spec: the jsonrpc field must be "2.0", ids must be strings
+	// or integers, a response must have an id and either a result
+	// or an error, and params must be an array or an object.
+	Strict bool
+
+	// LazyValues keeps the params and the result as raw json until
+	// they are read by MustParams(), MustResult() or the
+	// Decode*Into methods, which saves the decoding of messages only
+	// forwarded. The Params and Result fields of such messages are
+	// left nil.
+	LazyValues bool
+}
+
 func ParseBytes(data []byte) (Message, error) {
-	decoder := json.NewDecoder(bytes.NewReader(data))
-	return DecodeMessage(decoder)
+	return ParseBytesWithOptions(data, DecodeOptions{})
+}
+
+func ParseBytesWithOptions(data []byte, opts DecodeOptions) (Message, error) {
+	msg, err := decodeRaw(data, opts)
+	if err == errSyntax {
+		// let encoding/json report the syntax error
+		return nil, syntaxError(data)
+	}
+	return msg, err
+}
+
+func syntaxError(data []byte) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&raw); err != nil {
+		return err
+	}
+	return errSyntax
 }
 
+// msgUnion holds the raw fields of a message, absent fields are nil
 type msgUnion struct {
-	Id      *json.RawMessage `json:"id,omitempty"`
-	Result  *json.RawMessage `json:"result,omitempty"`
-	Error   *json.RawMessage `json:"error,omitempty"`
-	Params  *json.RawMessage `json:"params,omitempty"`
-	Method  string           `json:"method,omitempty"`
-	TraceId string           `json:"traceid,omitempty"`
+	Jsonrpc  []byte
+	Id       []byte
+	Result   []byte
+	Error    []byte
+	Params   []byte
+	Method   []byte
+	TraceId  []byte
+	Metadata []byte
+}
+
+// scanUnion scans the fields of a message object in one pass, keys
+// are matched case insensitively like encoding/json
+func scanUnion(data []byte) (*msgUnion, error) {
+	sc := scanner{data: data}
+	sc.skipSpace()
+	if sc.pos >= len(data) {
+		return nil, errSyntax
+	}
+	if data[sc.pos] != '{' {
+		if err := sc.skipValue(); err != nil {
+			return nil, err
+		}
+		return nil, errdecode("message must be an object")
+	}
+	un := &msgUnion{}
+	err := sc.object(func(key []byte, escaped bool, value []byte) error {
+		if escaped {
+			k, err := unquote(key, true)
+			if err != nil {
+				return err
+			}
+			un.set(strings.ToLower(k), value)
+		} else if !un.set(string(key[1:len(key)-1]), value) {
+			un.set(strings.ToLower(string(key[1:len(key)-1])), value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return un, nil
+}
+
+// set the field by key, returns false if the key is unknown
+func (self *msgUnion) set(key string, value []byte) bool {
+	switch key {
+	case "jsonrpc":
+		self.Jsonrpc = value
+	case "id":
+		self.Id = value
+	case "result":
+		self.Result = value
+	case "error":
+		self.Error = value
+	case "params":
+		self.Params = value
+	case "method":
+		self.Method = value
+	case "traceid":
+		self.TraceId = value
+	default:
+		if !strings.EqualFold(key, MetadataKey) {
+			return false
+		}
+		self.Metadata = value
+	}
+	return true
+}
+
+// decodeMetadata decodes the metadata object, values which are not
+// strings are dropped in non-strict mode
+func decodeMetadata(value []byte, opts DecodeOptions) (Metadata, error) {
+	if value == nil || isNull(value) {
+		return nil, nil
+	}
+	if value[0] != '{' {
+		return nil, errdecode("metadata must be an object")
+	}
+	md := make(Metadata)
+	sc := scanner{data: value}
+	err := sc.object(func(key []byte, escaped bool, v []byte) error {
+		k, err := unquote(key, escaped)
+		if err != nil {
+			return err
+		}
+		if v[0] != '"' {
+			if opts.Strict {
+				return errdecode("metadata values must be strings")
+			}
+			return nil
+		}
+		sv, err := unquote(v, bytes.IndexByte(v, '\\') >= 0)
+		if err != nil {
+			return err
+		}
+		md[k] = sv
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// decodeString decodes a string field, null is taken as empty
+func decodeString(field string, value []byte) (string, error) {
+	if value == nil || isNull(value) {
+		return "", nil
+	}
+	if value[0] != '"' {
+		return "", errdecode(field + " must be a string")
+	}
+	return unquote(value, bytes.IndexByte(value, '\\') >= 0)
 }
 
 type decodeErrorT struct {
 	errmsg string
+	// the rpc error the decode error is reported as
+	rpcErr *RPCError
+	// the id of the malformed message if it can be recovered
+	id interface{}
 }
 
 func (self decodeErrorT) Error() string {
@@ -28,131 +175,255 @@ func (self decodeErrorT) Error() string {
 }
 
 func errdecode(errmsg string) *decodeErrorT {
-	return &decodeErrorT{errmsg: errmsg}
+	return &decodeErrorT{errmsg: errmsg, rpcErr: ErrInvalidRequest}
+}
+
+// NewDecodeErrorMessage converts an error returned by ParseBytes or
+// DecodeMessage into an ErrorMessage which can be replied to the
+// peer, malformed json is reported as a parse error and a json value
+// which is not a valid message is reported as an invalid request
+// carrying the message id when it can be recovered.
+func NewDecodeErrorMessage(err error) *ErrorMessage {
+	var decErr *decodeErrorT
+	if errors.As(err, &decErr) {
+		return rawErrorMessage(decErr.id, decErr.rpcErr.WithData(decErr.errmsg))
+	}
+	return rawErrorMessage(nil, ErrParseMessage.WithData(err.Error()))
 }
 
-func decodeId(un *msgUnion) (interface{}, error) {
-	if un.Id == nil {
+func decodeId(un *msgUnion, opts DecodeOptions) (interface{}, error) {
+	if un.Id == nil || isNull(un.Id) {
 		// no id
 		return nil, nil
 	}
+	rawId := un.Id
 
-	// decode id
-	var intId int
-	if err := json.Unmarshal(*un.Id, &intId); err == nil {
-		return intId, nil
+	if rawId[0] == '"' {
+		sid, err := unquote(rawId, bytes.IndexByte(rawId, '\\') >= 0)
+		if err != nil {
+			return nil, errdecode("bad id string")
+		}
+		return sid, nil
 	}
 
-	var sid string
-	if err := json.Unmarshal(*un.Id, &sid); err != nil {
-		return nil, err
+	intId, err := strconv.Atoi(string(rawId))
+	if err != nil {
+		return nil, errdecode("id must be a string or an integer")
 	}
-
-	return sid, nil
+	return intId, nil
 }
 
-func decodeParams(un *msgUnion) (p []interface{}, islist bool, e error) {
-	if un.Params == nil {
+func decodeParams(un *msgUnion, opts DecodeOptions) (raw *rawValue, islist bool, e error) {
+	if un.Params == nil || isNull(un.Params) {
+		if opts.Strict && un.Params == nil {
+			// params may be omitted
+			return nil, true, nil
+		}
+		if opts.Strict {
+			return nil, false, errdecode("params must be an array or an object")
+		}
 		return nil, false, errdecode("no params field")
 	}
-	arr := []interface{}{}
-	dec := json.NewDecoder(bytes.NewReader(*un.Params))
-	dec.UseNumber()
-	if err := dec.Decode(&arr); err != nil {
-		var intfparams interface{}
-		idec := json.NewDecoder(bytes.NewReader(*un.Params))
-		idec.UseNumber()
-		if err := idec.Decode(&intfparams); err != nil {
-			return nil, false, err
+	if opts.Strict && un.Params[0] != '[' && un.Params[0] != '{' {
+		return nil, false, errdecode("params must be an array or an object")
+	}
+	return newRawValue(un.Params), un.Params[0] == '[', nil
+}
 
+func decodeErrorBody(data []byte, opts DecodeOptions) (*RPCError, error) {
+	if opts.Strict {
+		var strictBody struct {
+			Code    *int        `json:"code"`
+			Message *string     `json:"message"`
+			Data    interface{} `json:"data,omitempty"`
+		}
+		errdec := json.NewDecoder(bytes.NewReader(data))
+		errdec.UseNumber()
+		if err := errdec.Decode(&strictBody); err != nil {
+			return nil, errdecode("bad error object")
+		}
+		if strictBody.Code == nil || strictBody.Message == nil {
+			return nil, errdecode("error object requires code and message")
 		}
-		return []interface{}{intfparams}, false, nil
+		return &RPCError{*strictBody.Code, *strictBody.Message, strictBody.Data}, nil
+	}
+
+	var errbody RPCError
+	errdec := json.NewDecoder(bytes.NewReader(data))
+	errdec.UseNumber()
+	if err := errdec.Decode(&errbody); err != nil {
+		return nil, errdecode("bad error object")
 	}
-	return arr, true, nil
+	return &errbody, nil
 }
 
 func DecodeMessage(decoder *json.Decoder) (Message, error) {
-	decoder.UseNumber()
-	var un msgUnion
-	if err := decoder.Decode(&un); err != nil {
+	return DecodeMessageWithOptions(decoder, DecodeOptions{})
+}
+
+func DecodeMessageWithOptions(decoder *json.Decoder, opts DecodeOptions) (Message, error) {
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
 		return nil, err
 	}
+	return decodeRaw(raw, opts)
+}
 
-	if un.Error != nil {
-		// senity check
-		if un.Result != nil {
-			return nil, errdecode("result and error cannot co exist")
+func decodeRaw(data []byte, opts DecodeOptions) (msg Message, err error) {
+	sc := scanner{data: data}
+	sc.skipSpace()
+	if sc.pos < len(data) && data[sc.pos] == '[' {
+		msg, err = decodeBatch(data[sc.pos:], opts)
+	} else {
+		msg, err = decodeSingle(data, opts)
+	}
+	if err == errSyntax {
+		// let encoding/json report the syntax error
+		return nil, syntaxError(data)
+	}
+	return msg, err
+}
+
+// decode a batch, elements failed to decode are turned into error
+// messages, carrying the ids if they can be recovered.
+func decodeBatch(data []byte, opts DecodeOptions) (Message, error) {
+	var elems [][]byte
+	sc := scanner{data: data}
+	if err := sc.array(func(elem []byte) error {
+		elems = append(elems, elem)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if len(elems) == 0 {
+		return nil, errdecode("empty batch")
+	}
+	msgs := make([]Message, 0, len(elems))
+	for _, elem := range elems {
+		msg, err := decodeSingle(elem, opts)
+		if err != nil {
+			msg = NewDecodeErrorMessage(err)
 		}
-		// parse error body
-		var errbody RPCError
-		errdec := json.NewDecoder(bytes.NewReader(*un.Error))
-		errdec.UseNumber()
-		if err := errdec.Decode(&errbody); err != nil {
-			return nil, err
+		msgs = append(msgs, msg)
+	}
+	return NewBatchMessage(msgs), nil
+}
+
+func decodeSingle(data []byte, opts DecodeOptions) (Message, error) {
+	un, err := scanUnion(data)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := decodeId(un, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// invalid returns a decode error attached with message id
+	invalid := func(err error) error {
+		var decErr *decodeErrorT
+		if errors.As(err, &decErr) {
+			decErr.id = id
+			return decErr
 		}
+		return err
+	}
 
-		id, err := decodeId(&un)
+	jsonrpc, err := decodeString("jsonrpc", un.Jsonrpc)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	method, err := decodeString("method", un.Method)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	traceId, err := decodeString("traceid", un.TraceId)
+	if err != nil {
+		return nil, invalid(err)
+	}
+
+	md, err := decodeMetadata(un.Metadata, opts)
+	if err != nil {
+		return nil, invalid(err)
+	}
+
+	if opts.Strict && jsonrpc != "2.0" {
+		return nil, invalid(errdecode("jsonrpc version is not 2.0"))
+	}
+
+	if un.Error != nil && !isNull(un.Error) {
+		// senity check
+		if un.Result != nil && !isNull(un.Result) {
+			return nil, invalid(errdecode("result and error cannot co exist"))
+		}
+		if opts.Strict && un.Id == nil {
+			return nil, invalid(errdecode("no id field"))
+		}
+		// parse error body
+		errbody, err := decodeErrorBody(un.Error, opts)
 		if err != nil {
-			return nil, err
+			return nil, invalid(err)
 		}
 
-		errmsg := rawErrorMessage(id, &errbody)
-		errmsg.SetTraceId(un.TraceId)
+		errmsg := rawErrorMessage(id, errbody)
+		errmsg.SetTraceId(traceId)
+		errmsg.SetMetadata(md)
 		return errmsg, nil
 	} else if un.Result != nil {
-		if un.Error != nil {
-			return nil, errdecode("result and error cannot co exist")
+		if opts.Strict && un.Id == nil {
+			return nil, invalid(errdecode("no id field"))
 		}
-
-		// parse result
-		var res interface{}
-		resdec := json.NewDecoder(bytes.NewReader(*un.Result))
-		resdec.UseNumber()
-		if err := resdec.Decode(&res); err != nil {
-			return nil, err
+		if id == nil && !opts.Strict && isNull(un.Result) {
+			return nil, invalid(errdecode("not a jsonrpc message"))
 		}
 
-		id, err := decodeId(&un)
-		if err != nil {
-			return nil, err
+		resmsg := rawResultMessage(id, nil)
+		if !isNull(un.Result) {
+			resmsg.rawResult = newRawValue(un.Result)
+			if !opts.LazyValues {
+				resmsg.loadRawResult()
+			}
 		}
-
-		resmsg := rawResultMessage(id, res)
-		resmsg.SetTraceId(un.TraceId)
+		resmsg.SetTraceId(traceId)
+		resmsg.SetMetadata(md)
 		return resmsg, nil
-	} else if un.Method != "" {
-		params, islist, err := decodeParams(&un)
-		if err != nil {
-			return nil, err
+	} else if method != "" {
+		if opts.Strict && un.Id != nil && id == nil {
+			return nil, invalid(errdecode("null id is not supported"))
 		}
-
-		id, err := decodeId(&un)
+		rawParams, islist, err := decodeParams(un, opts)
 		if err != nil {
-			return nil, err
+			return nil, invalid(err)
 		}
 
 		if id != nil {
-			reqmsg := NewRequestMessage(id, un.Method, params)
-			reqmsg.paramsAreList = islist
-			reqmsg.SetTraceId(un.TraceId)
+			reqmsg := NewRequestMessage(id, method, nil)
+			reqmsg.setRawParams(rawParams, islist)
+			if !opts.LazyValues {
+				reqmsg.loadRawParams()
+			}
+			reqmsg.SetTraceId(traceId)
+			reqmsg.SetMetadata(md)
 			return reqmsg, nil
 		} else {
-			ntfmsg := NewNotifyMessage(un.Method, params)
-			ntfmsg.paramsAreList = islist
-			ntfmsg.SetTraceId(un.TraceId)
+			ntfmsg := NewNotifyMessage(method, nil)
+			ntfmsg.setRawParams(rawParams, islist)
+			if !opts.LazyValues {
+				ntfmsg.loadRawParams()
+			}
+			ntfmsg.SetTraceId(traceId)
+			ntfmsg.SetMetadata(md)
 			return ntfmsg, nil
 		}
-	} else if un.Id != nil {
-		// parse id
-		id, err := decodeId(&un)
-		if err != nil {
-			return nil, err
-		}
-
+	} else if opts.Strict && un.Id != nil {
+		return nil, invalid(errdecode("no result or error field"))
+	} else if id != nil {
 		// result is null
 		resmsg := rawResultMessage(id, nil)
-		resmsg.SetTraceId(un.TraceId)
+		resmsg.SetTraceId(traceId)
+		resmsg.SetMetadata(md)
 		return resmsg, nil
 	}
-	return nil, errdecode("not a jsonrpc message")
+	return nil, invalid(errdecode("not a jsonrpc message"))
 }
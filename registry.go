@@ -0,0 +1,217 @@
+package jlib
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"reflect"
+	"sync"
+)
+
+// ErrorRegistry maps golang errors to RPCErrors and back, so that a
+// server handler may return plain golang errors and a client gets
+// the same errors from the error messages.
+//
+// Applications register ranges of codes they own, then sentinel
+// errors and error types with codes out of the ranges. Errors are
+// matched with errors.Is and errors.As in the order of registration.
+type ErrorRegistry struct {
+	lock     sync.RWMutex
+	ranges   []errorRange
+	mappings []*errorMapping
+	codes    map[int]*errorMapping
+}
+
+type errorRange struct {
+	name     string
+	min, max int
+}
+
+type errorMapping struct {
+	code    int
+	message string
+	// match checks the error and returns the data of RPCError
+	match func(err error) (data interface{}, ok bool)
+	// fromRPC converts a RPCError back into golang error
+	fromRPC func(rpcErr *RPCError) error
+}
+
+// RemoteError is the golang error converted from a RPCError, it
+// unwraps to the registered error and can be taken as the original
+// *RPCError via errors.As
+type RemoteError struct {
+	RPCError *RPCError
+	err      error
+}
+
+func (self *RemoteError) Error() string {
+	return self.err.Error()
+}
+
+func (self *RemoteError) Unwrap() error {
+	return self.err
+}
+
+func (self *RemoteError) As(target interface{}) bool {
+	if p, ok := target.(**RPCError); ok {
+		*p = self.RPCError
+		return true
+	}
+	return false
+}
+
+// DefaultErrorRegistry is used by actors and clients which are not
+// given a registry
+var DefaultErrorRegistry = NewErrorRegistry()
+
+func NewErrorRegistry() *ErrorRegistry {
+	return &ErrorRegistry{
+		codes: make(map[int]*errorMapping),
+	}
+}
+
+// RegisterRange claims the codes from min to max(inclusive) under a
+// name, ranges cannot overlap with each other, with the codes
+// reserved by the JSONRPC spec or with the codes of jlib's errors.
+func (self *ErrorRegistry) RegisterRange(name string, min, max int) error {
+	if min > max {
+		return errors.Errorf("bad error code range %d to %d", min, max)
+	}
+	if min <= ReservedCodeMax && max >= ReservedCodeMin {
+		return errors.Errorf("error code range %s overlaps with the reserved codes", name)
+	}
+	for _, rpcErr := range builtinErrors {
+		if rpcErr.Code >= min && rpcErr.Code <= max {
+			return errors.Errorf("error code range %s overlaps with %s", name, rpcErr.Message)
+		}
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, r := range self.ranges {
+		if min <= r.max && max >= r.min {
+			return errors.Errorf("error code range %s overlaps with %s", name, r.name)
+		}
+	}
+	self.ranges = append(self.ranges, errorRange{name: name, min: min, max: max})
+	return nil
+}
+
+// RegisterSentinel maps a sentinel error, the errors matching
+// errors.Is(err, target) are converted to RPCError with code and
+// message, the message defaults to target.Error() if it's empty.
+func (self *ErrorRegistry) RegisterSentinel(target error, code int, message string) error {
+	if message == "" {
+		message = target.Error()
+	}
+	return self.register(&errorMapping{
+		code:    code,
+		message: message,
+		match: func(err error) (interface{}, bool) {
+			return nil, errors.Is(err, target)
+		},
+		fromRPC: func(rpcErr *RPCError) error {
+			return target
+		},
+	})
+}
+
+// RegisterErrorType maps an error type, the errors matching
+// errors.As(err, *T) are converted to RPCError with the code, the
+// error value is marshaled as the data and unmarshaled back on the
+// client side, the message defaults to err.Error() if it's empty.
+func RegisterErrorType[T error](registry *ErrorRegistry, code int, message string) error {
+	errType := reflect.TypeOf((*T)(nil)).Elem()
+	return registry.register(&errorMapping{
+		code:    code,
+		message: message,
+		match: func(err error) (interface{}, bool) {
+			var target T
+			if errors.As(err, &target) {
+				return target, true
+			}
+			return nil, false
+		},
+		fromRPC: func(rpcErr *RPCError) error {
+			data, err := json.Marshal(rpcErr.Data)
+			if err != nil {
+				return rpcErr
+			}
+			var v reflect.Value
+			if errType.Kind() == reflect.Ptr {
+				v = reflect.New(errType.Elem())
+				if err := json.Unmarshal(data, v.Interface()); err != nil {
+					return rpcErr
+				}
+			} else {
+				v = reflect.New(errType)
+				if err := json.Unmarshal(data, v.Interface()); err != nil {
+					return rpcErr
+				}
+				v = v.Elem()
+			}
+			if target, ok := v.Interface().(T); ok {
+				return target
+			}
+			return rpcErr
+		},
+	})
+}
+
+func (self *ErrorRegistry) register(mapping *errorMapping) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.codes[mapping.code]; ok {
+		return errors.Errorf("error code %d already registered", mapping.code)
+	}
+	inRange := false
+	for _, r := range self.ranges {
+		if mapping.code >= r.min && mapping.code <= r.max {
+			inRange = true
+			break
+		}
+	}
+	if !inRange {
+		return errors.Errorf("error code %d is not in any registered range", mapping.code)
+	}
+	self.mappings = append(self.mappings, mapping)
+	self.codes[mapping.code] = mapping
+	return nil
+}
+
+// ToRPCError converts a golang error into RPCError, an error which
+// already is a *RPCError is returned as it is, returns false if the
+// error is not registered.
+func (self *ErrorRegistry) ToRPCError(err error) (*RPCError, bool) {
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr, true
+	}
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	for _, mapping := range self.mappings {
+		if data, ok := mapping.match(err); ok {
+			message := mapping.message
+			if message == "" {
+				message = err.Error()
+			}
+			return &RPCError{mapping.code, message, data}, true
+		}
+	}
+	return nil, false
+}
+
+// FromRPCError converts a RPCError back into the registered golang
+// error wrapped in a *RemoteError, the RPCError itself is returned if
+// the code is not registered.
+func (self *ErrorRegistry) FromRPCError(rpcErr *RPCError) error {
+	self.lock.RLock()
+	mapping, ok := self.codes[rpcErr.Code]
+	self.lock.RUnlock()
+	if !ok {
+		return rpcErr
+	}
+	err := mapping.fromRPC(rpcErr)
+	if err == error(rpcErr) {
+		return rpcErr
+	}
+	return &RemoteError{RPCError: rpcErr, err: err}
+}
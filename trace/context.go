@@ -0,0 +1,182 @@
+// jlibtrace propagates W3C trace context(https://www.w3.org/TR/trace-context/)
+// along jsonrpc messages and creates spans around calls via a small
+// tracer interface, which can be adapted to OpenTelemetry.
+package jlibtrace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"github.com/superisaac/jlib"
+	"strings"
+)
+
+// the metadata keys of trace context, also used as http header names
+const (
+	TraceparentKey = "traceparent"
+	TracestateKey  = "tracestate"
+)
+
+const (
+	// FlagSampled is the sampled bit of trace flags
+	FlagSampled = 0x01
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (self TraceID) String() string {
+	return hex.EncodeToString(self[:])
+}
+
+func (self TraceID) IsValid() bool {
+	return self != TraceID{}
+}
+
+func (self SpanID) String() string {
+	return hex.EncodeToString(self[:])
+}
+
+func (self SpanID) IsValid() bool {
+	return self != SpanID{}
+}
+
+// TraceContext is the trace context carried across processes
+type TraceContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+	// State is the vendor specific tracestate, kept as it is
+	State string
+}
+
+func (self TraceContext) IsValid() bool {
+	return self.TraceID.IsValid() && self.SpanID.IsValid()
+}
+
+func (self TraceContext) IsSampled() bool {
+	return self.Flags&FlagSampled != 0
+}
+
+// Traceparent formats the trace context as the traceparent header
+func (self TraceContext) Traceparent() string {
+	return "00-" + self.TraceID.String() + "-" + self.SpanID.String() + "-" + hex.EncodeToString([]byte{self.Flags})
+}
+
+// ParseTraceparent parses the traceparent header value
+func ParseTraceparent(traceparent string) (TraceContext, error) {
+	var tc TraceContext
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 {
+		return tc, errors.New("bad traceparent")
+	}
+	version := parts[0]
+	if len(version) != 2 || !isLowerHex(version) || version == "ff" {
+		return tc, errors.New("bad traceparent version")
+	}
+	if version == "00" && len(parts) != 4 {
+		return tc, errors.New("bad traceparent")
+	}
+	if err := decodeHex(parts[1], tc.TraceID[:]); err != nil {
+		return tc, errors.Wrap(err, "bad trace id")
+	}
+	if err := decodeHex(parts[2], tc.SpanID[:]); err != nil {
+		return tc, errors.Wrap(err, "bad span id")
+	}
+	var flags [1]byte
+	if err := decodeHex(parts[3], flags[:]); err != nil {
+		return tc, errors.Wrap(err, "bad trace flags")
+	}
+	tc.Flags = flags[0]
+	if !tc.IsValid() {
+		return tc, errors.New("invalid trace context")
+	}
+	return tc, nil
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeHex(s string, dst []byte) error {
+	if len(s) != len(dst)*2 || !isLowerHex(s) {
+		return errors.New("bad hex length or chars")
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+// NewTraceID generates a random trace id
+func NewTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// NewSpanID generates a random span id
+func NewSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// FromMetadata extracts the trace context from message metadata
+func FromMetadata(md jlib.Metadata) (TraceContext, bool) {
+	traceparent := md.Get(TraceparentKey)
+	if traceparent == "" {
+		return TraceContext{}, false
+	}
+	tc, err := ParseTraceparent(traceparent)
+	if err != nil {
+		return TraceContext{}, false
+	}
+	tc.State = md.Get(TracestateKey)
+	return tc, true
+}
+
+// Inject sets the trace context into the metadata of msg, the
+// metadata is copied so that the map shared with other messages is
+// untouched.
+func Inject(msg jlib.Message, tc TraceContext) {
+	md := msg.Metadata().Clone()
+	if md == nil {
+		md = make(jlib.Metadata)
+	}
+	md[TraceparentKey] = tc.Traceparent()
+	if tc.State != "" {
+		md[TracestateKey] = tc.State
+	} else {
+		delete(md, TracestateKey)
+	}
+	msg.SetMetadata(md)
+}
+
+type spanContextKeyType int
+
+var spanContextKey spanContextKeyType = 1
+
+// ContextWithSpan returns a context carrying the span, the spans
+// started from the context become children of it.
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanContextKey, span)
+}
+
+// SpanFromContext returns the span carried by the context
+func SpanFromContext(ctx context.Context) (Span, bool) {
+	if v := ctx.Value(spanContextKey); v != nil {
+		span, ok := v.(Span)
+		return span, ok
+	}
+	return nil, false
+}
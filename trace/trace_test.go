@@ -0,0 +1,77 @@
+package jlibtrace
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/superisaac/jlib"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	assert := assert.New(t)
+
+	tc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.Nil(err)
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", tc.TraceID.String())
+	assert.Equal("00f067aa0ba902b7", tc.SpanID.String())
+	assert.True(tc.IsSampled())
+	assert.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", tc.Traceparent())
+
+	// future versions may carry more fields
+	_, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	assert.Nil(err)
+
+	badCases := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+	for _, c := range badCases {
+		_, err := ParseTraceparent(c)
+		assert.NotNil(err, c)
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	assert := assert.New(t)
+
+	tracer := NewMemoryTracer()
+	reqmsg := jlib.NewRequestMessage(1, "add", []interface{}{1, 2})
+	reqmsg.SetMeta(TraceparentKey, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	reqmsg.SetMeta(TracestateKey, "vendor=abc")
+	sharedMd := reqmsg.Metadata()
+
+	ctx, clientSpan := StartClientSpan(context.Background(), tracer, reqmsg)
+	_, ok := SpanFromContext(ctx)
+	assert.True(ok)
+	// the metadata is copied on injection
+	assert.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sharedMd.Get(TraceparentKey))
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", clientSpan.TraceContext().TraceID.String())
+
+	// the remote side
+	msg, err := jlib.ParseBytes([]byte(jlib.MessageString(reqmsg)))
+	assert.Nil(err)
+	tc, ok := FromMetadata(msg.Metadata())
+	assert.True(ok)
+	assert.Equal(clientSpan.TraceContext().SpanID, tc.SpanID)
+	assert.Equal("vendor=abc", tc.State)
+
+	_, serverSpan := StartServerSpan(context.Background(), tracer, msg)
+	EndSpan(serverSpan, jlib.ErrMethodNotFound.ToMessage(reqmsg), nil)
+	EndSpan(clientSpan, nil, nil)
+
+	spans := tracer.Spans()
+	assert.Equal(2, len(spans))
+	assert.Equal(SpanKindServer, spans[0].Kind)
+	assert.Equal(clientSpan.TraceContext().TraceID, spans[0].Context.TraceID)
+	assert.Equal(clientSpan.TraceContext().SpanID, spans[0].ParentID)
+	assert.Equal("add", spans[0].Name)
+	assert.Equal(jlib.ErrMethodNotFound.Code, spans[0].Attributes[AttrRPCErrorCode])
+	assert.NotNil(spans[0].Err)
+	assert.Equal(SpanKindClient, spans[1].Kind)
+	assert.Nil(spans[1].Err)
+}
@@ -0,0 +1,188 @@
+package jlibtrace
+
+import (
+	"context"
+	"github.com/superisaac/jlib"
+	"sync"
+	"time"
+)
+
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = iota
+	SpanKindServer
+	SpanKindClient
+)
+
+// Span is a unit of work in a trace, the methods follow the
+// OpenTelemetry span so that an adaptor is straightforward
+type Span interface {
+	// the trace context to propagate, the span id is of this span
+	TraceContext() TraceContext
+	SetAttribute(key string, value interface{})
+	// record an error and mark the span failed
+	SetError(err error)
+	End()
+}
+
+// Tracer starts spans, parent is the remote trace context, which is
+// invalid if there is no remote parent, a span carried by ctx
+// takes precedence over the remote parent.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string, kind SpanKind, parent TraceContext) (context.Context, Span)
+}
+
+// the attribute keys follow the OpenTelemetry semantic conventions
+// for JSON-RPC
+const (
+	AttrRPCSystem    = "rpc.system"
+	AttrRPCMethod    = "rpc.method"
+	AttrRPCVersion   = "rpc.jsonrpc.version"
+	AttrRPCRequestId = "rpc.jsonrpc.request_id"
+	AttrRPCErrorCode = "rpc.jsonrpc.error_code"
+	AttrRPCErrorMsg  = "rpc.jsonrpc.error_message"
+)
+
+func setMessageAttributes(span Span, msg jlib.Message) {
+	span.SetAttribute(AttrRPCSystem, "jsonrpc")
+	span.SetAttribute(AttrRPCVersion, "2.0")
+	span.SetAttribute(AttrRPCMethod, msg.MustMethod())
+	if msg.IsRequest() {
+		span.SetAttribute(AttrRPCRequestId, msg.MustId())
+	}
+}
+
+// StartServerSpan starts a span for an incoming Request or Notify
+// message, the remote parent is extracted from message metadata.
+func StartServerSpan(ctx context.Context, tracer Tracer, msg jlib.Message) (context.Context, Span) {
+	parent, _ := FromMetadata(msg.Metadata())
+	ctx, span := tracer.StartSpan(ctx, msg.MustMethod(), SpanKindServer, parent)
+	setMessageAttributes(span, msg)
+	return ctx, span
+}
+
+// StartClientSpan starts a span for an outgoing Request or Notify
+// message and injects the trace context into the message metadata.
+func StartClientSpan(ctx context.Context, tracer Tracer, msg jlib.Message) (context.Context, Span) {
+	parent, _ := FromMetadata(msg.Metadata())
+	ctx, span := tracer.StartSpan(ctx, msg.MustMethod(), SpanKindClient, parent)
+	setMessageAttributes(span, msg)
+	Inject(msg, span.TraceContext())
+	return ctx, span
+}
+
+// EndSpan records the outcome of a call and ends the span, resmsg
+// may be nil for notifies.
+func EndSpan(span Span, resmsg jlib.Message, err error) {
+	if err != nil {
+		span.SetError(err)
+	} else if resmsg != nil && resmsg.IsError() {
+		rpcErr := resmsg.MustError()
+		span.SetAttribute(AttrRPCErrorCode, rpcErr.Code)
+		span.SetAttribute(AttrRPCErrorMsg, rpcErr.Message)
+		span.SetError(rpcErr)
+	}
+	span.End()
+}
+
+// MemoryTracer keeps the ended spans in memory, it's useful in tests
+type MemoryTracer struct {
+	lock  sync.Mutex
+	spans []*MemorySpan
+}
+
+type MemorySpan struct {
+	Name       string
+	Kind       SpanKind
+	Context    TraceContext
+	ParentID   SpanID
+	Attributes map[string]interface{}
+	Err        error
+	StartTime  time.Time
+	EndTime    time.Time
+
+	tracer *MemoryTracer
+	lock   sync.Mutex
+	ended  bool
+}
+
+func NewMemoryTracer() *MemoryTracer {
+	return &MemoryTracer{}
+}
+
+func (self *MemoryTracer) StartSpan(ctx context.Context, name string, kind SpanKind, parent TraceContext) (context.Context, Span) {
+	if parentSpan, ok := SpanFromContext(ctx); ok {
+		parent = parentSpan.TraceContext()
+	}
+	span := &MemorySpan{
+		Name:       name,
+		Kind:       kind,
+		Attributes: make(map[string]interface{}),
+		StartTime:  time.Now(),
+		tracer:     self,
+	}
+	if parent.IsValid() {
+		span.Context = TraceContext{
+			TraceID: parent.TraceID,
+			SpanID:  NewSpanID(),
+			Flags:   parent.Flags,
+			State:   parent.State,
+		}
+		span.ParentID = parent.SpanID
+	} else {
+		span.Context = TraceContext{
+			TraceID: NewTraceID(),
+			SpanID:  NewSpanID(),
+			Flags:   FlagSampled,
+		}
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+// Spans returns the ended spans in the order of ending
+func (self *MemoryTracer) Spans() []*MemorySpan {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	spans := make([]*MemorySpan, len(self.spans))
+	copy(spans, self.spans)
+	return spans
+}
+
+// Reset clears the ended spans
+func (self *MemoryTracer) Reset() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.spans = nil
+}
+
+func (self *MemorySpan) TraceContext() TraceContext {
+	return self.Context
+}
+
+func (self *MemorySpan) SetAttribute(key string, value interface{}) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.Attributes[key] = value
+}
+
+func (self *MemorySpan) SetError(err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.Err = err
+}
+
+func (self *MemorySpan) End() {
+	self.lock.Lock()
+	if self.ended {
+		self.lock.Unlock()
+		return
+	}
+	self.ended = true
+	self.EndTime = time.Now()
+	self.lock.Unlock()
+
+	self.tracer.lock.Lock()
+	defer self.tracer.lock.Unlock()
+	self.tracer.spans = append(self.tracer.spans, self)
+}
@@ -13,6 +13,7 @@ const (
 	MKNotify
 	MKResult
 	MKError
+	MKBatch
 )
 
 // RPC error object
@@ -29,7 +30,8 @@ type RPCError struct {
 //
 //	Notify method params |
 //	Result id result |
-//	Error id error={ code message data }
+//	Error id error={ code message data } |
+//	Batch [Message]
 type Message interface {
 	// Return's the judgement of message types
 	IsRequest() bool
@@ -38,12 +40,20 @@ type Message interface {
 	IsResult() bool
 	IsError() bool
 	IsResultOrError() bool
+	IsBatch() bool
 
 	// TraceId can be used to analyse the flow of whole message
 	// transportation
 	SetTraceId(traceId string)
 	TraceId() string
 
+	// Metadata carries out-of-band key value pairs of a message,
+	// like tenant ids, deadlines and baggage, metadata is encoded
+	// as an object under the key MetadataKey
+	Metadata() Metadata
+	SetMetadata(md Metadata)
+	SetMeta(key string, value string)
+
 	// Returns template structures, this structure can be used to
 	// marshal and turn into map
 	Interface() interface{}
@@ -65,10 +75,28 @@ type Message interface {
 	// message is a Result or Error
 	MustParams() []interface{}
 
+	// NamedParams returns the params of a message as a map when
+	// the params are given by name, returns nil if params are
+	// given by position, will panic when message is a Result or
+	// Error
+	NamedParams() map[string]interface{}
+
 	// MustResult returns the result field of a message, will
 	// panic when the message is not a Result
 	MustResult() interface{}
 
+	// DecodeParamsInto decodes the params into v following the
+	// semantics of encoding/json, i.e. json.Unmarshaler
+	// implementations are respected, v receives an array for
+	// positional params and an object for named params. Returns
+	// an error when the message is not a Request or Notify
+	DecodeParamsInto(v interface{}) error
+
+	// DecodeResultInto decodes the result into v following the
+	// semantics of encoding/json, returns an error when the message
+	// is not a Result
+	DecodeResultInto(v interface{}) error
+
 	// MustError returns the error field of a message, will panic
 	// when the message is not an Error
 	MustError() *RPCError
@@ -81,19 +109,30 @@ type Message interface {
 	Log() *log.Entry
 }
 
+// Metadata is the out-of-band key value pairs of a message
+type Metadata map[string]string
+
+// MetadataKey is the key under which metadata is encoded in a
+// message object
+var MetadataKey = "metadata"
+
 // The base class of JSONRPC types
 type BaseMessage struct {
-	kind    int
-	traceId string
+	kind     int
+	traceId  string
+	metadata Metadata
 }
 
 // Request message kind
 type RequestMessage struct {
 	BaseMessage
-	Id            interface{}
-	Method        string
+	Id     interface{}
+	Method string
+	// Params of a message decoded with DecodeOptions.LazyValues is
+	// nil, the raw json is decoded by MustParams()
 	Params        []interface{}
 	paramsAreList bool
+	rawParams     *rawValue
 
 	// request specific fields
 }
@@ -101,16 +140,22 @@ type RequestMessage struct {
 // Notify message kind
 type NotifyMessage struct {
 	BaseMessage
-	Method        string
+	Method string
+	// Params of a message decoded with DecodeOptions.LazyValues is
+	// nil, the raw json is decoded by MustParams()
 	Params        []interface{}
 	paramsAreList bool
+	rawParams     *rawValue
 }
 
 // Result message kind
 type ResultMessage struct {
 	BaseMessage
-	Id     interface{}
-	Result interface{}
+	Id interface{}
+	// Result of a message decoded with DecodeOptions.LazyValues is
+	// nil, the raw json is decoded by MustResult()
+	Result    interface{}
+	rawResult *rawValue
 }
 
 // Error message kind
@@ -120,6 +165,12 @@ type ErrorMessage struct {
 	Error *RPCError
 }
 
+// Batch message kind, a list of messages sent or received as a whole
+type BatchMessage struct {
+	BaseMessage
+	Messages []Message
+}
+
 // marshaling templates
 type templateRequest struct {
 	Jsonrpc string      `json:"jsonrpc"`